@@ -2,22 +2,44 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"embed"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
 	"io"
+	"io/fs"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
 )
 
 // ============================================================================
@@ -40,32 +62,82 @@ type Job struct {
 
 // Phase 2: Multi-video story generation
 type Project struct {
-	ID                string      `json:"id"`
-	Name              string      `json:"name"`
-	DogName           string      `json:"dog_name"`
-	DogBreed          string      `json:"dog_breed,omitempty"`
-	OwnerRelationship string      `json:"owner_relationship,omitempty"` // 主人與毛小孩的關係 (媽媽/爸爸/小主人等)
-	StoryMode         string      `json:"story_mode,omitempty"`         // 故事模式: warm(溫馨感人), cute(可愛活潑), funny(幽默風趣)
-	EndingImage       string      `json:"ending_image,omitempty"`       // 結尾圖片路徑
-	OwnerMessage      string      `json:"owner_message,omitempty"`      // 主人想對狗狗說的話
-	Status            string      `json:"status"`                       // pending, analyzing, generating_story, generating_video, completed, failed
-	Videos            []VideoInfo `json:"videos"`
-	Story             *Story      `json:"story,omitempty"`
-	FinalVideo        string      `json:"final_video,omitempty"`
-	CreatedAt         time.Time   `json:"created_at"`
-	UpdatedAt         time.Time   `json:"updated_at"`
-	Error             string      `json:"error,omitempty"`
+	ID                 string                    `json:"id"`
+	Name               string                    `json:"name"`
+	DogName            string                    `json:"dog_name"` // 毛小孩名字（多隻時為所有名字），保留給舊的 API 使用
+	DogBreed           string                    `json:"dog_breed,omitempty"`
+	Pets               []PetInfo                 `json:"pets,omitempty"`                // 專案中的所有毛小孩
+	NarrationStyle     string                    `json:"narration_style,omitempty"`     // 多隻毛小孩時的說話方式: multi(輪流說話), collective(用「我們」一起說)
+	OwnerRelationship  string                    `json:"owner_relationship,omitempty"`  // 主人與毛小孩的關係 (媽媽/爸爸/小主人等)
+	StoryMode          string                    `json:"story_mode,omitempty"`          // 故事模式: warm(溫馨感人), cute(可愛活潑), funny(幽默風趣)，或 prompts/modes 中的自訂模式
+	StoryModeVersion   int                       `json:"story_mode_version,omitempty"`  // 建立專案時使用的模式版本
+	Occasion           string                    `json:"occasion,omitempty"`            // 影片的場合: memorial(預設), birthday, gotcha_day, new_puppy，或 prompts/occasions 中的自訂場合
+	PhotoMotion        string                    `json:"photo_motion,omitempty"`        // 照片的運鏡方式: auto(預設), zoom_in, zoom_out, pan_left, pan_right, none
+	PhotoZoom          float64                   `json:"photo_zoom,omitempty"`          // 照片運鏡的最大放大倍率，預設 1.2
+	Transition         string                    `json:"transition,omitempty"`          // 章節之間的轉場: dissolve(預設), wipe, slide, circle_open, fade_white, fade_black
+	TransitionDuration float64                   `json:"transition_duration,omitempty"` // 轉場秒數，預設 0.8
+	TimingStrategy     string                    `json:"timing_strategy,omitempty"`     // 畫面比旁白短時的補足方式: extend(預設), freeze, loop, slow
+	NarrationPadding   *float64                  `json:"narration_padding,omitempty"`   // 旁白結束後保留的秒數 0～3，nil 使用預設 0.5
+	Language           string                    `json:"language,omitempty"`            // 故事、旁白與字幕的語言: zh-TW(預設), zh-CN, en, ja
+	EndingImage        string                    `json:"ending_image,omitempty"`        // 結尾圖片路徑
+	EndingTemplate     string                    `json:"ending_template,omitempty"`     // 結尾卡片版面: classic(預設), message, name_dates, paw_frame, polaroid
+	EndingDuration     float64                   `json:"ending_duration,omitempty"`     // 結尾秒數 5～30，預設 15
+	EndingStartDate    string                    `json:"ending_start_date,omitempty"`   // 結尾卡片的日期區間 YYYY-MM-DD，空白時使用毛小孩檔案的生日
+	EndingEndDate      string                    `json:"ending_end_date,omitempty"`
+	OwnerMessage       string                    `json:"owner_message,omitempty"` // 主人想對狗狗說的話
+	Status             string                    `json:"status"`                  // pending, analyzing, generating_story, generating_video, completed, failed
+	Videos             []VideoInfo               `json:"videos"`
+	Story              *Story                    `json:"story,omitempty"`
+	DraftCount         int                       `json:"draft_count,omitempty"`    // 要產生幾份候選故事，大於 1 時會等使用者選擇後才開始合成
+	StoryDrafts        []*Story                  `json:"story_drafts,omitempty"`   // 候選故事
+	SelectedDraft      int                       `json:"selected_draft,omitempty"` // 使用者選擇的候選故事（從 1 開始，0 代表尚未選擇）
+	OutputFormats      []string                  `json:"output_formats,omitempty"` // 要輸出的比例: 16:9(預設), 9:16, 1:1, 4:5，第一個為主要格式
+	Framing            string                    `json:"framing,omitempty"`        // 比例不同時的構圖: smart(預設，跟著毛小孩裁切), fit(保留完整畫面)
+	FillMode           string                    `json:"fill_mode,omitempty"`      // 保留完整畫面時空白處的填充: blur(預設), black, color, pattern
+	FillColor          string                    `json:"fill_color,omitempty"`     // color/pattern 使用的顏色 #RRGGBB，空白時使用場合的主題色
+	SubtitleMode       string                    `json:"subtitle_mode,omitempty"`  // 字幕: burn(預設，燒錄在畫面上), soft(可開關的字幕軌), both, none
+	Typography         *TypographySettings       `json:"typography,omitempty"`     // 結尾卡片與字幕的字體、字級、顏色與外框，nil 使用預設
+	AudioMix           *AudioMixSettings         `json:"audio_mix,omitempty"`      // 背景音樂的音量、旁白時的閃避與淡入淡出，nil 使用預設
+	MusicTrackID       string                    `json:"music_track_id,omitempty"` // 背景音樂: 音樂庫的曲目 ID 或 custom（上傳的歌曲），空白時依場合與故事模式自動挑選
+	CustomMusic        string                    `json:"custom_music,omitempty"`   // 上傳的歌曲路徑
+	CustomMusicTitle   string                    `json:"custom_music_title,omitempty"`
+	FinalVideo         string                    `json:"final_video,omitempty"`
+	FinalVideos        map[string]string         `json:"final_videos,omitempty"` // 各比例的成品路徑
+	Loudness           map[string]*LoudnessStats `json:"loudness,omitempty"`     // 各比例成品的響度量測
+	CreatedAt          time.Time                 `json:"created_at"`
+	UpdatedAt          time.Time                 `json:"updated_at"`
+	Error              string                    `json:"error,omitempty"`
+}
+
+// PetInfo 專案中的一隻毛小孩
+type PetInfo struct {
+	ProfileID   string `json:"profile_id,omitempty"` // 連結的毛小孩檔案，prompt 會使用檔案中的最新資料
+	Name        string `json:"name"`
+	Species     string `json:"species"` // dog, cat, rabbit, hamster, guinea_pig, bird, ferret, other
+	Breed       string `json:"breed,omitempty"`
+	Personality string `json:"personality,omitempty"`
 }
 
 type VideoInfo struct {
-	ID           string      `json:"id"`
-	OriginalName string      `json:"original_name"`
-	Path         string      `json:"path"`
-	Duration     float64     `json:"duration"`
-	FramesDir    string      `json:"frames_dir"`
-	Analyzed     bool        `json:"analyzed"`
-	Segments     []Segment   `json:"segments,omitempty"`
-	Highlights   []Highlight `json:"highlights,omitempty"`
+	ID           string  `json:"id"`
+	OriginalName string  `json:"original_name"`
+	MediaType    string  `json:"media_type"` // video 或 photo
+	Path         string  `json:"path"`
+	Duration     float64 `json:"duration"` // 照片為沒有旁白時的預設停留秒數
+
+	Width         int    `json:"width,omitempty"`          // 編碼的寬度
+	Height        int    `json:"height,omitempty"`         // 編碼的高度
+	Rotation      int    `json:"rotation"`                 // 播放時要順時針旋轉的角度
+	DisplayWidth  int    `json:"display_width,omitempty"`  // 旋轉後的實際寬度，版面配置請用這個
+	DisplayHeight int    `json:"display_height,omitempty"` // 旋轉後的實際高度
+	Orientation   string `json:"orientation,omitempty"`    // landscape, portrait, square
+	HasAudio      bool   `json:"has_audio"`                // 影片有原音，可以保留在旁白下面
+
+	FramesDir  string      `json:"frames_dir"`
+	Analyzed   bool        `json:"analyzed"`
+	Segments   []Segment   `json:"segments,omitempty"`
+	Highlights []Highlight `json:"highlights,omitempty"`
+	PetTrack   []PetBox    `json:"pet_track,omitempty"` // 每張截圖中毛小孩的位置，供直橫轉換時裁切
 }
 
 type Story struct {
@@ -74,6 +146,18 @@ type Story struct {
 	OwnerMessage string         `json:"owner_message,omitempty"` // 主人想對狗狗說的話
 	DogResponse  string         `json:"dog_response,omitempty"`  // 狗狗回應主人（AI 生成）
 	FinalMessage string         `json:"final_message,omitempty"` // 兼容舊代碼，可能不再使用
+	Duration     float64        `json:"duration,omitempty"`      // 章節部分（不含結尾卡片）扣掉轉場重疊後的總長度
+	OwnerSpeech  *EndingSpeech  `json:"owner_speech,omitempty"`  // 結尾唸出的主人的話
+	PetSpeech    *EndingSpeech  `json:"pet_speech,omitempty"`    // 結尾唸出的毛小孩回應
+}
+
+// EndingSpeech 結尾片段中的一段語音
+type EndingSpeech struct {
+	Text          string    `json:"text"`
+	AudioPath     string    `json:"audio_path"`
+	Duration      float64   `json:"duration"`
+	Start         float64   `json:"start"`                    // 在結尾片段中開始的秒數
+	SentenceTimes []float64 `json:"sentence_times,omitempty"` // 每一句相對於語音開頭的開始秒數
 }
 
 type StoryChapter struct {
@@ -84,6 +168,20 @@ type StoryChapter struct {
 	EndTime   float64 `json:"end_time"`
 	AudioPath string  `json:"audio_path,omitempty"`
 	Duration  float64 `json:"duration"`
+	Speaker   string  `json:"speaker,omitempty"` // 多隻毛小孩輪流說話時，這段對白的說話者
+	Motion    string  `json:"motion,omitempty"`  // 照片章節的運鏡方式，空白時使用專案設定
+
+	OriginalVolume    *float64      `json:"original_volume,omitempty"`     // 這一段影片原音的音量 0～1，nil 時使用專案的 audio_mix.original_volume
+	FullVolumeMoments []AudioMoment `json:"full_volume_moments,omitempty"` // 原音以全音量播放的時段（原始影片的秒數）
+
+	Transition         string    `json:"transition,omitempty"`          // 接到下一段的轉場，空白時使用專案設定
+	TransitionDuration float64   `json:"transition_duration,omitempty"` // 轉場秒數，0 時使用專案設定
+	TimelineStart      float64   `json:"timeline_start"`                // 在成品中的開始秒數（已扣掉轉場重疊）
+	TimelineEnd        float64   `json:"timeline_end"`
+	NarrationStart     float64   `json:"narration_start"`          // 旁白在成品中的開始秒數（前一個轉場結束時）
+	SentenceTimes      []float64 `json:"sentence_times,omitempty"` // TTS 回傳的每一句開始時間（相對於旁白開頭）
+
+	NarrationHistory []string `json:"narration_history,omitempty"` // 重寫前的舊對白（最新的在最後），供還原使用
 }
 
 type Segment struct {
@@ -95,11 +193,27 @@ type Segment struct {
 }
 
 type Analysis struct {
-	HasDog          bool   `json:"has_dog"`
-	HasHuman        bool   `json:"has_human"`
-	InteractionType string `json:"interaction_type"`
-	Emotion         string `json:"emotion"`
-	ShortCaption    string `json:"short_caption"`
+	HasDog          bool            `json:"has_dog"`
+	HasPet          bool            `json:"has_pet"`                   // 是否有任何專案中的毛小孩
+	SpeciesPresent  map[string]bool `json:"species_present,omitempty"` // 各物種是否出現，例如 {"dog": true, "cat": false}
+	HasHuman        bool            `json:"has_human"`
+	InteractionType string          `json:"interaction_type"`
+	Emotion         string          `json:"emotion"`
+	ShortCaption    string          `json:"short_caption"`
+	PetBoxes        []PetBox        `json:"pet_boxes,omitempty"` // 每張圖片中毛小孩的位置
+}
+
+// hasAnyPet 是否有毛小孩入鏡（相容只回傳 has_dog 的舊分析結果）
+func (a *Analysis) hasAnyPet() bool {
+	if a.HasPet || a.HasDog {
+		return true
+	}
+	for _, present := range a.SpeciesPresent {
+		if present {
+			return true
+		}
+	}
+	return false
 }
 
 type Highlight struct {
@@ -123,9 +237,28 @@ var (
 	projects      = make(map[string]*Project)
 	projectsMutex sync.RWMutex
 
-	storagePath   string
-	aiAPIKey      string
-	aiAPIEndpoint string
+	// 分段上傳中的檔案
+	uploads      = make(map[string]*UploadSession)
+	uploadsMutex sync.RWMutex
+
+	// 毛小孩檔案，可在多個專案之間共用
+	petProfiles      = make(map[string]*PetProfile)
+	petProfilesMutex sync.RWMutex
+
+	storagePath      string
+	uploadTempPath   string // 分段上傳中的 .part 檔，放在 /storage 靜態檔案之外
+	promptsPath      string
+	fontsPath        string
+	musicLibraryPath string
+	aiAPIKey         string
+	aiAPIEndpoint    string
+
+	// 上傳限制，0 代表不限制
+	maxUploadSize      int64   // bytes
+	maxVideoDuration   float64 // seconds
+	maxMediaPerProject int
+	maxMusicUploadSize int64         // bytes，背景音樂另外限制，比影片小很多
+	uploadSessionTTL   time.Duration // 分段上傳閒置超過這個時間就刪除
 )
 
 // ============================================================================
@@ -138,11 +271,30 @@ func main() {
 
 	port := getEnv("PORT", "8080")
 	storagePath = getEnv("STORAGE_PATH", "./storage")
+	// 預設放在 storage 旁邊：不會被 /storage 公開，通常也和 storage 在同一個檔案系統，finalize 時可以直接搬移
+	uploadTempPath = getEnv("UPLOAD_TMP_PATH", filepath.Join(filepath.Dir(filepath.Clean(storagePath)), "upload-tmp"))
 	aiAPIKey = getEnv("AI_API_KEY", "")
 	aiAPIEndpoint = getEnv("AI_API_ENDPOINT", "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.5-flash:generateContent")
+	promptsPath = getEnv("PROMPTS_PATH", "./prompts")
+	fontsPath = getEnv("FONTS_PATH", "./fonts")
+	musicLibraryPath = getEnv("MUSIC_PATH", "./music")
+	maxUploadSize = int64(getEnvInt("MAX_UPLOAD_SIZE_MB", 500)) * 1024 * 1024
+	maxVideoDuration = float64(getEnvInt("MAX_VIDEO_DURATION_SECONDS", 600))
+	maxMediaPerProject = getEnvInt("MAX_MEDIA_PER_PROJECT", 30)
+	maxMusicUploadSize = int64(getEnvInt("MAX_MUSIC_UPLOAD_SIZE_MB", 50)) * 1024 * 1024
+	uploadSessionTTL = time.Duration(getEnvInt("UPLOAD_SESSION_TTL_HOURS", 24)) * time.Hour
+
+	// Load story modes and prompt templates
+	if err := loadStoryModes(); err != nil {
+		log.Fatalf("Failed to load story modes: %v", err)
+	}
 
 	// Create storage directories
 	createStorageDirectories()
+	go expireUploadSessions()
+	logFontResolution()
+	migrateLegacyMusic()
+	loadMusicLibrary()
 
 	// Setup Gin router
 	router := gin.Default()
@@ -156,6 +308,7 @@ func main() {
 
 	// Serve storage files
 	router.Static("/storage", storagePath)
+	router.Static("/music", musicLibraryPath)
 
 	// ========================================================================
 	// Phase 1 APIs - All in one place, not separated
@@ -273,14 +426,301 @@ func main() {
 	// Phase 2 APIs - Multi-video Story Generation
 	// ========================================================================
 
+	// GET /api/v2/story/modes - List available story modes
+	router.GET("/api/v2/story/modes", func(c *gin.Context) {
+		modes := listStoryModes()
+		c.JSON(http.StatusOK, gin.H{
+			"modes": modes,
+			"total": len(modes),
+		})
+	})
+
+	// POST /api/v2/story/modes/reload - Reload modes and prompt templates from PROMPTS_PATH
+	router.POST("/api/v2/story/modes/reload", func(c *gin.Context) {
+		if err := loadStoryModes(); err != nil {
+			log.Printf("Failed to reload story modes: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to reload story modes: " + err.Error()})
+			return
+		}
+
+		modes := listStoryModes()
+		c.JSON(http.StatusOK, gin.H{
+			"modes":     modes,
+			"total":     len(modes),
+			"occasions": listOccasions(),
+		})
+	})
+
+	// GET /api/v2/story/occasions - List available occasions
+	router.GET("/api/v2/story/occasions", func(c *gin.Context) {
+		list := listOccasions()
+		c.JSON(http.StatusOK, gin.H{
+			"occasions": list,
+			"total":     len(list),
+		})
+	})
+
+	// GET /api/v2/story/output-formats - List supported output aspect ratios
+	router.GET("/api/v2/story/output-formats", func(c *gin.Context) {
+		list := listOutputFormats()
+		c.JSON(http.StatusOK, gin.H{
+			"formats": list,
+			"total":   len(list),
+			"default": defaultOutputFormat,
+		})
+	})
+
+	// GET /api/v2/story/transitions - List available chapter transitions
+	router.GET("/api/v2/story/transitions", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"transitions":      transitionLibrary,
+			"total":            len(transitionLibrary),
+			"default":          defaultTransition,
+			"default_duration": defaultTransitionDuration,
+		})
+	})
+
+	// GET /api/v2/story/ending-templates - List ending card layouts
+	router.GET("/api/v2/story/ending-templates", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"templates":        endingTemplates,
+			"total":            len(endingTemplates),
+			"default":          defaultEndingTemplate,
+			"default_duration": defaultEndingDuration,
+		})
+	})
+
+	// GET /api/v2/story/music - List background music tracks
+	router.GET("/api/v2/story/music", func(c *gin.Context) {
+		list := listMusicTracks()
+		c.JSON(http.StatusOK, gin.H{
+			"tracks": list,
+			"total":  len(list),
+		})
+	})
+
+	// POST /api/v2/story/music/reload - Rescan MUSIC_PATH for tracks
+	router.POST("/api/v2/story/music/reload", func(c *gin.Context) {
+		loadMusicLibrary()
+		list := listMusicTracks()
+		c.JSON(http.StatusOK, gin.H{
+			"tracks": list,
+			"total":  len(list),
+		})
+	})
+
+	// GET /api/v2/story/languages - List supported languages
+	router.GET("/api/v2/story/languages", func(c *gin.Context) {
+		codes := make([]string, 0, len(languageProfiles))
+		for code := range languageProfiles {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+
+		languages := make([]*LanguageProfile, 0, len(codes))
+		for _, code := range codes {
+			languages = append(languages, languageProfiles[code])
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"languages": languages,
+			"default":   defaultLanguage,
+		})
+	})
+
+	// POST /api/v2/pets - Create a pet profile
+	router.POST("/api/v2/pets", func(c *gin.Context) {
+		var req PetProfileRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+
+		profile := &PetProfile{
+			ID:        uuid.New().String(),
+			CreatedAt: time.Now(),
+		}
+		if err := applyPetProfileRequest(profile, req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+
+		petProfilesMutex.Lock()
+		petProfiles[profile.ID] = profile
+		petProfilesMutex.Unlock()
+
+		log.Printf("🐾 Pet profile created: %s (%s)", profile.Name, profile.ID)
+		c.JSON(http.StatusOK, profile)
+	})
+
+	// GET /api/v2/pets - List pet profiles
+	router.GET("/api/v2/pets", func(c *gin.Context) {
+		petProfilesMutex.RLock()
+		list := make([]PetProfile, 0, len(petProfiles))
+		for _, profile := range petProfiles {
+			list = append(list, *profile)
+		}
+		petProfilesMutex.RUnlock()
+
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		})
+
+		c.JSON(http.StatusOK, gin.H{
+			"pets":  list,
+			"total": len(list),
+		})
+	})
+
+	// GET /api/v2/pets/:petId - Get a pet profile
+	router.GET("/api/v2/pets/:petId", func(c *gin.Context) {
+		profile, exists := getPetProfile(c.Param("petId"))
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pet not found"})
+			return
+		}
+		c.JSON(http.StatusOK, profile)
+	})
+
+	// PUT /api/v2/pets/:petId - Update a pet profile
+	router.PUT("/api/v2/pets/:petId", func(c *gin.Context) {
+		var req PetProfileRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+
+		petProfilesMutex.Lock()
+		profile, exists := petProfiles[c.Param("petId")]
+		if !exists {
+			petProfilesMutex.Unlock()
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pet not found"})
+			return
+		}
+		updated := *profile
+		if err := applyPetProfileRequest(&updated, req); err != nil {
+			petProfilesMutex.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		*profile = updated
+		petProfilesMutex.Unlock()
+
+		c.JSON(http.StatusOK, updated)
+	})
+
+	// DELETE /api/v2/pets/:petId - Delete a pet profile
+	router.DELETE("/api/v2/pets/:petId", func(c *gin.Context) {
+		petID := c.Param("petId")
+
+		petProfilesMutex.Lock()
+		_, exists := petProfiles[petID]
+		delete(petProfiles, petID)
+		petProfilesMutex.Unlock()
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pet not found"})
+			return
+		}
+
+		// 已建立的專案保留當時的名字與品種，只是不再同步檔案內容
+		os.RemoveAll(filepath.Join(storagePath, "pets", petID))
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	// POST /api/v2/pets/:petId/photo - Upload a reference photo
+	router.POST("/api/v2/pets/:petId/photo", func(c *gin.Context) {
+		petID := c.Param("petId")
+
+		if _, exists := getPetProfile(petID); !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pet not found"})
+			return
+		}
+
+		file, err := c.FormFile("photo")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No photo uploaded"})
+			return
+		}
+
+		// 驗證圖片格式
+		ext := strings.ToLower(filepath.Ext(file.Filename))
+		if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only JPG and PNG images are supported"})
+			return
+		}
+
+		petDir := filepath.Join(storagePath, "pets", petID)
+		if err := os.MkdirAll(petDir, 0755); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create pet directory"})
+			return
+		}
+		photoPath := filepath.Join(petDir, "photo"+ext)
+
+		if err := c.SaveUploadedFile(file, photoPath); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save photo"})
+			return
+		}
+
+		petProfilesMutex.Lock()
+		profile, exists := petProfiles[petID]
+		if exists {
+			// 換了副檔名時移除舊照片
+			if profile.PhotoPath != "" && profile.PhotoPath != photoPath {
+				os.Remove(profile.PhotoPath)
+			}
+			profile.PhotoPath = photoPath
+			profile.UpdatedAt = time.Now()
+		}
+		petProfilesMutex.Unlock()
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pet not found"})
+			return
+		}
+
+		log.Printf("Pet photo saved for %s: %s", petID, photoPath)
+		c.JSON(http.StatusOK, gin.H{
+			"success":    true,
+			"photo_path": photoPath,
+			"photo_url":  fmt.Sprintf("/storage/pets/%s/photo%s", petID, ext),
+		})
+	})
+
 	// POST /api/v2/story/projects - Create a new project
 	router.POST("/api/v2/story/projects", func(c *gin.Context) {
 		var req struct {
-			Name              string `json:"name" binding:"required"`
-			DogName           string `json:"dog_name" binding:"required"`
-			DogBreed          string `json:"dog_breed"`
-			OwnerRelationship string `json:"owner_relationship"` // 媽媽/爸爸/小主人等
-			StoryMode         string `json:"story_mode"`         // warm, cute, funny
+			Name               string              `json:"name" binding:"required"`
+			DogName            string              `json:"dog_name"` // 只有一隻狗時可以只填這個
+			DogBreed           string              `json:"dog_breed"`
+			Pets               []PetInfo           `json:"pets"`                // 多隻或非狗狗的毛小孩
+			PetIDs             []string            `json:"pet_ids"`             // 連結已建立的毛小孩檔案
+			NarrationStyle     string              `json:"narration_style"`     // multi, collective
+			OwnerRelationship  string              `json:"owner_relationship"`  // 媽媽/爸爸/小主人等
+			StoryMode          string              `json:"story_mode"`          // warm, cute, funny 或其他已載入的模式
+			Occasion           string              `json:"occasion"`            // memorial, birthday, gotcha_day, new_puppy
+			PhotoMotion        string              `json:"photo_motion"`        // auto, zoom_in, zoom_out, pan_left, pan_right, none
+			PhotoZoom          float64             `json:"photo_zoom"`          // 1.0～2.0，預設 1.2
+			DraftCount         int                 `json:"draft_count"`         // 候選故事數量，預設 1
+			Language           string              `json:"language"`            // zh-TW, zh-CN, en, ja
+			OutputFormat       string              `json:"output_format"`       // 16:9, 9:16, 1:1, 4:5
+			OutputFormats      []string            `json:"output_formats"`      // 一次輸出多種比例
+			Framing            string              `json:"framing"`             // smart, fit
+			Transition         string              `json:"transition"`          // dissolve, wipe, slide, circle_open, fade_white, fade_black
+			TransitionDuration float64             `json:"transition_duration"` // 秒，預設 0.8
+			TimingStrategy     string              `json:"timing_strategy"`     // extend, freeze, loop, slow
+			NarrationPadding   *float64            `json:"narration_padding"`   // 秒 0～3，預設 0.5
+			SubtitleMode       string              `json:"subtitle_mode"`       // burn, soft, both, none
+			FillMode           string              `json:"fill_mode"`           // blur, black, color, pattern
+			FillColor          string              `json:"fill_color"`          // #RRGGBB
+			Typography         *TypographySettings `json:"typography"`          // 字體、字級、顏色、外框與底框
+			EndingTemplate     string              `json:"ending_template"`     // classic, message, name_dates, paw_frame, polaroid
+			EndingDuration     float64             `json:"ending_duration"`     // 秒，預設 15
+			EndingStartDate    string              `json:"ending_start_date"`   // YYYY-MM-DD
+			EndingEndDate      string              `json:"ending_end_date"`     // YYYY-MM-DD
+			MusicTrackID       string              `json:"music_track_id"`      // 音樂庫的曲目 ID，空白時自動挑選
+			AudioMix           *AudioMixSettings   `json:"audio_mix"`           // 音樂音量、閃避深度、attack/release、淡入淡出
 		}
 
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -288,29 +728,175 @@ func main() {
 			return
 		}
 
-		// 預設關係為「主人」
+		// 整理毛小孩清單：先放連結的毛小孩檔案，沒有 pets 時使用 dog_name 建立一隻狗
+		pets := []PetInfo{}
+		linked := make([]PetInfo, 0, len(req.PetIDs)+len(req.Pets))
+		for _, id := range req.PetIDs {
+			linked = append(linked, PetInfo{ProfileID: id})
+		}
+		req.Pets = append(linked, req.Pets...)
+		for _, pet := range req.Pets {
+			if pet.ProfileID != "" {
+				profile, ok := getPetProfile(pet.ProfileID)
+				if !ok {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Pet not found: " + pet.ProfileID})
+					return
+				}
+				if req.OwnerRelationship == "" {
+					req.OwnerRelationship = profile.OwnerRelationship
+				}
+				pets = append(pets, petInfoFromProfile(profile))
+				continue
+			}
+			pet.Name = strings.TrimSpace(pet.Name)
+			if pet.Name == "" {
+				continue
+			}
+			pet.Species = normalizeSpecies(pet.Species)
+			pets = append(pets, pet)
+		}
+		if len(pets) == 0 {
+			if strings.TrimSpace(req.DogName) == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: dog_name, pets or pet_ids is required"})
+				return
+			}
+			pets = append(pets, PetInfo{Name: req.DogName, Species: defaultSpecies, Breed: req.DogBreed})
+		}
+		if req.DogName == "" {
+			req.DogName = petNames(pets, req.Language)
+		}
+		if req.DogBreed == "" && len(pets) == 1 {
+			req.DogBreed = pets[0].Breed
+		}
+
+		// 多隻毛小孩預設輪流說話
+		if req.NarrationStyle != "multi" && req.NarrationStyle != "collective" {
+			req.NarrationStyle = "multi"
+		}
+		if len(pets) == 1 {
+			req.NarrationStyle = ""
+		}
+
+		// 驗證語言，預設為繁體中文
+		if _, ok := languageProfiles[req.Language]; !ok {
+			if req.Language != "" {
+				log.Printf("Unsupported language %q, using %s", req.Language, defaultLanguage)
+			}
+			req.Language = defaultLanguage
+		}
+
+		// 預設關係為該語言的「主人」
 		if req.OwnerRelationship == "" {
-			req.OwnerRelationship = "主人"
+			req.OwnerRelationship = languageProfiles[req.Language].DefaultOwnerTitle
+		}
+
+		// 驗證並設定故事模式，找不到時使用預設模式，並記下當下的版本
+		mode := lookupStoryMode(req.StoryMode, 0)
+		if req.StoryMode == "" || mode == nil {
+			req.StoryMode = defaultStoryMode
+			mode = lookupStoryMode(defaultStoryMode, 0)
+		}
+
+		// 驗證場合，找不到時使用預設場合
+		if lookupOccasion(req.Occasion) == nil {
+			if req.Occasion != "" {
+				log.Printf("Unknown occasion %q, using %s", req.Occasion, defaultOccasion)
+			}
+			req.Occasion = defaultOccasion
+		}
+
+		// 驗證輸出比例，預設為 16:9
+		formats, err := normalizeOutputFormats(append([]string{req.OutputFormat}, req.OutputFormats...))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+
+		if req.FillColor != "" {
+			if _, err := parseHexColor(req.FillColor); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+				return
+			}
+		}
+		typography, err := normalizeTypography(req.Typography)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		audioMix, err := normalizeAudioMix(req.AudioMix)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		if !floatInRange(req.NarrationPadding, 0, maxNarrationPadding) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: narration_padding must be between 0 and %g seconds", maxNarrationPadding)})
+			return
+		}
+		if req.EndingTemplate == "" {
+			req.EndingTemplate = defaultEndingTemplate
+		} else if lookupEndingTemplate(req.EndingTemplate) == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown ending template: " + req.EndingTemplate})
+			return
+		}
+		for _, date := range []string{req.EndingStartDate, req.EndingEndDate} {
+			if err := validateEndingDate(date); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+				return
+			}
+		}
+		if req.MusicTrackID != "" && lookupMusicTrack(req.MusicTrackID) == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown music track: " + req.MusicTrackID})
+			return
+		}
+		if req.Transition == "" {
+			req.Transition = defaultTransition
+		} else if lookupTransition(req.Transition) == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown transition: " + req.Transition})
+			return
 		}
 
-		// 驗證並設定故事模式，預設為 warm
-		validModes := map[string]bool{"warm": true, "cute": true, "funny": true}
-		if req.StoryMode == "" || !validModes[req.StoryMode] {
-			req.StoryMode = "warm"
+		req.DraftCount = clampDraftCount(req.DraftCount)
+		req.PhotoMotion = normalizePhotoMotion(req.PhotoMotion)
+		if req.PhotoZoom < 1 || req.PhotoZoom > 2 {
+			req.PhotoZoom = defaultPhotoZoom
 		}
 
 		projectID := uuid.New().String()
 		project := &Project{
-			ID:                projectID,
-			Name:              req.Name,
-			DogName:           req.DogName,
-			DogBreed:          req.DogBreed,
-			OwnerRelationship: req.OwnerRelationship,
-			StoryMode:         req.StoryMode,
-			Status:            "pending",
-			Videos:            []VideoInfo{},
-			CreatedAt:         time.Now(),
-			UpdatedAt:         time.Now(),
+			ID:                 projectID,
+			Name:               req.Name,
+			DogName:            req.DogName,
+			DogBreed:           req.DogBreed,
+			Pets:               pets,
+			NarrationStyle:     req.NarrationStyle,
+			OwnerRelationship:  req.OwnerRelationship,
+			StoryMode:          req.StoryMode,
+			StoryModeVersion:   mode.Version,
+			Occasion:           req.Occasion,
+			PhotoMotion:        req.PhotoMotion,
+			PhotoZoom:          req.PhotoZoom,
+			OutputFormats:      formats,
+			Framing:            normalizeFraming(req.Framing),
+			FillMode:           normalizeFillMode(req.FillMode),
+			FillColor:          req.FillColor,
+			Transition:         req.Transition,
+			TransitionDuration: clampTransitionDuration(req.TransitionDuration),
+			TimingStrategy:     normalizeTimingStrategy(req.TimingStrategy),
+			NarrationPadding:   req.NarrationPadding,
+			SubtitleMode:       normalizeSubtitleMode(req.SubtitleMode),
+			Typography:         typography,
+			AudioMix:           audioMix,
+			EndingTemplate:     req.EndingTemplate,
+			EndingDuration:     clampEndingDuration(req.EndingDuration),
+			EndingStartDate:    req.EndingStartDate,
+			EndingEndDate:      req.EndingEndDate,
+			MusicTrackID:       req.MusicTrackID,
+			DraftCount:         req.DraftCount,
+			Language:           req.Language,
+			Status:             "pending",
+			Videos:             []VideoInfo{},
+			CreatedAt:          time.Now(),
+			UpdatedAt:          time.Now(),
 		}
 
 		projectsMutex.Lock()
@@ -369,6 +955,98 @@ func main() {
 		})
 	})
 
+	// POST /api/v2/story/projects/:projectId/music - Upload the owner's own background music
+	router.POST("/api/v2/story/projects/:projectId/music", func(c *gin.Context) {
+		projectID := c.Param("projectId")
+
+		projectsMutex.RLock()
+		project, exists := projects[projectID]
+		processing := exists && isProjectProcessing(project)
+		projectsMutex.RUnlock()
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+			return
+		}
+		// 合成中的 FFmpeg 正在讀取目前的歌曲，不能覆蓋
+		if processing {
+			c.JSON(http.StatusConflict, gin.H{"error": "Project is still processing"})
+			return
+		}
+
+		file, err := c.FormFile("music")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No music uploaded"})
+			return
+		}
+		if maxMusicUploadSize > 0 && file.Size > maxMusicUploadSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file is %d MB, limit is %d MB", file.Size/1024/1024, maxMusicUploadSize/1024/1024)})
+			return
+		}
+
+		// 驗證音樂格式
+		ext := strings.ToLower(filepath.Ext(file.Filename))
+		if !musicFileTypes[ext] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only MP3, M4A, AAC, WAV, OGG and FLAC files are supported"})
+			return
+		}
+
+		projectDir := filepath.Join(storagePath, "projects", projectID)
+		if err := os.MkdirAll(projectDir, 0755); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create project directory"})
+			return
+		}
+		musicPath := filepath.Join(projectDir, "custom_music"+ext)
+		// 先存成暫存檔，檢查完再換掉目前的歌曲
+		tempPath := filepath.Join(projectDir, "custom_music.upload"+ext)
+
+		if err := c.SaveUploadedFile(file, tempPath); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save music"})
+			return
+		}
+
+		duration := getVideoDuration(tempPath)
+		if duration <= 0 {
+			os.Remove(tempPath)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Uploaded file is not playable audio"})
+			return
+		}
+
+		title := strings.TrimSuffix(filepath.Base(file.Filename), filepath.Ext(file.Filename))
+
+		projectsMutex.Lock()
+		// 上傳期間可能已經開始合成
+		if isProjectProcessing(project) {
+			projectsMutex.Unlock()
+			os.Remove(tempPath)
+			c.JSON(http.StatusConflict, gin.H{"error": "Project is still processing"})
+			return
+		}
+		if err := os.Rename(tempPath, musicPath); err != nil {
+			projectsMutex.Unlock()
+			os.Remove(tempPath)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save music"})
+			return
+		}
+		// 換了副檔名時移除舊的歌曲
+		if project.CustomMusic != "" && project.CustomMusic != musicPath {
+			os.Remove(project.CustomMusic)
+		}
+		project.CustomMusic = musicPath
+		project.CustomMusicTitle = title
+		project.MusicTrackID = customMusicTrackID
+		project.UpdatedAt = time.Now()
+		log.Printf("Custom music saved for project %s: %s (%.1fs)", projectID, musicPath, duration)
+		projectsMutex.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{
+			"success":        true,
+			"music_track_id": customMusicTrackID,
+			"title":          title,
+			"duration":       duration,
+		})
+	})
+
 	// POST /api/v2/story/projects/:projectId/owner-message - Set owner message
 	router.POST("/api/v2/story/projects/:projectId/owner-message", func(c *gin.Context) {
 		projectID := c.Param("projectId")
@@ -423,7 +1101,7 @@ func main() {
 		}
 
 		files := form.File["videos"]
-		if len(files) == 0 {
+		if len(files) == 0 && len(form.File["photos"]) == 0 {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "No videos uploaded"})
 			return
 		}
@@ -432,34 +1110,48 @@ func main() {
 		os.MkdirAll(projectDir, 0755)
 
 		uploadedVideos := []VideoInfo{}
+		rejected := []RejectedUpload{}
+
+		projectsMutex.RLock()
+		existingCount := len(project.Videos)
+		projectsMutex.RUnlock()
 
+		// 照片可以和影片一起上傳，也可以使用 photos 欄位
+		files = append(files, form.File["photos"]...)
+
+		// 不看副檔名，存檔後用 ffprobe 檢查內容
 		for _, file := range files {
-			ext := strings.ToLower(filepath.Ext(file.Filename))
-			if ext != ".mp4" && ext != ".mov" && ext != ".avi" {
+			if maxUploadSize > 0 && file.Size > maxUploadSize {
+				rejected = append(rejected, RejectedUpload{File: file.Filename, Reason: fmt.Sprintf("file is %d MB, limit is %d MB", file.Size/1024/1024, maxUploadSize/1024/1024)})
+				continue
+			}
+			if maxMediaPerProject > 0 && existingCount+len(uploadedVideos) >= maxMediaPerProject {
+				rejected = append(rejected, RejectedUpload{File: file.Filename, Reason: fmt.Sprintf("project already has the maximum of %d files", maxMediaPerProject)})
 				continue
 			}
 
-			videoID := uuid.New().String()
-			videoPath := filepath.Join(projectDir, videoID+ext)
-
-			if err := c.SaveUploadedFile(file, videoPath); err != nil {
+			tempPath := filepath.Join(projectDir, "upload_"+uuid.New().String())
+			if err := c.SaveUploadedFile(file, tempPath); err != nil {
 				log.Printf("Failed to save video %s: %v", file.Filename, err)
+				rejected = append(rejected, RejectedUpload{File: file.Filename, Reason: "failed to save file"})
 				continue
 			}
 
-			// Get video duration using ffprobe
-			duration := getVideoDuration(videoPath)
-
-			videoInfo := VideoInfo{
-				ID:           videoID,
-				OriginalName: file.Filename,
-				Path:         videoPath,
-				Duration:     duration,
-				FramesDir:    filepath.Join(projectDir, videoID+"_frames"),
-				Analyzed:     false,
+			videoInfo, reason := ingestProjectMedia(projectDir, tempPath, file.Filename)
+			if videoInfo == nil {
+				rejected = append(rejected, RejectedUpload{File: file.Filename, Reason: reason})
+				continue
 			}
 
-			uploadedVideos = append(uploadedVideos, videoInfo)
+			uploadedVideos = append(uploadedVideos, *videoInfo)
+		}
+
+		if len(uploadedVideos) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":    "No valid videos or photos uploaded",
+				"rejected": rejected,
+			})
+			return
 		}
 
 		projectsMutex.Lock()
@@ -470,15 +1162,16 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{
 			"uploaded": len(uploadedVideos),
 			"videos":   uploadedVideos,
+			"rejected": rejected,
 		})
 	})
 
-	// POST /api/v2/story/projects/:projectId/generate - Generate story
-	router.POST("/api/v2/story/projects/:projectId/generate", func(c *gin.Context) {
+	// POST /api/v2/story/projects/:projectId/uploads - Start a resumable upload
+	router.POST("/api/v2/story/projects/:projectId/uploads", func(c *gin.Context) {
 		projectID := c.Param("projectId")
 
 		projectsMutex.RLock()
-		project, exists := projects[projectID]
+		_, exists := projects[projectID]
 		projectsMutex.RUnlock()
 
 		if !exists {
@@ -486,22 +1179,150 @@ func main() {
 			return
 		}
 
-		if len(project.Videos) == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "No videos in project"})
-			return
+		var req struct {
+			Filename string `json:"filename" binding:"required"`
+			Size     int64  `json:"size" binding:"required"`
+			Checksum string `json:"checksum"` // 可選，整個檔案的 sha256（hex）
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		if req.Size <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "size must be greater than 0"})
+			return
+		}
+		if maxUploadSize > 0 && req.Size > maxUploadSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file is %d MB, limit is %d MB", req.Size/1024/1024, maxUploadSize/1024/1024)})
+			return
 		}
 
-		// Start processing in background
-		go processProject(projectID)
+		uploadDir := filepath.Join(uploadTempPath, projectID)
+		if err := os.MkdirAll(uploadDir, 0755); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+			return
+		}
+
+		session := &UploadSession{
+			ID:        uuid.New().String(),
+			ProjectID: projectID,
+			Filename:  req.Filename,
+			Size:      req.Size,
+			Checksum:  strings.ToLower(req.Checksum),
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		session.Path = filepath.Join(uploadDir, session.ID+".part")
+
+		uploadsMutex.Lock()
+		uploads[session.ID] = session
+		uploadsMutex.Unlock()
+
+		log.Printf("📤 Upload %s started for project %s: %s (%d bytes)", session.ID, projectID, req.Filename, req.Size)
+
+		c.Header("Upload-Offset", "0")
+		c.JSON(http.StatusCreated, gin.H{
+			"upload_id":  session.ID,
+			"offset":     0,
+			"size":       session.Size,
+			"chunk_size": maxUploadChunkSize,
+		})
+	})
+
+	// HEAD /api/v2/story/projects/:projectId/uploads/:uploadId - Current offset in the Upload-Offset header
+	router.HEAD("/api/v2/story/projects/:projectId/uploads/:uploadId", func(c *gin.Context) {
+		session, ok := getUploadSession(c.Param("projectId"), c.Param("uploadId"))
+		if !ok {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		session.mu.Lock()
+		offset := session.Offset
+		session.mu.Unlock()
+
+		c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+		c.Header("Upload-Length", strconv.FormatInt(session.Size, 10))
+		c.Status(http.StatusOK)
+	})
+
+	// GET /api/v2/story/projects/:projectId/uploads/:uploadId - Upload status
+	router.GET("/api/v2/story/projects/:projectId/uploads/:uploadId", func(c *gin.Context) {
+		session, ok := getUploadSession(c.Param("projectId"), c.Param("uploadId"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
+		}
+
+		session.mu.Lock()
+		defer session.mu.Unlock()
+
+		c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		c.JSON(http.StatusOK, session)
+	})
+
+	// PATCH /api/v2/story/projects/:projectId/uploads/:uploadId - Append a chunk at Upload-Offset
+	router.PATCH("/api/v2/story/projects/:projectId/uploads/:uploadId", func(c *gin.Context) {
+		session, ok := getUploadSession(c.Param("projectId"), c.Param("uploadId"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
+		}
+
+		offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid Upload-Offset header"})
+			return
+		}
+		checksum, err := parseChunkChecksum(c.GetHeader("Upload-Checksum"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		session.mu.Lock()
+		defer session.mu.Unlock()
+
+		if session.expired {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
+		}
+
+		// offset 不一致代表用戶端的進度是舊的，回傳目前的 offset 讓它從正確位置繼續
+		if offset != session.Offset {
+			c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+			c.JSON(http.StatusConflict, gin.H{
+				"error":  "Upload-Offset does not match",
+				"offset": session.Offset,
+			})
+			return
+		}
+
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadChunkSize)
+		if err := writeUploadChunk(session, body, checksum); err != nil {
+			log.Printf("⚠️ Upload %s chunk at %d rejected: %v", session.ID, offset, err)
+			status := http.StatusBadRequest
+			if strings.Contains(err.Error(), "checksum") {
+				status = http.StatusUnprocessableEntity
+			}
+			c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+			c.JSON(status, gin.H{
+				"error":  err.Error(),
+				"offset": session.Offset,
+			})
+			return
+		}
 
+		c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
 		c.JSON(http.StatusOK, gin.H{
-			"project_id": projectID,
-			"status":     "processing",
+			"offset":   session.Offset,
+			"size":     session.Size,
+			"complete": session.Offset == session.Size,
 		})
 	})
 
-	// GET /api/v2/story/projects/:projectId - Get project status
-	router.GET("/api/v2/story/projects/:projectId", func(c *gin.Context) {
+	// POST /api/v2/story/projects/:projectId/uploads/:uploadId/finalize - Verify and add the file to the project
+	router.POST("/api/v2/story/projects/:projectId/uploads/:uploadId/finalize", func(c *gin.Context) {
 		projectID := c.Param("projectId")
 
 		projectsMutex.RLock()
@@ -513,2396 +1334,7600 @@ func main() {
 			return
 		}
 
-		response := gin.H{
-			"id":                 project.ID,
-			"name":               project.Name,
-			"dog_name":           project.DogName,
-			"dog_breed":          project.DogBreed,
-			"owner_relationship": project.OwnerRelationship,
-			"story_mode":         project.StoryMode,
-			"ending_image":       project.EndingImage,
-			"status":             project.Status,
-			"videos":             project.Videos,
-			"created_at":         project.CreatedAt,
-			"updated_at":         project.UpdatedAt,
+		session, ok := getUploadSession(projectID, c.Param("uploadId"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
 		}
 
-		if project.Error != "" {
-			response["error"] = project.Error
-		}
+		session.mu.Lock()
+		defer session.mu.Unlock()
 
-		if project.Story != nil {
-			response["story"] = project.Story
+		if session.expired {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
 		}
 
-		if project.FinalVideo != "" {
-			response["final_video_url"] = fmt.Sprintf("/storage/projects/%s/final.mp4", project.ID)
+		if session.Offset != session.Size {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":  fmt.Sprintf("upload incomplete: %d of %d bytes received", session.Offset, session.Size),
+				"offset": session.Offset,
+			})
+			return
 		}
 
-		c.JSON(http.StatusOK, response)
-	})
+		if session.Checksum != "" {
+			sum, err := fileSHA256(session.Path)
+			if err != nil || sum != session.Checksum {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "file checksum mismatch"})
+				return
+			}
+		}
 
-	// GET /api/v2/story/projects - List all projects
-	router.GET("/api/v2/story/projects", func(c *gin.Context) {
 		projectsMutex.RLock()
-		defer projectsMutex.RUnlock()
+		existingCount := len(project.Videos)
+		projectsMutex.RUnlock()
 
-		projectList := make([]*Project, 0, len(projects))
-		for _, project := range projects {
-			projectList = append(projectList, project)
+		removeSession := func() {
+			uploadsMutex.Lock()
+			delete(uploads, session.ID)
+			uploadsMutex.Unlock()
+		}
+
+		if maxMediaPerProject > 0 && existingCount >= maxMediaPerProject {
+			os.Remove(session.Path)
+			removeSession()
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":    "No valid videos or photos uploaded",
+				"rejected": []RejectedUpload{{File: session.Filename, Reason: fmt.Sprintf("project already has the maximum of %d files", maxMediaPerProject)}},
+			})
+			return
+		}
+
+		// 與一般上傳相同的檢查流程
+		projectDir := filepath.Join(storagePath, "projects", projectID)
+		if err := os.MkdirAll(projectDir, 0755); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create project directory"})
+			return
+		}
+		videoInfo, reason := ingestProjectMedia(projectDir, session.Path, session.Filename)
+		removeSession()
+		if videoInfo == nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":    "No valid videos or photos uploaded",
+				"rejected": []RejectedUpload{{File: session.Filename, Reason: reason}},
+			})
+			return
 		}
 
+		projectsMutex.Lock()
+		project.Videos = append(project.Videos, *videoInfo)
+		project.UpdatedAt = time.Now()
+		projectsMutex.Unlock()
+
 		c.JSON(http.StatusOK, gin.H{
-			"projects": projectList,
-			"total":    len(projectList),
+			"uploaded": 1,
+			"videos":   []VideoInfo{*videoInfo},
+			"rejected": []RejectedUpload{},
 		})
 	})
 
-	// Catch-all for SPA routing
-	router.NoRoute(func(c *gin.Context) {
-		if !strings.HasPrefix(c.Request.URL.Path, "/api/") {
-			c.File("./frontend/dist/index.html")
-		} else {
-			c.JSON(http.StatusNotFound, gin.H{"error": "API endpoint not found"})
+	// DELETE /api/v2/story/projects/:projectId/uploads/:uploadId - Abort an upload
+	router.DELETE("/api/v2/story/projects/:projectId/uploads/:uploadId", func(c *gin.Context) {
+		session, ok := getUploadSession(c.Param("projectId"), c.Param("uploadId"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
 		}
+
+		session.mu.Lock()
+		os.Remove(session.Path)
+		session.mu.Unlock()
+
+		uploadsMutex.Lock()
+		delete(uploads, session.ID)
+		uploadsMutex.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
 	})
 
-	// Start server
-	log.Printf("Server starting on port %s", port)
-	router.Run(":" + port)
-}
+	// POST /api/v2/story/projects/:projectId/generate - Generate story
+	router.POST("/api/v2/story/projects/:projectId/generate", func(c *gin.Context) {
+		projectID := c.Param("projectId")
 
-// ============================================================================
-// Processing Pipeline
-// ============================================================================
+		var req struct {
+			DraftCount int `json:"draft_count"` // 可選，覆蓋建立專案時的設定
+		}
 
-func processJob(jobID string) {
-	jobsMutex.Lock()
-	job := jobs[jobID]
-	job.Status = "processing"
-	job.UpdatedAt = time.Now()
-	jobsMutex.Unlock()
+		if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
 
-	log.Printf("Processing job %s", jobID)
+		projectsMutex.Lock()
+		project, exists := projects[projectID]
+		if !exists {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+			return
+		}
+		// 前一次的分析或合成還在寫入草稿與故事，不能同時再跑一次
+		if isProjectProcessing(project) {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": "Project is still processing"})
+			return
+		}
+		if len(project.Videos) == 0 {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No videos in project"})
+			return
+		}
+		if req.DraftCount > 0 {
+			project.DraftCount = clampDraftCount(req.DraftCount)
+		}
+		// 先標記為處理中，避免背景工作開始前又收到一次請求
+		project.Status = "analyzing"
+		project.UpdatedAt = time.Now()
+		projectsMutex.Unlock()
 
-	// Step 1: Extract frames
-	if err := extractFrames(job); err != nil {
-		markJobFailed(jobID, "Failed to extract frames: "+err.Error())
-		return
-	}
+		// Start processing in background
+		go processProject(projectID)
 
-	// Step 2: Create segments
-	if err := createSegments(job); err != nil {
-		markJobFailed(jobID, "Failed to create segments: "+err.Error())
-		return
-	}
+		c.JSON(http.StatusOK, gin.H{
+			"project_id": projectID,
+			"status":     "processing",
+		})
+	})
 
-	// Step 3: Analyze segments with AI
-	if err := analyzeSegments(job); err != nil {
-		markJobFailed(jobID, "Failed to analyze segments: "+err.Error())
-		return
-	}
+	// GET /api/v2/story/projects/:projectId/drafts - List candidate stories
+	router.GET("/api/v2/story/projects/:projectId/drafts", func(c *gin.Context) {
+		projectID := c.Param("projectId")
 
-	// Step 4: Find highlights
-	if err := findHighlights(job); err != nil {
-		markJobFailed(jobID, "Failed to find highlights: "+err.Error())
-		return
-	}
+		projectsMutex.RLock()
+		defer projectsMutex.RUnlock()
 
-	// Step 5: Create highlight video
-	if len(job.Highlights) > 0 {
-		if err := createHighlightVideo(job); err != nil {
-			markJobFailed(jobID, "Failed to create highlight video: "+err.Error())
+		project, exists := projects[projectID]
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
 			return
 		}
-	}
 
-	jobsMutex.Lock()
-	job.Status = "completed"
-	job.UpdatedAt = time.Now()
-	jobsMutex.Unlock()
+		c.JSON(http.StatusOK, gin.H{
+			"drafts":         project.StoryDrafts,
+			"total":          len(project.StoryDrafts),
+			"selected_draft": project.SelectedDraft,
+			"status":         project.Status,
+		})
+	})
 
-	log.Printf("Job %s completed successfully", jobID)
-}
+	// POST /api/v2/story/projects/:projectId/drafts/:draftIndex/select - Pick a draft and start rendering
+	router.POST("/api/v2/story/projects/:projectId/drafts/:draftIndex/select", func(c *gin.Context) {
+		projectID := c.Param("projectId")
 
-func extractFrames(job *Job) error {
-	os.MkdirAll(job.FramesDir, 0755)
+		projectsMutex.RLock()
+		project, exists := projects[projectID]
+		projectsMutex.RUnlock()
 
-	outputPattern := filepath.Join(job.FramesDir, "frame_%04d.jpg")
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+			return
+		}
 
-	// Extract 2 frames per second (0.5s intervals) and downscale to 360p
-	// scale=640:360 = 360p resolution to reduce file size and processing
-	cmd := exec.Command("ffmpeg", "-i", job.VideoPath, "-vf", "fps=2,scale=640:360", outputPattern)
+		draftIndex, err := strconv.Atoi(c.Param("draftIndex"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid draft index"})
+			return
+		}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
-	}
+		projectsMutex.Lock()
+		if project.Status != "awaiting_selection" && project.Status != "completed" && project.Status != "failed" {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": "Project is not ready for draft selection"})
+			return
+		}
+		if draftIndex < 1 || draftIndex > len(project.StoryDrafts) {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Draft not found"})
+			return
+		}
+		project.Story = cloneStory(project.StoryDrafts[draftIndex-1])
+		project.SelectedDraft = draftIndex
+		project.Status = "generating_video"
+		project.Error = ""
+		project.UpdatedAt = time.Now()
+		projectsMutex.Unlock()
 
-	log.Printf("Extracted frames for job %s (2 fps, 360p)", job.ID)
-	return nil
-}
+		log.Printf("Project %s: selected draft %d, start rendering", projectID, draftIndex)
 
-func createSegments(job *Job) error {
-	// List all frame files
-	files, err := filepath.Glob(filepath.Join(job.FramesDir, "frame_*.jpg"))
-	if err != nil {
-		return err
-	}
+		go renderProject(projectID)
 
-	if len(files) == 0 {
-		return fmt.Errorf("no frames extracted")
-	}
+		c.JSON(http.StatusOK, gin.H{
+			"project_id":     projectID,
+			"selected_draft": draftIndex,
+			"status":         "generating_video",
+		})
+	})
 
-	// Create segments of 2-4 seconds
-	// At 2 fps: 6 frames = 3 seconds (0.5s per frame)
-	segmentSize := 6 // 6 frames = 3 seconds at 2 fps
-	segments := []Segment{}
+	// POST /api/v2/story/projects/:projectId/render - Re-render the current story (e.g. after rewriting chapters)
+	router.POST("/api/v2/story/projects/:projectId/render", func(c *gin.Context) {
+		projectID := c.Param("projectId")
 
-	for i := 0; i < len(files); i += segmentSize {
-		end := i + segmentSize
-		if end > len(files) {
-			end = len(files)
+		// 可以在重新合成時改變輸出比例，沒有帶 body 時沿用專案設定
+		var req struct {
+			OutputFormats    []string            `json:"output_formats"`
+			Framing          string              `json:"framing"`
+			FillMode         string              `json:"fill_mode"`
+			FillColor        string              `json:"fill_color"`
+			TimingStrategy   string              `json:"timing_strategy"`
+			NarrationPadding *float64            `json:"narration_padding"`
+			SubtitleMode     string              `json:"subtitle_mode"`
+			Typography       *TypographySettings `json:"typography"`
+			EndingTemplate   string              `json:"ending_template"`
+			EndingDuration   float64             `json:"ending_duration"`
+			MusicTrackID     string              `json:"music_track_id"` // 曲目 ID、custom（上傳的歌曲）或 auto（自動挑選）
+			AudioMix         *AudioMixSettings   `json:"audio_mix"`
 		}
-
-		segment := Segment{
-			Index:      len(segments) + 1,
+		if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		typography, err := normalizeTypography(req.Typography)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		audioMix, err := normalizeAudioMix(req.AudioMix)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		if !floatInRange(req.NarrationPadding, 0, maxNarrationPadding) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: narration_padding must be between 0 and %g seconds", maxNarrationPadding)})
+			return
+		}
+		if req.EndingTemplate != "" && lookupEndingTemplate(req.EndingTemplate) == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown ending template: " + req.EndingTemplate})
+			return
+		}
+		if req.MusicTrackID != "" && req.MusicTrackID != "auto" && req.MusicTrackID != customMusicTrackID && lookupMusicTrack(req.MusicTrackID) == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown music track: " + req.MusicTrackID})
+			return
+		}
+		if req.FillColor != "" {
+			if _, err := parseHexColor(req.FillColor); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+				return
+			}
+		}
+		var formats []string
+		if len(req.OutputFormats) > 0 {
+			var err error
+			if formats, err = normalizeOutputFormats(req.OutputFormats); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+				return
+			}
+		}
+
+		projectsMutex.Lock()
+		project, exists := projects[projectID]
+		if !exists {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+			return
+		}
+		if project.Story == nil {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Project has no story yet"})
+			return
+		}
+		if project.Status == "analyzing" || project.Status == "generating_story" || project.Status == "generating_video" {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": "Project is still processing"})
+			return
+		}
+		if req.MusicTrackID == customMusicTrackID && project.CustomMusic == "" {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Project has no uploaded music"})
+			return
+		}
+		if formats != nil {
+			project.OutputFormats = formats
+		}
+		if req.Framing != "" {
+			project.Framing = normalizeFraming(req.Framing)
+		}
+		if req.FillMode != "" {
+			project.FillMode = normalizeFillMode(req.FillMode)
+		}
+		if req.FillColor != "" {
+			project.FillColor = req.FillColor
+		}
+		if req.TimingStrategy != "" {
+			project.TimingStrategy = normalizeTimingStrategy(req.TimingStrategy)
+		}
+		if req.NarrationPadding != nil {
+			project.NarrationPadding = req.NarrationPadding
+		}
+		if req.SubtitleMode != "" {
+			project.SubtitleMode = normalizeSubtitleMode(req.SubtitleMode)
+		}
+		if typography != nil {
+			project.Typography = typography
+		}
+		if audioMix != nil {
+			project.AudioMix = audioMix
+		}
+		if req.EndingTemplate != "" {
+			project.EndingTemplate = req.EndingTemplate
+		}
+		if req.EndingDuration != 0 {
+			project.EndingDuration = clampEndingDuration(req.EndingDuration)
+		}
+		if req.MusicTrackID == "auto" {
+			project.MusicTrackID = ""
+		} else if req.MusicTrackID != "" {
+			project.MusicTrackID = req.MusicTrackID
+		}
+		project.Status = "generating_video"
+		project.Error = ""
+		project.UpdatedAt = time.Now()
+		formats = projectOutputFormats(project)
+		projectsMutex.Unlock()
+
+		go renderProject(projectID)
+
+		c.JSON(http.StatusOK, gin.H{
+			"project_id":     projectID,
+			"status":         "generating_video",
+			"output_formats": formats,
+		})
+	})
+
+	// GET /api/v2/story/projects/:projectId - Get project status
+	router.GET("/api/v2/story/projects/:projectId", func(c *gin.Context) {
+		projectID := c.Param("projectId")
+
+		projectsMutex.RLock()
+		project, exists := projects[projectID]
+		projectsMutex.RUnlock()
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+			return
+		}
+
+		response := gin.H{
+			"id":                 project.ID,
+			"name":               project.Name,
+			"dog_name":           project.DogName,
+			"dog_breed":          project.DogBreed,
+			"pets":               projectPets(project),
+			"narration_style":    project.NarrationStyle,
+			"owner_relationship": project.OwnerRelationship,
+			"story_mode":         project.StoryMode,
+			"story_mode_version": project.StoryModeVersion,
+			"occasion":           project.Occasion,
+			"photo_motion":       project.PhotoMotion,
+			"output_formats":     projectOutputFormats(project),
+			"framing":            normalizeFraming(project.Framing),
+			"fill_mode":          normalizeFillMode(project.FillMode),
+			"fill_color":         projectFill(project).Color,
+			"transition":         project.Transition,
+			"timing_strategy":    normalizeTimingStrategy(project.TimingStrategy),
+			"narration_padding":  narrationPadding(project),
+			"subtitle_mode":      normalizeSubtitleMode(project.SubtitleMode),
+			"typography":         projectTypography(project),
+			"language":           project.Language,
+			"ending_image":       project.EndingImage,
+			"ending_template":    projectEndingTemplate(project).ID,
+			"ending_duration":    clampEndingDuration(project.EndingDuration),
+			"music_track_id":     project.MusicTrackID,
+			"music":              resolveProjectMusic(project),
+			"audio_mix":          projectAudioMix(project),
+			"status":             project.Status,
+			"videos":             project.Videos,
+			"created_at":         project.CreatedAt,
+			"updated_at":         project.UpdatedAt,
+		}
+
+		if project.Error != "" {
+			response["error"] = project.Error
+		}
+
+		if project.Story != nil {
+			response["story"] = project.Story
+		}
+
+		if len(project.StoryDrafts) > 0 {
+			response["draft_count"] = project.DraftCount
+			response["story_drafts"] = project.StoryDrafts
+			response["selected_draft"] = project.SelectedDraft
+		}
+
+		if project.FinalVideo != "" {
+			response["final_video_url"] = fmt.Sprintf("/storage/projects/%s/final.mp4", project.ID)
+		}
+		if len(project.FinalVideos) > 0 {
+			urls := gin.H{}
+			for id, path := range project.FinalVideos {
+				urls[id] = fmt.Sprintf("/storage/projects/%s/%s", project.ID, filepath.Base(path))
+			}
+			response["final_video_urls"] = urls
+
+			subtitleURLs := gin.H{}
+			for ext := range subtitleFileTypes {
+				subtitleURLs[ext] = fmt.Sprintf("/api/v2/story/projects/%s/subtitles.%s", project.ID, ext)
+			}
+			response["subtitle_urls"] = subtitleURLs
+		}
+		if len(project.Loudness) > 0 {
+			response["loudness"] = project.Loudness
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	// POST /api/v2/story/projects/:projectId/chapters/:index/regenerate - Rewrite a single chapter with AI
+	router.POST("/api/v2/story/projects/:projectId/chapters/:index/regenerate", func(c *gin.Context) {
+		projectID := c.Param("projectId")
+
+		projectsMutex.RLock()
+		project, exists := projects[projectID]
+		projectsMutex.RUnlock()
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+			return
+		}
+
+		var req struct {
+			Feedback string `json:"feedback"` // 例如「提到海邊」、「不要那麼難過」
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+
+		// AI 重寫需要一段時間，先在鎖內複製一份故事，呼叫期間不持有鎖
+		projectsMutex.RLock()
+		chapterPos, errMsg := findChapterPositionLocked(project, c.Param("index"))
+		var story *Story
+		var snapshot Story
+		if errMsg == "" {
+			story = project.Story
+			snapshot = *story
+			snapshot.Chapters = append([]StoryChapter(nil), story.Chapters...)
+		}
+		projectsMutex.RUnlock()
+		if errMsg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": errMsg})
+			return
+		}
+		chapterIndex := snapshot.Chapters[chapterPos].Index
+
+		narration, err := regenerateChapterNarration(project, &snapshot, chapterPos, req.Feedback)
+		if err != nil {
+			log.Printf("Failed to regenerate chapter for project %s: %v", projectID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to regenerate chapter: " + err.Error()})
+			return
+		}
+
+		// 重寫期間故事可能被換掉（選擇其他草稿、重新產生）或正在合成，章節要重新找一次
+		projectsMutex.Lock()
+		if project.Story != story || isProjectProcessing(project) {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": "Project changed while regenerating the chapter, please try again"})
+			return
+		}
+		chapterPos = chapterPositionByIndex(story, chapterIndex)
+		if chapterPos < 0 {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": "Chapter no longer exists"})
+			return
+		}
+		chapter := &story.Chapters[chapterPos]
+		chapter.NarrationHistory = append(chapter.NarrationHistory, chapter.Narration)
+		chapter.Narration = narration
+		// 舊的 TTS 已經對不上新對白，下次合成時重新產生
+		chapter.AudioPath = ""
+		chapter.SentenceTimes = nil
+		chapter.Duration = chapter.EndTime - chapter.StartTime
+		project.UpdatedAt = time.Now()
+		result := *chapter
+		projectsMutex.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"chapter": result,
+		})
+	})
+
+	// POST /api/v2/story/projects/:projectId/chapters/:index/revert - Restore the previous narration
+	router.POST("/api/v2/story/projects/:projectId/chapters/:index/revert", func(c *gin.Context) {
+		projectID := c.Param("projectId")
+
+		projectsMutex.RLock()
+		project, exists := projects[projectID]
+		projectsMutex.RUnlock()
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+			return
+		}
+
+		projectsMutex.Lock()
+		chapterPos, errMsg := findChapterPositionLocked(project, c.Param("index"))
+		if errMsg != "" {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": errMsg})
+			return
+		}
+		chapter := &project.Story.Chapters[chapterPos]
+		if len(chapter.NarrationHistory) == 0 {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No previous narration to revert to"})
+			return
+		}
+		last := len(chapter.NarrationHistory) - 1
+		chapter.Narration = chapter.NarrationHistory[last]
+		chapter.NarrationHistory = chapter.NarrationHistory[:last]
+		chapter.AudioPath = ""
+		chapter.SentenceTimes = nil
+		chapter.Duration = chapter.EndTime - chapter.StartTime
+		project.UpdatedAt = time.Now()
+		result := *chapter
+		projectsMutex.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"chapter": result,
+		})
+	})
+
+	// POST /api/v2/story/projects/:projectId/chapters/:index/motion - Set the pan/zoom motion of a photo chapter
+	router.POST("/api/v2/story/projects/:projectId/chapters/:index/motion", func(c *gin.Context) {
+		projectID := c.Param("projectId")
+
+		projectsMutex.RLock()
+		project, exists := projects[projectID]
+		projectsMutex.RUnlock()
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+			return
+		}
+
+		var req struct {
+			Motion string `json:"motion" binding:"required"` // auto, zoom_in, zoom_out, pan_left, pan_right, none
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		if normalizePhotoMotion(req.Motion) != req.Motion {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown motion: " + req.Motion})
+			return
+		}
+
+		projectsMutex.Lock()
+		chapterPos, errMsg := findChapterPositionLocked(project, c.Param("index"))
+		if errMsg != "" {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": errMsg})
+			return
+		}
+		chapter := &project.Story.Chapters[chapterPos]
+		chapter.Motion = req.Motion
+		project.UpdatedAt = time.Now()
+		result := *chapter
+		projectsMutex.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"chapter": result,
+		})
+	})
+
+	// POST /api/v2/story/projects/:projectId/chapters/:index/audio - Keep the original clip audio of a chapter
+	router.POST("/api/v2/story/projects/:projectId/chapters/:index/audio", func(c *gin.Context) {
+		projectID := c.Param("projectId")
+
+		projectsMutex.RLock()
+		project, exists := projects[projectID]
+		projectsMutex.RUnlock()
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+			return
+		}
+
+		var req struct {
+			OriginalVolume    *float64      `json:"original_volume"`     // 0～1，不帶時使用專案設定
+			FullVolumeMoments []AudioMoment `json:"full_volume_moments"` // 原始影片的秒數
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		if req.OriginalVolume != nil && (*req.OriginalVolume < 0 || *req.OriginalVolume > 1) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "original_volume must be between 0 and 1"})
+			return
+		}
+		if err := validateAudioMoments(req.FullVolumeMoments); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+
+		projectsMutex.Lock()
+		chapterPos, errMsg := findChapterPositionLocked(project, c.Param("index"))
+		if errMsg != "" {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": errMsg})
+			return
+		}
+		chapter := &project.Story.Chapters[chapterPos]
+		hasAudio := false
+		for _, video := range project.Videos {
+			if video.ID == chapter.VideoID {
+				hasAudio = video.HasAudio
+			}
+		}
+		if !hasAudio {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "This chapter's media has no original audio"})
+			return
+		}
+		chapter.OriginalVolume = req.OriginalVolume
+		chapter.FullVolumeMoments = req.FullVolumeMoments
+		project.UpdatedAt = time.Now()
+		result := *chapter
+		projectsMutex.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"chapter": result,
+		})
+	})
+
+	// GET /api/v2/story/projects/:projectId/subtitles.{srt,vtt,ass} - Download subtitles of the rendered timeline
+	for ext, contentType := range subtitleFileTypes {
+		ext, contentType := ext, contentType
+		router.GET("/api/v2/story/projects/:projectId/subtitles."+ext, func(c *gin.Context) {
+			projectID := c.Param("projectId")
+
+			projectsMutex.RLock()
+			defer projectsMutex.RUnlock()
+
+			project, exists := projects[projectID]
+			if !exists {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+				return
+			}
+			if project.Story == nil || project.Story.Duration == 0 {
+				c.JSON(http.StatusConflict, gin.H{"error": "Project has not been rendered yet"})
+				return
+			}
+
+			// 斷行寬度依輸出比例，預設使用主要格式
+			formatID := c.DefaultQuery("format", projectOutputFormats(project)[0])
+			if _, ok := outputFormats[formatID]; !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown output format: " + formatID})
+				return
+			}
+			format := getOutputFormat(formatID)
+
+			content := renderSubtitleFile(ext, projectSubtitleCues(project, format), projectTypography(project), format)
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, project.ID, ext))
+			c.Data(http.StatusOK, contentType, []byte(content))
+		})
+	}
+
+	// GET /api/v2/story/projects/:projectId/ending-card.png - Preview the ending card
+	router.GET("/api/v2/story/projects/:projectId/ending-card.png", func(c *gin.Context) {
+		projectID := c.Param("projectId")
+
+		projectsMutex.RLock()
+		project, exists := projects[projectID]
+		var preview Project
+		if exists {
+			preview = *project
+		}
+		projectsMutex.RUnlock()
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+			return
+		}
+		if preview.EndingImage == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Project has no ending image"})
+			return
+		}
+
+		// 可以用 ?template= 預覽其他版面，不會改變專案設定
+		if id := c.Query("template"); id != "" {
+			if lookupEndingTemplate(id) == nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown ending template: " + id})
+				return
+			}
+			preview.EndingTemplate = id
+		}
+		formatID := c.DefaultQuery("format", projectOutputFormats(&preview)[0])
+		if _, ok := outputFormats[formatID]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown output format: " + formatID})
+			return
+		}
+
+		bg, layers, err := drawEndingCard(&preview, getOutputFormat(formatID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render ending card: " + err.Error()})
+			return
+		}
+		for _, layer := range layers {
+			draw.Draw(bg, bg.Bounds(), layer, image.Point{}, draw.Over)
+		}
+		c.Header("Content-Type", "image/png")
+		if err := png.Encode(c.Writer, bg); err != nil {
+			log.Printf("⚠️ Failed to send ending card preview: %v", err)
+		}
+	})
+
+	// POST /api/v2/story/projects/:projectId/chapters/:index/transition - Set the transition from a chapter to the next one
+	router.POST("/api/v2/story/projects/:projectId/chapters/:index/transition", func(c *gin.Context) {
+		projectID := c.Param("projectId")
+
+		projectsMutex.RLock()
+		project, exists := projects[projectID]
+		projectsMutex.RUnlock()
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Project not found"})
+			return
+		}
+
+		var req struct {
+			Transition string  `json:"transition"` // 空白代表使用專案設定
+			Duration   float64 `json:"duration"`   // 0 代表使用專案設定
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		if req.Transition != "" && lookupTransition(req.Transition) == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown transition: " + req.Transition})
+			return
+		}
+
+		projectsMutex.Lock()
+		chapterPos, errMsg := findChapterPositionLocked(project, c.Param("index"))
+		if errMsg != "" {
+			projectsMutex.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": errMsg})
+			return
+		}
+		chapter := &project.Story.Chapters[chapterPos]
+		chapter.Transition = req.Transition
+		chapter.TransitionDuration = clampTransitionDuration(req.Duration)
+		project.UpdatedAt = time.Now()
+		result := *chapter
+		projectsMutex.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"chapter": result,
+		})
+	})
+
+	// GET /api/v2/story/projects - List all projects
+	router.GET("/api/v2/story/projects", func(c *gin.Context) {
+		projectsMutex.RLock()
+		defer projectsMutex.RUnlock()
+
+		projectList := make([]*Project, 0, len(projects))
+		for _, project := range projects {
+			projectList = append(projectList, project)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"projects": projectList,
+			"total":    len(projectList),
+		})
+	})
+
+	// Catch-all for SPA routing
+	router.NoRoute(func(c *gin.Context) {
+		if !strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			c.File("./frontend/dist/index.html")
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API endpoint not found"})
+		}
+	})
+
+	// Start server
+	log.Printf("Server starting on port %s", port)
+	router.Run(":" + port)
+}
+
+// ============================================================================
+// Processing Pipeline
+// ============================================================================
+
+func processJob(jobID string) {
+	jobsMutex.Lock()
+	job := jobs[jobID]
+	job.Status = "processing"
+	job.UpdatedAt = time.Now()
+	jobsMutex.Unlock()
+
+	log.Printf("Processing job %s", jobID)
+
+	// Step 1: Extract frames
+	if err := extractFrames(job); err != nil {
+		markJobFailed(jobID, "Failed to extract frames: "+err.Error())
+		return
+	}
+
+	// Step 2: Create segments
+	if err := createSegments(job); err != nil {
+		markJobFailed(jobID, "Failed to create segments: "+err.Error())
+		return
+	}
+
+	// Step 3: Analyze segments with AI
+	if err := analyzeSegments(job); err != nil {
+		markJobFailed(jobID, "Failed to analyze segments: "+err.Error())
+		return
+	}
+
+	// Step 4: Find highlights
+	if err := findHighlights(job); err != nil {
+		markJobFailed(jobID, "Failed to find highlights: "+err.Error())
+		return
+	}
+
+	// Step 5: Create highlight video
+	if len(job.Highlights) > 0 {
+		if err := createHighlightVideo(job); err != nil {
+			markJobFailed(jobID, "Failed to create highlight video: "+err.Error())
+			return
+		}
+	}
+
+	jobsMutex.Lock()
+	job.Status = "completed"
+	job.UpdatedAt = time.Now()
+	jobsMutex.Unlock()
+
+	log.Printf("Job %s completed successfully", jobID)
+}
+
+func extractFrames(job *Job) error {
+	os.MkdirAll(job.FramesDir, 0755)
+
+	outputPattern := filepath.Join(job.FramesDir, "frame_%04d.jpg")
+
+	// Extract 2 frames per second (0.5s intervals) and downscale to 360p
+	// scale=640:360 = 360p resolution to reduce file size and processing
+	cmd := exec.Command("ffmpeg", "-i", job.VideoPath, "-vf", "fps=2,scale=640:360", outputPattern)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
+	}
+
+	log.Printf("Extracted frames for job %s (2 fps, 360p)", job.ID)
+	return nil
+}
+
+func createSegments(job *Job) error {
+	// List all frame files
+	files, err := filepath.Glob(filepath.Join(job.FramesDir, "frame_*.jpg"))
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no frames extracted")
+	}
+
+	// Create segments of 2-4 seconds
+	// At 2 fps: 6 frames = 3 seconds (0.5s per frame)
+	segmentSize := 6 // 6 frames = 3 seconds at 2 fps
+	segments := []Segment{}
+
+	for i := 0; i < len(files); i += segmentSize {
+		end := i + segmentSize
+		if end > len(files) {
+			end = len(files)
+		}
+
+		segment := Segment{
+			Index:      len(segments) + 1,
 			Start:      float64(i) * 0.5, // 0.5s per frame at 2 fps
 			End:        float64(end) * 0.5,
 			FramePaths: files[i:end],
 		}
-		segments = append(segments, segment)
+		segments = append(segments, segment)
+	}
+
+	jobsMutex.Lock()
+	job.Segments = segments
+	jobsMutex.Unlock()
+
+	log.Printf("Created %d segments for job %s", len(segments), job.ID)
+	return nil
+}
+
+func analyzeSegments(job *Job) error {
+	if aiAPIKey == "" || aiAPIKey == "your_api_key_here" || aiAPIKey == "your_gemini_api_key_here" {
+		return fmt.Errorf("AI API key not configured. Please set AI_API_KEY in .env file")
+	}
+
+	log.Printf("Using Gemini AI analysis for job %s", job.ID)
+
+	successCount := 0
+	// 使用真實 AI 分析每個 segment
+	for i := range job.Segments {
+		analysis, err := analyzeSegmentWithAI(&job.Segments[i])
+		if err != nil {
+			// 記錄錯誤但繼續處理其他 segments
+			log.Printf("Warning: AI analysis failed for segment %d: %v (skipping)", i, err)
+			// 設定一個預設的分析結果
+			job.Segments[i].Analysis = &Analysis{
+				HasDog:          false,
+				HasHuman:        false,
+				InteractionType: "none",
+				Emotion:         "neutral",
+				ShortCaption:    "分析失敗",
+			}
+			continue
+		}
+		job.Segments[i].Analysis = analysis
+		successCount++
+
+		// 避免 API 限流，稍微延遲
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	log.Printf("AI analyzed %d/%d segments successfully for job %s", successCount, len(job.Segments), job.ID)
+
+	// 只要有至少一半的 segments 分析成功就繼續
+	if successCount < len(job.Segments)/2 {
+		return fmt.Errorf("too many segments failed analysis (%d/%d succeeded)", successCount, len(job.Segments))
+	}
+
+	return nil
+}
+
+// analyzeVideoWithAI - 整個影片只打一次 API，傳送最多 10 張代表性圖片
+// 有ＡＩ
+// species 為專案中的物種，nil 時只找狗
+// lang 決定 short_caption 的語言，之後會原封不動帶入故事的 prompt
+func analyzeVideoWithAI(framePaths []string, videoID string, species []string, lang *LanguageProfile) (*Analysis, error) {
+	if len(framePaths) == 0 {
+		return nil, fmt.Errorf("no frames provided")
+	}
+
+	// 智能選擇最多 10 張代表性圖片（均勻分佈）
+	maxImages := 10
+	selectedFrames := []int{}
+
+	if len(framePaths) <= maxImages {
+		// 圖片數量不多，全部使用
+		for i := range framePaths {
+			selectedFrames = append(selectedFrames, i)
+		}
+	} else {
+		// 均勻選擇 10 張圖片
+		step := float64(len(framePaths)) / float64(maxImages)
+		for i := 0; i < maxImages; i++ {
+			idx := int(float64(i) * step)
+			if idx < len(framePaths) {
+				selectedFrames = append(selectedFrames, idx)
+			}
+		}
+	}
+
+	log.Printf("Video %s: Analyzing with %d images (total frames: %d)", videoID, len(selectedFrames), len(framePaths))
+
+	// 壓縮並編碼所有選中的圖片
+	// sentFrames 記錄實際送出的圖片對應到第幾張截圖，用來還原方框的時間
+	base64Images := []string{}
+	sentFrames := []int{}
+	for _, idx := range selectedFrames {
+		framePath := framePaths[idx]
+		compressedData, err := compressImage(framePath, 320, 240) // 壓縮到 320x240
+		if err != nil {
+			log.Printf("Warning: failed to compress image %s: %v", framePath, err)
+			continue
+		}
+
+		base64Image := base64.StdEncoding.EncodeToString(compressedData)
+		base64Images = append(base64Images, base64Image)
+		sentFrames = append(sentFrames, idx)
+	}
+
+	if len(base64Images) == 0 {
+		return nil, fmt.Errorf("no frames could be processed")
+	}
+
+	log.Printf("Successfully compressed %d images for video %s", len(base64Images), videoID)
+
+	if len(species) == 0 {
+		species = []string{defaultSpecies}
+	}
+	speciesFields := make([]string, 0, len(species))
+	speciesNames := make([]string, 0, len(species))
+	for _, s := range species {
+		speciesFields = append(speciesFields, fmt.Sprintf(`"%s": true/false`, s))
+		speciesNames = append(speciesNames, fmt.Sprintf("%s(%s)", s, speciesLabel(s, defaultLanguage)))
+	}
+
+	// 構建 API 請求
+	parts := []map[string]interface{}{
+		{
+			"text": fmt.Sprintf(`這些是來自同一個影片的 %d 張連續截圖（每隔 2 秒一張）。請綜合分析整個影片，判斷以下內容並以 JSON 格式回應：
+
+{
+  "has_dog": true/false,
+  "has_pet": true/false,
+  "species_present": {%s},
+  "has_human": true/false,
+  "interaction_type": "running_towards_owner" | "playing" | "being_petted" | "fetching" | "cuddling" | "none",
+  "emotion": "happy" | "excited" | "calm" | "neutral" | "sad",
+  "short_caption": "%s",
+  "pet_boxes": [{"frame": 0, "x": 0.0, "y": 0.0, "w": 0.0, "h": 0.0}]
+}
+
+判斷標準：
+- has_dog: 影片中是否有狗
+- has_pet: 影片中是否有以下任何一種寵物：%s
+- species_present: 每一種寵物是否出現在影片中
+- has_human: 影片中是否有人
+- interaction_type: 寵物和人之間的主要互動類型
+- emotion: 寵物的整體情緒
+- short_caption: 簡短描述影片內容（提到是哪一種寵物）
+- pet_boxes: 每張圖片中寵物的位置。frame 是圖片的順序（從 0 開始）；x、y 是方框左上角，w、h 是寬高，都是相對於圖片寬高的 0～1 比例。有多隻寵物時框住全部，看不到寵物的圖片不要列出
+
+**重要**：這些圖片來自同一個完整影片，請綜合所有圖片進行分析。
+
+只回傳 JSON，不要其他文字。`, len(base64Images), strings.Join(speciesFields, ", "), lang.PromptLabels.Caption, strings.Join(speciesNames, "、")),
+		},
+	}
+
+	// 添加所有圖片
+	for _, imgData := range base64Images {
+		parts = append(parts, map[string]interface{}{
+			"inline_data": map[string]string{
+				"mime_type": "image/jpeg",
+				"data":      imgData,
+			},
+		})
+	}
+
+	requestBody := map[string]interface{}{
+		"contents": []map[string]interface{}{
+			{
+				"parts": parts,
+			},
+		},
+		"generationConfig": map[string]interface{}{
+			"temperature":      0.4,
+			"maxOutputTokens":  2000, // 增加到 2000，避免 MAX_TOKENS 錯誤
+			"responseMimeType": "application/json",
+		},
+	}
+
+	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// 發送請求
+	url := fmt.Sprintf("%s?key=%s", aiAPIEndpoint, aiAPIKey)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 60 * time.Second} // 增加超時時間
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
+	}
+
+	// 讀取回應
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	// 解析回應
+	var apiResponse struct {
+		Candidates []struct {
+			Content struct {
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"content"`
+			FinishReason string `json:"finishReason"`
+		} `json:"candidates"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+
+	if err := json.Unmarshal(bodyBytes, &apiResponse); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	// 檢查錯誤
+	if apiResponse.Error != nil {
+		return nil, fmt.Errorf("Gemini API error: %d - %s", apiResponse.Error.Code, apiResponse.Error.Message)
+	}
+
+	if len(apiResponse.Candidates) == 0 {
+		return nil, fmt.Errorf("no candidates in response")
+	}
+
+	candidate := apiResponse.Candidates[0]
+
+	// 檢查內容
+	if candidate.Content.Parts == nil || len(candidate.Content.Parts) == 0 {
+		log.Printf("Gemini returned empty content for video %s. FinishReason: %s, Response: %s",
+			videoID, candidate.FinishReason, string(bodyBytes))
+		return nil, fmt.Errorf("no content (finishReason: %s)", candidate.FinishReason)
+	}
+
+	// 解析 JSON
+	content := candidate.Content.Parts[0].Text
+	content = strings.TrimPrefix(content, "```json")
+	content = strings.TrimPrefix(content, "```")
+	content = strings.TrimSuffix(content, "```")
+	content = strings.TrimSpace(content)
+
+	var analysis Analysis
+	if err := json.Unmarshal([]byte(content), &analysis); err != nil {
+		return nil, fmt.Errorf("failed to parse AI response: %v, content: %s", err, content)
+	}
+
+	if analysis.SpeciesPresent[defaultSpecies] {
+		analysis.HasDog = true
+	}
+	if !analysis.HasPet {
+		analysis.HasPet = analysis.hasAnyPet()
+	}
+	analysis.PetBoxes = sanitizePetBoxes(analysis.PetBoxes, sentFrames)
+
+	log.Printf("✅ Video %s analyzed: has_pet=%v, species=%v, has_human=%v, interaction=%s, emotion=%s, caption=%s, pet_boxes=%d",
+		videoID, analysis.HasPet, analysis.SpeciesPresent, analysis.HasHuman, analysis.InteractionType, analysis.Emotion, analysis.ShortCaption, len(analysis.PetBoxes))
+
+	return &analysis, nil
+}
+
+// analyzeSegmentWithAI - 保留此函數供 Phase 1 使用
+func analyzeSegmentWithAI(segment *Segment) (*Analysis, error) {
+	if len(segment.FramePaths) == 0 {
+		return nil, fmt.Errorf("no frames in segment")
+	}
+
+	// 使用新的函數分析
+	return analyzeVideoWithAI(segment.FramePaths, fmt.Sprintf("segment_%d", segment.Index), nil, getLanguageProfile(defaultLanguage))
+}
+
+func findHighlights(job *Job) error {
+	highlights := []Highlight{}
+
+	var currentHighlight *Highlight
+
+	for _, segment := range job.Segments {
+		if segment.Analysis == nil {
+			continue
+		}
+
+		// Check if this segment qualifies as highlight
+		if segment.Analysis.HasDog && segment.Analysis.HasHuman &&
+			segment.Analysis.InteractionType != "none" {
+
+			if currentHighlight == nil {
+				// Start new highlight
+				currentHighlight = &Highlight{
+					Start:       segment.Start,
+					End:         segment.End,
+					Caption:     segment.Analysis.ShortCaption,
+					Interaction: segment.Analysis.InteractionType,
+					Emotion:     segment.Analysis.Emotion,
+				}
+			} else {
+				// Extend current highlight
+				currentHighlight.End = segment.End
+				if currentHighlight.Caption != "" {
+					currentHighlight.Caption += " → " + segment.Analysis.ShortCaption
+				}
+			}
+		} else {
+			// No interaction, save current highlight if exists
+			if currentHighlight != nil {
+				highlights = append(highlights, *currentHighlight)
+				currentHighlight = nil
+			}
+		}
+	}
+
+	// Save last highlight if exists
+	if currentHighlight != nil {
+		highlights = append(highlights, *currentHighlight)
+	}
+
+	jobsMutex.Lock()
+	job.Highlights = highlights
+	jobsMutex.Unlock()
+
+	log.Printf("Found %d highlights for job %s", len(highlights), job.ID)
+	return nil
+}
+
+func createHighlightVideo(job *Job) error {
+	if len(job.Highlights) == 0 {
+		return nil
+	}
+
+	outputDir := filepath.Join(storagePath, "videos", job.ID)
+	outputPath := filepath.Join(outputDir, "highlight.mp4")
+
+	// For simplicity, create video from first highlight
+	// In production, you'd concatenate all highlights
+	highlight := job.Highlights[0]
+
+	cmd := exec.Command("ffmpeg",
+		"-i", job.VideoPath,
+		"-ss", fmt.Sprintf("%.2f", highlight.Start),
+		"-to", fmt.Sprintf("%.2f", highlight.End),
+		"-c", "copy",
+		"-y",
+		outputPath,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
+	}
+
+	jobsMutex.Lock()
+	job.HighlightVideo = outputPath
+	jobsMutex.Unlock()
+
+	log.Printf("Created highlight video for job %s", job.ID)
+	return nil
+}
+
+func markJobFailed(jobID, errorMsg string) {
+	log.Printf("Job %s failed: %s", jobID, errorMsg)
+
+	jobsMutex.Lock()
+	if job, exists := jobs[jobID]; exists {
+		job.Status = "failed"
+		job.Error = errorMsg
+		job.UpdatedAt = time.Now()
+	}
+	jobsMutex.Unlock()
+}
+
+// ============================================================================
+// Phase 2 Processing Pipeline
+// ============================================================================
+
+func processProject(projectID string) {
+	projectsMutex.Lock()
+	project := projects[projectID]
+	project.Status = "analyzing"
+	project.UpdatedAt = time.Now()
+	projectsMutex.Unlock()
+
+	log.Printf("Processing project %s with %d videos", projectID, len(project.Videos))
+
+	// Step 1: Analyze all videos (繼續處理即使有錯誤)
+	successCount := 0
+	for i := range project.Videos {
+		if err := analyzeVideo(project, i); err != nil {
+			log.Printf("⚠️ Warning: Failed to analyze video %s: %v (continuing)", project.Videos[i].ID, err)
+			// 不要立即返回，繼續處理其他影片
+			continue
+		}
+		successCount++
+	}
+
+	// 至少要有一半的影片分析成功才能繼續
+	if successCount == 0 {
+		markProjectFailed(projectID, "All videos failed to analyze")
+		return
+	}
+
+	log.Printf("✅ Successfully analyzed %d/%d videos", successCount, len(project.Videos))
+
+	// Step 2: Generate story with AI
+	projectsMutex.Lock()
+	project.Status = "generating_story"
+	project.UpdatedAt = time.Now()
+	projectsMutex.Unlock()
+
+	// 需要多份候選故事時，產生完就停下來等使用者選擇，避免花時間合成沒被選上的版本
+	if project.DraftCount > 1 {
+		drafts := generateStoryDrafts(project, project.DraftCount)
+		if len(drafts) == 0 {
+			markProjectFailed(projectID, "Failed to generate any story draft")
+			return
+		}
+
+		projectsMutex.Lock()
+		project.StoryDrafts = drafts
+		project.SelectedDraft = 0
+		project.Story = nil
+		project.FinalVideo = ""
+		project.FinalVideos = nil
+		project.Loudness = nil
+		project.Status = "awaiting_selection"
+		project.UpdatedAt = time.Now()
+		projectsMutex.Unlock()
+
+		log.Printf("Project %s: %d story drafts ready, waiting for selection", projectID, len(drafts))
+		return
+	}
+
+	story, err := generateStoryWithAI(project)
+	if err != nil {
+		markProjectFailed(projectID, "Failed to generate story: "+err.Error())
+		return
+	}
+
+	projectsMutex.Lock()
+	project.Story = story
+	project.StoryDrafts = nil
+	project.SelectedDraft = 0
+	project.Status = "generating_video"
+	project.UpdatedAt = time.Now()
+	projectsMutex.Unlock()
+
+	renderProject(projectID)
+}
+
+// renderProject 根據目前的故事產生 TTS 並合成最終影片
+func renderProject(projectID string) {
+	projectsMutex.RLock()
+	project := projects[projectID]
+	projectsMutex.RUnlock()
+
+	// Step 3: Generate TTS audio for each chapter
+	for i := range project.Story.Chapters {
+		if err := generateTTS(project, i); err != nil {
+			log.Printf("Warning: TTS generation failed for chapter %d: %v", i, err)
+			// Continue without audio
+		}
+	}
+
+	// Step 4: Composite final video (with subtitles and background music)
+	if err := compositeVideo(project); err != nil {
+		markProjectFailed(projectID, "Failed to composite video: "+err.Error())
+		return
+	}
+
+	projectsMutex.Lock()
+	project.Status = "completed"
+	project.UpdatedAt = time.Now()
+	projectsMutex.Unlock()
+
+	log.Printf("Project %s completed successfully", projectID)
+}
+
+// generateStoryDrafts 產生多份候選故事，個別失敗不影響其他份
+func generateStoryDrafts(project *Project, count int) []*Story {
+	drafts := []*Story{}
+	for i := 0; i < count; i++ {
+		log.Printf("Generating story draft %d/%d for project %s", i+1, count, project.ID)
+		story, err := generateStoryWithAI(project)
+		if err != nil {
+			log.Printf("⚠️ Warning: story draft %d failed: %v (continuing)", i+1, err)
+			continue
+		}
+		drafts = append(drafts, story)
+	}
+	return drafts
+}
+
+// cloneStory 複製故事，避免選定的草稿與正式故事共用同一份章節資料
+func cloneStory(story *Story) *Story {
+	cloned := *story
+	cloned.Chapters = make([]StoryChapter, len(story.Chapters))
+	copy(cloned.Chapters, story.Chapters)
+	for i := range cloned.Chapters {
+		cloned.Chapters[i].NarrationHistory = append([]string(nil), story.Chapters[i].NarrationHistory...)
+	}
+	return &cloned
+}
+
+// clampDraftCount 將候選故事數量限制在 1～5 份
+func clampDraftCount(count int) int {
+	if count < 1 {
+		return 1
+	}
+	if count > 5 {
+		return 5
+	}
+	return count
+}
+
+func analyzeVideo(project *Project, videoIndex int) error {
+	video := &project.Videos[videoIndex]
+
+	if video.isPhoto() {
+		return analyzePhoto(project, videoIndex)
+	}
+
+	log.Printf("Analyzing video %s (%s)", video.ID, video.OriginalName)
+
+	// Extract frames - 每2秒一張 (fps=0.5)
+	os.MkdirAll(video.FramesDir, 0755)
+	outputPattern := filepath.Join(video.FramesDir, "frame_%04d.jpg")
+	// 直式影片先轉正，縮放時保持比例（最長邊 640），避免直式畫面被壓扁
+	frameFilter := "fps=0.5,scale=640:640:force_original_aspect_ratio=decrease"
+	if rotate := rotationFilter(video.Rotation); rotate != "" {
+		frameFilter = rotate + "," + frameFilter
+	}
+	cmd := exec.Command("ffmpeg", "-noautorotate", "-i", video.Path, "-vf", frameFilter, outputPattern)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
+	}
+
+	// Get all frame files
+	files, err := filepath.Glob(filepath.Join(video.FramesDir, "frame_*.jpg"))
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no frames extracted")
+	}
+
+	log.Printf("Extracted %d frames from video %s", len(files), video.ID)
+
+	// **新邏輯：整個影片只打一次 API，一次傳送所有圖片（最多10張）**
+	analysis, err := analyzeVideoWithAI(files, video.ID, projectSpecies(project), getLanguageProfile(project.Language))
+	if err != nil {
+		log.Printf("Warning: AI analysis failed for video %s: %v (using default analysis)", video.ID, err)
+		// 使用預設分析，讓流程繼續
+		analysis = &Analysis{
+			HasDog:          true,
+			HasPet:          true,
+			HasHuman:        true,
+			InteractionType: "none",
+			Emotion:         "neutral",
+			ShortCaption:    getLanguageProfile(project.Language).PromptLabels.Video,
+		}
+	}
+
+	// 根據 AI 分析結果創建 segments（每個 segment = 6 秒）
+	segmentSize := 3 // 3 frames = 6 seconds at fps=0.5 (2s per frame)
+	segments := []Segment{}
+
+	for i := 0; i < len(files); i += segmentSize {
+		end := i + segmentSize
+		if end > len(files) {
+			end = len(files)
+		}
+
+		segment := Segment{
+			Index:      len(segments) + 1,
+			Start:      float64(i) * 2.0, // 2.0s per frame at fps=0.5
+			End:        float64(end) * 2.0,
+			FramePaths: files[i:end],
+			Analysis:   analysis, // 所有 segment 使用相同的分析結果
+		}
+		segments = append(segments, segment)
+	}
+
+	// Find highlights based on analysis
+	highlights := []Highlight{}
+
+	// 如果有互動，將整個影片（或前幾個 segment）標記為 highlight
+	if analysis.hasAnyPet() && analysis.HasHuman && analysis.InteractionType != "none" {
+		// 取前 15 秒作為 highlight
+		maxHighlightDuration := 15.0
+		for _, segment := range segments {
+			if segment.End <= maxHighlightDuration {
+				if len(highlights) == 0 {
+					highlights = append(highlights, Highlight{
+						Start:       segment.Start,
+						End:         segment.End,
+						Caption:     analysis.ShortCaption,
+						Interaction: analysis.InteractionType,
+						Emotion:     analysis.Emotion,
+					})
+				} else {
+					highlights[0].End = segment.End
+				}
+			}
+		}
+	}
+
+	// 毛小孩的位置換算成影片中的秒數（每 2 秒一張截圖）
+	track := make([]PetBox, len(analysis.PetBoxes))
+	for i, box := range analysis.PetBoxes {
+		box.Time = float64(box.Frame) * 2.0
+		track[i] = box
+	}
+
+	// Update video info
+	projectsMutex.Lock()
+	project.Videos[videoIndex].Segments = segments
+	project.Videos[videoIndex].Highlights = highlights
+	project.Videos[videoIndex].PetTrack = track
+	project.Videos[videoIndex].Analyzed = true
+	projectsMutex.Unlock()
+
+	log.Printf("Analyzed video %s: %d segments, %d highlights", video.ID, len(segments), len(highlights))
+	return nil
+}
+
+// analyzePhoto 照片直接送進同一個視覺分析，整張照片視為一個片段
+func analyzePhoto(project *Project, videoIndex int) error {
+	photo := &project.Videos[videoIndex]
+
+	log.Printf("Analyzing photo %s (%s)", photo.ID, photo.OriginalName)
+
+	analysis, err := analyzeVideoWithAI([]string{photo.Path}, photo.ID, projectSpecies(project), getLanguageProfile(project.Language))
+	if err != nil {
+		log.Printf("Warning: AI analysis failed for photo %s: %v (using default analysis)", photo.ID, err)
+		analysis = &Analysis{
+			HasDog:          true,
+			HasPet:          true,
+			InteractionType: "none",
+			Emotion:         "neutral",
+			ShortCaption:    getLanguageProfile(project.Language).PromptLabels.Photo,
+		}
+	}
+
+	segments := []Segment{{
+		Index:      1,
+		Start:      0,
+		End:        photo.Duration,
+		FramePaths: []string{photo.Path},
+		Analysis:   analysis,
+	}}
+
+	// 照片常常只有毛小孩自己（尤其是紀念用的舊照片），有毛小孩就當作高光
+	highlights := []Highlight{}
+	if analysis.hasAnyPet() {
+		highlights = append(highlights, Highlight{
+			Start:       0,
+			End:         photo.Duration,
+			Caption:     analysis.ShortCaption,
+			Interaction: analysis.InteractionType,
+			Emotion:     analysis.Emotion,
+		})
+	}
+
+	projectsMutex.Lock()
+	project.Videos[videoIndex].Segments = segments
+	project.Videos[videoIndex].Highlights = highlights
+	project.Videos[videoIndex].PetTrack = analysis.PetBoxes
+	project.Videos[videoIndex].Analyzed = true
+	projectsMutex.Unlock()
+
+	log.Printf("Analyzed photo %s: %d highlights", photo.ID, len(highlights))
+	return nil
+}
+
+// 有ＡＩ
+func generateStoryWithAI(project *Project) (*Story, error) {
+	log.Printf("Generating story for project %s with AI (mode: %s)", project.ID, project.StoryMode)
+
+	// 收集所有高光片段的描述
+	labels := getLanguageProfile(project.Language).PromptLabels
+	allHighlights := []string{}
+	for _, video := range project.Videos {
+		label := labels.Video
+		if video.isPhoto() {
+			label = labels.Photo
+		}
+		for _, highlight := range video.Highlights {
+			allHighlights = append(allHighlights, fmt.Sprintf("%s《%s》: %s %s",
+				label, video.OriginalName, highlight.Caption, fmt.Sprintf(labels.Emotion, highlight.Emotion)))
+		}
+	}
+
+	if len(allHighlights) == 0 {
+		return nil, fmt.Errorf("no highlights found in any video")
+	}
+
+	// 根據關係設定稱呼
+	ownerTitle := projectOwnerTitle(project)
+
+	// 根據模式設定不同的提示詞風格
+	mode := resolveProjectStoryMode(project)
+	promptCtx, err := newPromptContext(project, ownerTitle, mode.localized(promptLanguage(project)).Story)
+	if err != nil {
+		return nil, err
+	}
+
+	// 構建 prompt - 生成 5 段狗狗對白（加長、加細節）
+	prompt, err := renderPromptTemplate(mode, "story", promptLanguage(project), StoryPromptData{
+		PromptContext: promptCtx,
+		Highlights:    strings.Join(allHighlights, "\n"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 調用 Gemini AI
+	requestBody := map[string]interface{}{
+		"contents": []map[string]interface{}{
+			{
+				"parts": []map[string]interface{}{
+					{"text": prompt},
+				},
+			},
+		},
+		"generationConfig": map[string]interface{}{
+			"temperature":      0.8, // 稍微提高溫度，讓語氣更活潑
+			"maxOutputTokens":  8000,
+			"responseMimeType": "application/json",
+		},
+	}
+
+	jsonData, _ := json.Marshal(requestBody)
+	url := fmt.Sprintf("%s?key=%s", aiAPIEndpoint, aiAPIKey)
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	var apiResponse struct {
+		Candidates []struct {
+			Content struct {
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"content"`
+		} `json:"candidates"`
+	}
+
+	if err := json.Unmarshal(bodyBytes, &apiResponse); err != nil {
+		return nil, err
+	}
+
+	if len(apiResponse.Candidates) == 0 {
+		log.Printf("Story generation failed: no candidates. Response: %s", string(bodyBytes))
+		return nil, fmt.Errorf("no content in AI response")
+	}
+
+	candidate := apiResponse.Candidates[0]
+
+	if len(candidate.Content.Parts) == 0 {
+		log.Printf("Story generation failed: no parts. FinishReason: %v, Response: %s",
+			candidate, string(bodyBytes))
+		return nil, fmt.Errorf("no content in AI response (finishReason may be MAX_TOKENS or SAFETY)")
+	}
+
+	content := apiResponse.Candidates[0].Content.Parts[0].Text
+	log.Printf("Story AI response content: %s", content)
+	content = strings.TrimPrefix(content, "```json")
+	content = strings.TrimPrefix(content, "```")
+	content = strings.TrimSuffix(content, "```")
+	content = strings.TrimSpace(content)
+
+	var storyResponse struct {
+		Title    string `json:"title"`
+		Chapters []struct {
+			Narration      string `json:"narration"`
+			VideoIndex     int    `json:"video_index"`
+			HighlightIndex int    `json:"highlight_index"`
+			Speaker        string `json:"speaker"`
+		} `json:"chapters"`
+	}
+
+	if err := json.Unmarshal([]byte(content), &storyResponse); err != nil {
+		return nil, fmt.Errorf("failed to parse story: %v", err)
+	}
+
+	// 轉換為 Story 結構
+	story := &Story{
+		Title:    storyResponse.Title,
+		Chapters: []StoryChapter{},
+	}
+
+	for i, ch := range storyResponse.Chapters {
+		if ch.VideoIndex >= len(project.Videos) {
+			log.Printf("Warning: chapter %d video_index %d >= videos length %d, skipping",
+				i, ch.VideoIndex, len(project.Videos))
+			continue
+		}
+		video := project.Videos[ch.VideoIndex]
+
+		// 如果沒有 highlights 或 highlight_index 超出範圍，使用整個影片
+		var startTime, endTime float64
+		if len(video.Highlights) > 0 && ch.HighlightIndex < len(video.Highlights) {
+			highlight := video.Highlights[ch.HighlightIndex]
+			startTime = highlight.Start
+			endTime = highlight.End
+		} else {
+			// 沒有 highlights，使用影片前 15 秒
+			startTime = 0
+			endTime = 15.0
+			if video.Duration > 0 && video.Duration < 15.0 {
+				endTime = video.Duration
+			}
+			log.Printf("Using full video duration for chapter %d: 0 to %.2f", i+1, endTime)
+		}
+
+		chapter := StoryChapter{
+			Index:     i + 1,
+			Narration: ch.Narration,
+			VideoID:   video.ID,
+			StartTime: startTime,
+			EndTime:   endTime,
+			Duration:  endTime - startTime,
+		}
+		if project.NarrationStyle == "multi" {
+			chapter.Speaker = ch.Speaker
+		}
+		story.Chapters = append(story.Chapters, chapter)
+	}
+
+	log.Printf("Generated story with %d chapters", len(story.Chapters))
+
+	// 如果主人有留言，生成狗狗的回應
+	if project.OwnerMessage != "" {
+		dogResponse, err := generateDogResponse(project, story)
+		if err != nil {
+			log.Printf("Warning: Failed to generate dog response: %v", err)
+			story.DogResponse = fmt.Sprintf(getLanguageProfile(project.Language).ShortResponse, ownerTitle) // 預設回應
+		} else {
+			story.DogResponse = dogResponse
+		}
+		story.OwnerMessage = project.OwnerMessage
+	}
+
+	return story, nil
+}
+
+// 有ＡＩ
+func generateDogResponse(project *Project, story *Story) (string, error) {
+	log.Printf("Generating dog response for project %s", project.ID)
+
+	// 收集影片描述（給模型一點上下文，不用太長）
+	videoDescriptions := []string{}
+	for i, chapter := range story.Chapters {
+		videoDescriptions = append(videoDescriptions, fmt.Sprintf("影片 %d: %s", i+1, chapter.Narration))
+	}
+
+	// 根據關係設定稱呼
+	ownerTitle := projectOwnerTitle(project)
+
+	// 根據模式設定不同的回應風格
+	mode := resolveProjectStoryMode(project)
+	promptCtx, err := newPromptContext(project, ownerTitle, mode.localized(promptLanguage(project)).DogResponse)
+	if err != nil {
+		return "", err
+	}
+
+	// 建立 prompt：讓狗狗在結尾說一段「成熟、真心安慰媽媽」的告白
+	prompt, err := renderPromptTemplate(mode, "dog_response", promptLanguage(project), DogResponsePromptData{
+		PromptContext: promptCtx,
+		OwnerMessage:  project.OwnerMessage,
+		Memories:      strings.Join(videoDescriptions, "\n"),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Dog response prompt (mode=%s v%d): %s", mode.ID, mode.Version, prompt)
+
+	requestBody := map[string]interface{}{
+		"contents": []map[string]interface{}{
+			{
+				"parts": []map[string]interface{}{
+					{"text": prompt},
+				},
+			},
+		},
+		"generationConfig": map[string]interface{}{
+			"temperature":     0.9,
+			"maxOutputTokens": 2000,
+		},
+		// 放寬安全過濾，避免寵物紀念內容被誤判為敏感內容
+		"safetySettings": []map[string]interface{}{
+			{"category": "HARM_CATEGORY_HARASSMENT", "threshold": "BLOCK_NONE"},
+			{"category": "HARM_CATEGORY_HATE_SPEECH", "threshold": "BLOCK_NONE"},
+			{"category": "HARM_CATEGORY_SEXUALLY_EXPLICIT", "threshold": "BLOCK_NONE"},
+			{"category": "HARM_CATEGORY_DANGEROUS_CONTENT", "threshold": "BLOCK_NONE"},
+		},
+	}
+
+	jsonData, _ := json.Marshal(requestBody)
+	url := fmt.Sprintf("%s?key=%s", aiAPIEndpoint, aiAPIKey)
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	// 印出完整 raw response 方便 debug 截斷問題
+	log.Printf("[DEBUG] Gemini raw response for dog_response (len=%d): %s", len(bodyBytes), string(bodyBytes))
+
+	var apiResponse struct {
+		Candidates []struct {
+			Content struct {
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"content"`
+			FinishReason string `json:"finishReason"`
+		} `json:"candidates"`
+	}
+
+	if err := json.Unmarshal(bodyBytes, &apiResponse); err != nil {
+		log.Printf("[ERROR] Failed to unmarshal Gemini response: %v", err)
+		return "", err
+	}
+
+	if len(apiResponse.Candidates) == 0 || len(apiResponse.Candidates[0].Content.Parts) == 0 {
+		return "", fmt.Errorf("no response from AI")
+	}
+
+	// 將所有 parts 的文字串接起來，避免只取第一個 part 導致內容被截斷
+	var sb strings.Builder
+	for _, part := range apiResponse.Candidates[0].Content.Parts {
+		sb.WriteString(part.Text)
+	}
+	response := sb.String()
+
+	finishReason := apiResponse.Candidates[0].FinishReason
+	log.Printf("Raw dog response text (finishReason=%s, len=%d): %q", finishReason, len(response), response)
+
+	// 如果被截斷（MAX_TOKENS）或字數太少，給一個警告
+	if finishReason == "MAX_TOKENS" {
+		log.Printf("⚠️ WARNING: dog response was truncated by MAX_TOKENS!")
+	}
+
+	response = strings.TrimSpace(response)
+	// 去掉可能包起來的引號或書名號
+	response = strings.Trim(response, "「」\"")
+
+	// 檢查長度與結尾，避免看起來像「講到一半就被切斷」
+	lang := getLanguageProfile(project.Language)
+	length := textLength(response, lang)
+	log.Printf("Generated dog response (cleaned, length=%d %s): %s", length, lang.LengthUnit, response)
+
+	// 強制限制長度在該語言的範圍內
+	if length > lang.ResponseMax {
+		log.Printf("⚠️ Dog response too long (%d), truncating to %d", length, lang.ResponseMax)
+		// 在最後一個句號、逗號或感嘆號的位置截斷比較自然
+		response = truncateToLength(response, lang, lang.ResponseMin, lang.ResponseMax)
+		log.Printf("✂️ Truncated to %d: %s", textLength(response, lang), response)
+	} else if length < lang.ResponseMin {
+		log.Printf("⚠️ Dog response too short (%d), using fallback", length)
+		response = fmt.Sprintf(lang.LongResponse, ownerTitle)
+	}
+
+	// 確保結尾有標點符號（但不要再加長文字，避免超過字數限制）
+	response = ensureSentenceEnd(response, lang)
+
+	// 最終檢查長度
+	log.Printf("Final dog response (length=%d): %s", textLength(response, lang), response)
+
+	return response, nil
+}
+
+// 有ＡＩ
+// regenerateChapterNarration 根據使用者回饋重寫單一章節的對白，保留舊版本供還原
+// story 為呼叫者在鎖內複製的故事，呼叫 AI 期間不會持有鎖
+func regenerateChapterNarration(project *Project, story *Story, chapterPos int, feedback string) (string, error) {
+	chapter := story.Chapters[chapterPos]
+
+	log.Printf("Regenerating narration for project %s chapter %d (mode: %s, feedback: %q)",
+		project.ID, chapter.Index, project.StoryMode, feedback)
+
+	ownerTitle := projectOwnerTitle(project)
+
+	mode := resolveProjectStoryMode(project)
+	promptCtx, err := newPromptContext(project, ownerTitle, mode.localized(promptLanguage(project)).Story)
+	if err != nil {
+		return "", err
+	}
+
+	labels := getLanguageProfile(project.Language).PromptLabels
+
+	// 高光片段描述，讓新對白仍然對得上畫面
+	caption := labels.NoCaption
+	if highlight := findChapterHighlight(project, chapter); highlight != nil {
+		caption = highlight.Caption + " " + fmt.Sprintf(labels.Emotion, highlight.Emotion)
+	}
+
+	// 前後章節作為上下文，避免重複或接不起來
+	prevNarration := labels.FirstChapter
+	if chapterPos > 0 {
+		prevNarration = story.Chapters[chapterPos-1].Narration
+	}
+	nextNarration := labels.LastChapter
+	if chapterPos < len(story.Chapters)-1 {
+		nextNarration = story.Chapters[chapterPos+1].Narration
+	}
+
+	if strings.TrimSpace(feedback) == "" {
+		feedback = labels.DefaultFeedback
+	}
+
+	prompt, err := renderPromptTemplate(mode, "chapter_regenerate", promptLanguage(project), ChapterPromptData{
+		PromptContext:    promptCtx,
+		StoryTitle:       story.Title,
+		ChapterCount:     len(story.Chapters),
+		ChapterIndex:     chapter.Index,
+		Caption:          caption,
+		PrevNarration:    prevNarration,
+		CurrentNarration: chapter.Narration,
+		NextNarration:    nextNarration,
+		Feedback:         feedback,
+		Speaker:          chapter.Speaker,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	response, err := callGeminiText(prompt, 0.9, 2000)
+	if err != nil {
+		return "", err
+	}
+
+	response = strings.TrimSpace(response)
+	response = strings.Trim(response, "「」\"")
+	if response == "" {
+		return "", fmt.Errorf("empty narration from AI")
+	}
+
+	log.Printf("Regenerated chapter %d narration: %s", chapter.Index, response)
+	return response, nil
+}
+
+// findChapterHighlight 找出章節所使用的高光片段
+func findChapterHighlight(project *Project, chapter StoryChapter) *Highlight {
+	for _, video := range project.Videos {
+		if video.ID != chapter.VideoID {
+			continue
+		}
+		for i := range video.Highlights {
+			if video.Highlights[i].Start == chapter.StartTime {
+				return &video.Highlights[i]
+			}
+		}
+	}
+	return nil
+}
+
+// callGeminiText 送出純文字 prompt，回傳模型輸出的文字
+func callGeminiText(prompt string, temperature float64, maxOutputTokens int) (string, error) {
+	requestBody := map[string]interface{}{
+		"contents": []map[string]interface{}{
+			{
+				"parts": []map[string]interface{}{
+					{"text": prompt},
+				},
+			},
+		},
+		"generationConfig": map[string]interface{}{
+			"temperature":     temperature,
+			"maxOutputTokens": maxOutputTokens,
+		},
+	}
+
+	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	url := fmt.Sprintf("%s?key=%s", aiAPIEndpoint, aiAPIKey)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API error %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var apiResponse struct {
+		Candidates []struct {
+			Content struct {
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"content"`
+			FinishReason string `json:"finishReason"`
+		} `json:"candidates"`
+	}
+
+	if err := json.Unmarshal(bodyBytes, &apiResponse); err != nil {
+		return "", fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	if len(apiResponse.Candidates) == 0 || len(apiResponse.Candidates[0].Content.Parts) == 0 {
+		return "", fmt.Errorf("no content in AI response")
+	}
+
+	var sb strings.Builder
+	for _, part := range apiResponse.Candidates[0].Content.Parts {
+		sb.WriteString(part.Text)
+	}
+
+	if apiResponse.Candidates[0].FinishReason == "MAX_TOKENS" {
+		log.Printf("⚠️ WARNING: AI response was truncated by MAX_TOKENS!")
+	}
+
+	return sb.String(), nil
+}
+
+func generateTTS(project *Project, chapterIndex int) error {
+	chapter := &project.Story.Chapters[chapterIndex]
+
+	log.Printf("Generating TTS for chapter %d: %s", chapterIndex+1, chapter.Narration)
+
+	lang := getLanguageProfile(project.Language)
+	voice := speakerVoice(project, chapter.Speaker, lang.NarratorVoice)
+
+	// 使用 Google Cloud Text-to-Speech API
+	// API endpoint: https://texttospeech.googleapis.com/v1beta1/text:synthesize
+	// 以 SSML 在每一句前面加 mark，回傳的時間點用來對齊字幕
+	sentences := splitSentences(chapter.Narration)
+	if len(sentences) == 0 {
+		// 沒有旁白就不送出空的 <speak></speak>，並清掉之前產生的音檔，這一段只有畫面
+		log.Printf("⚠️ Chapter %d has no narration, skipping TTS", chapterIndex+1)
+		projectsMutex.Lock()
+		project.Story.Chapters[chapterIndex].AudioPath = ""
+		project.Story.Chapters[chapterIndex].Duration = 0
+		project.Story.Chapters[chapterIndex].SentenceTimes = nil
+		projectsMutex.Unlock()
+		return nil
+	}
+
+	requestBody := map[string]interface{}{
+		"input": map[string]string{
+			"ssml": narrationSSML(sentences),
+		},
+		"enableTimePointing": []string{"SSML_MARK"},
+		"voice": map[string]interface{}{
+			"languageCode": lang.TTSLanguageCode,
+			"name":         voice.Name,
+			"ssmlGender":   voice.Gender,
+		},
+		"audioConfig": map[string]interface{}{
+			"audioEncoding": "MP3",
+			"speakingRate":  voice.SpeakingRate, // 稍微慢一點，更溫暖
+			"pitch":         voice.Pitch,
+		},
+	}
+
+	// 儲存音訊檔案
+	outputDir := filepath.Join(storagePath, "projects", project.ID, "audio")
+	os.MkdirAll(outputDir, 0755)
+
+	audioPath := filepath.Join(outputDir, fmt.Sprintf("chapter_%d.mp3", chapterIndex+1))
+	sentenceTimes, err := executeTTSRequest(requestBody, audioPath, len(sentences))
+	if err != nil {
+		return err
+	}
+
+	// 取得音訊時長
+	duration := getAudioDuration(audioPath)
+
+	// 更新章節資訊
+	projectsMutex.Lock()
+	project.Story.Chapters[chapterIndex].AudioPath = audioPath
+	project.Story.Chapters[chapterIndex].Duration = duration
+	project.Story.Chapters[chapterIndex].SentenceTimes = sentenceTimes
+	projectsMutex.Unlock()
+
+	log.Printf("Generated TTS audio for chapter %d (duration: %.2fs)", chapterIndex+1, duration)
+	return nil
+}
+
+func getAudioDuration(audioPath string) float64 {
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		audioPath,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0
+	}
+
+	duration := 0.0
+	fmt.Sscanf(string(output), "%f", &duration)
+	return duration
+}
+
+func compositeVideo(project *Project) error {
+	log.Printf("Compositing final video for project %s (with transitions, subtitles and music)", project.ID)
+
+	if len(project.Story.Chapters) == 0 {
+		return fmt.Errorf("no chapters to composite")
+	}
+
+	outputDir := filepath.Join(storagePath, "projects", project.ID)
+
+	// 結尾的狗狗回應只產生一次，所有比例共用
+	log.Printf("📸 EndingImage check: EndingImage='%s', DogResponse='%s', OwnerMessage='%s'",
+		project.EndingImage, project.Story.DogResponse, project.OwnerMessage)
+	if project.EndingImage != "" {
+		// 如果有 OwnerMessage 但 DogResponse 還是預設的簡短回應，重新生成
+		lang := getLanguageProfile(project.Language)
+		ownerTitle := projectOwnerTitle(project)
+		if project.OwnerMessage != "" && (project.Story.DogResponse == "" || project.Story.DogResponse == fmt.Sprintf(lang.ShortResponse, ownerTitle)) {
+			log.Printf("🤖 Regenerating dog response based on owner message")
+			dogResponse, err := generateDogResponse(project, project.Story)
+			if err != nil {
+				log.Printf("⚠️ Failed to generate dog response: %v, using default", err)
+				project.Story.DogResponse = fmt.Sprintf(lang.LongResponse, ownerTitle)
+			} else {
+				project.Story.DogResponse = dogResponse
+				log.Printf("✅ Generated dog response: %s", dogResponse)
+			}
+			project.Story.OwnerMessage = project.OwnerMessage
+		} else if project.Story.DogResponse == "" {
+			log.Printf("⚠️ No DogResponse, using default response for ending")
+			project.Story.DogResponse = fmt.Sprintf(lang.LongResponse, ownerTitle)
+		}
+
+		// 結尾唸出主人的話與毛小孩的回應，所有比例共用
+		generateEndingSpeech(project)
+	}
+
+	// 同一個故事依序輸出每一種比例
+	finalVideos := map[string]string{}
+	loudness := map[string]*LoudnessStats{}
+	for _, id := range projectOutputFormats(project) {
+		format := getOutputFormat(id)
+		finalVideoPath := filepath.Join(outputDir, finalVideoName(project, format))
+		stats, err := compositeVideoFormat(project, format, finalVideoPath)
+		if err != nil {
+			return fmt.Errorf("failed to render %s: %v", format.ID, err)
+		}
+		finalVideos[format.ID] = finalVideoPath
+		if stats != nil {
+			loudness[format.ID] = stats
+		}
+	}
+
+	projectsMutex.Lock()
+	project.FinalVideo = finalVideos[projectOutputFormats(project)[0]]
+	project.FinalVideos = finalVideos
+	project.Loudness = loudness
+	projectsMutex.Unlock()
+
+	log.Printf("✅ Created final video with all effects for project %s (%d formats)", project.ID, len(finalVideos))
+	return nil
+}
+
+// compositeVideoFormat 以指定比例合成一支成品，中間檔案放在各自的工作目錄避免互相覆蓋，回傳成品的響度量測（沒有正規化時為 nil）
+func compositeVideoFormat(project *Project, format *OutputFormat, finalVideoPath string) (*LoudnessStats, error) {
+	log.Printf("🎞️ Rendering %s (%dx%d) for project %s", format.ID, format.Width, format.Height, project.ID)
+
+	workDir := filepath.Join(filepath.Dir(finalVideoPath), "render_"+format.fileKey())
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create work dir: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// Step 1: 生成帶轉場效果的影片片段（只保留 TTS，有設定時原音壓在旁白下面）
+	log.Printf("Step 1: Creating video segments with transitions and TTS audio")
+	videoWithTTSPath := filepath.Join(workDir, "video_with_tts.mp4")
+	if err := createVideoWithTransitionsAndTTS(project, format, videoWithTTSPath); err != nil {
+		return nil, fmt.Errorf("failed to create video with transitions: %v", err)
+	}
+
+	// Step 2: 如果有結尾圖片和狗狗回應，添加結尾片段
+	videoWithEndingPath := videoWithTTSPath
+	if project.EndingImage != "" {
+		log.Printf("Step 2: Adding ending image with dog response")
+		videoWithEndingPath = filepath.Join(workDir, "video_with_ending.mp4")
+		if err := addEndingImage(project, format, videoWithTTSPath, videoWithEndingPath); err != nil {
+			log.Printf("❌ Failed to add ending image: %v, continuing without it", err)
+			videoWithEndingPath = videoWithTTSPath
+		} else {
+			log.Printf("✅ Ending image added successfully")
+		}
+	} else {
+		log.Printf("Step 2: Skipping ending image (EndingImage path is empty)")
+	}
+
+	// Step 3: 燒錄字幕
+	subtitleMode := normalizeSubtitleMode(project.SubtitleMode)
+	subtitledVideoPath := videoWithEndingPath
+	if subtitleMode == subtitlesBurn || subtitleMode == subtitlesBoth {
+		log.Printf("Step 3: Burning subtitles")
+		subtitledVideoPath = filepath.Join(workDir, "subtitled_video.mp4")
+		if err := addSubtitles(project, format, videoWithEndingPath, subtitledVideoPath); err != nil {
+			log.Printf("Warning: Failed to add subtitles: %v, continuing without subtitles", err)
+			subtitledVideoPath = videoWithEndingPath
+		}
+	} else {
+		log.Printf("Step 3: Skipping burned subtitles (mode: %s)", subtitleMode)
+	}
+
+	// Step 4: 加入背景音樂，旁白出聲時自動壓低，開頭淡入、結尾淡出（音量與閃避依 audio_mix）
+	log.Printf("Step 4: Adding background music")
+	musicVideoPath := filepath.Join(workDir, "video_with_music.mp4")
+	if err := addBackgroundMusic(project, subtitledVideoPath, musicVideoPath); err != nil {
+		log.Printf("Warning: Failed to add background music: %v, using version without music", err)
+		musicVideoPath = subtitledVideoPath
+	}
+
+	// Step 5: 響度正規化（EBU R128 兩階段 loudnorm），不同的旁白、音樂與混音在手機上聽起來一樣大聲
+	log.Printf("Step 5: Normalizing loudness")
+	normalizedVideoPath := filepath.Join(workDir, "video_normalized.mp4")
+	loudness, err := normalizeLoudness(project, musicVideoPath, normalizedVideoPath)
+	if err != nil {
+		log.Printf("Warning: Failed to normalize loudness: %v, using version without normalization", err)
+		normalizedVideoPath = musicVideoPath
+	}
+
+	// Step 6: 加入可開關的字幕軌（要在混音之後，否則會被背景音樂的步驟丟掉）
+	if subtitleMode == subtitlesSoft || subtitleMode == subtitlesBoth {
+		log.Printf("Step 6: Adding soft subtitle track")
+		err := addSoftSubtitles(project, format, normalizedVideoPath, finalVideoPath)
+		if err == nil {
+			log.Printf("✅ Rendered %s: %s", format.ID, finalVideoPath)
+			return loudness, nil
+		}
+		log.Printf("Warning: Failed to add soft subtitles: %v, continuing without them", err)
+	}
+	if err := os.Rename(normalizedVideoPath, finalVideoPath); err != nil {
+		return nil, fmt.Errorf("failed to move final video: %v", err)
+	}
+
+	log.Printf("✅ Rendered %s: %s", format.ID, finalVideoPath)
+	return loudness, nil
+}
+
+// createVideoWithTransitionsAndTTS - 創建帶轉場效果和 TTS 的影片（預設移除原始音訊，見 chapterOriginalVolume）
+func createVideoWithTransitionsAndTTS(project *Project, format *OutputFormat, outputPath string) error {
+	outputDir := filepath.Dir(outputPath)
+
+	log.Printf("🎬 Creating video segments with transitions and TTS audio")
+
+	// 依輸出格式統一目標尺寸，例如 16:9 為 1920x1080、9:16 為 1080x1920
+	targetWidth := format.Width
+	targetHeight := format.Height
+	log.Printf("📐 Target resolution: %dx%d (%s)", targetWidth, targetHeight, format.ID)
+
+	// 依場合調整色調（例如紀念偏柔和、生日偏鮮豔）
+	colorFilter := resolveProjectOccasion(project).ColorFilter
+	framing := normalizeFraming(project.Framing)
+	fill := projectFill(project)
+	strategy := normalizeTimingStrategy(project.TimingStrategy)
+
+	// 處理每個章節
+	clips := []renderedClip{}
+
+	for i, chapter := range project.Story.Chapters {
+		// 找到對應的影片
+		var media *VideoInfo
+		for j := range project.Videos {
+			if project.Videos[j].ID == chapter.VideoID {
+				media = &project.Videos[j]
+				break
+			}
+		}
+
+		if media == nil {
+			log.Printf("⚠️ Warning: video not found for chapter %d", i+1)
+			continue
+		}
+		videoPath := media.Path
+
+		// 畫面長度配合旁白（加上前後轉場與收尾）
+		required := narrationClipDuration(project, i)
+
+		// 照片：做成運鏡片段，長度配合這一段旁白
+		if media.isPhoto() {
+			clipDuration := chapter.EndTime - chapter.StartTime
+			if required > 0 {
+				clipDuration = required
+			}
+
+			segmentPath := filepath.Join(outputDir, fmt.Sprintf("segment_%d.mp4", chapter.Index))
+			motion := chapterPhotoMotion(project, i)
+			zoom := project.PhotoZoom
+			if zoom == 0 {
+				zoom = defaultPhotoZoom
+			}
+			cropFilter := ""
+			if mediaFraming(framing, media) == framingSmart {
+				srcW, srcH := mediaDisplaySize(media)
+				cropFilter = smartCropFilter(media.PetTrack, srcW, srcH, targetWidth, targetHeight, 0, 0)
+			}
+			if err := createPhotoClip(videoPath, segmentPath, targetWidth, targetHeight, clipDuration, motion, zoom, cropFilter, fill, colorFilter); err != nil {
+				log.Printf("❌ Failed to create photo segment %d: %v", chapter.Index, err)
+				continue
+			}
+
+			log.Printf("✅ Chapter %d photo segment created: %s (%s)", chapter.Index, segmentPath, motion)
+			clips = append(clips, renderedClip{ChapterPos: i, Path: segmentPath, AudioPath: chapter.AudioPath, Duration: clipDuration})
+			continue
+		}
+
+		// 原始影片的實際顯示尺寸（已考慮手機的旋轉資訊）
+		log.Printf("📹 Chapter %d: display size=%dx%d (%s, rotation %d°), duration=%.2f-%.2f",
+			chapter.Index, media.DisplayWidth, media.DisplayHeight, media.Orientation, media.Rotation, chapter.StartTime, chapter.EndTime)
+
+		// 剪切影片片段（移除音訊）
+		segmentPath := filepath.Join(outputDir, fmt.Sprintf("segment_%d.mp4", chapter.Index))
+
+		timing := planClipTiming(strategy, media, chapter.StartTime, chapter.EndTime, required)
+		if required > 0 {
+			log.Printf("⏱️ Chapter %d: narration needs %.2fs, %s → source %.2f+%.2fs %s",
+				chapter.Index, required, strategy, timing.Start, timing.Length, timing.Filter)
+		}
+
+		// 組合濾鏡：轉正 + 縮放到輸出比例 + 場合調色（轉場在串接時以 xfade 處理）
+		// smart：比例不同時裁切並跟著毛小孩移動；fit：scale 保持寬高比，空白處依 fill_mode 填充
+		videoFilter := ""
+		if rotate := rotationFilter(media.Rotation); rotate != "" {
+			videoFilter = rotate + ","
+		}
+		cropFilter := ""
+		if mediaFraming(framing, media) == framingSmart {
+			srcW, srcH := mediaDisplaySize(media)
+			cropFilter = smartCropFilter(media.PetTrack, srcW, srcH, targetWidth, targetHeight, timing.Start, timing.Start+timing.Length)
+		}
+		if cropFilter != "" {
+			videoFilter += fmt.Sprintf("%s,scale=%d:%d,setsar=1,", cropFilter, targetWidth, targetHeight)
+		} else {
+			videoFilter += fillFilter(fill, targetWidth, targetHeight) + ",setsar=1,"
+		}
+		if colorFilter != "" {
+			videoFilter += colorFilter + ","
+		}
+		if timing.Filter != "" {
+			videoFilter += timing.Filter + ","
+		}
+		videoFilter += "fps=30,format=yuv420p"
+
+		log.Printf("🎨 Chapter %d filter: %s", chapter.Index, videoFilter)
+
+		// -ss/-t 放在輸入前面，濾鏡裡的 t 從片段開頭的 0 開始算（裁切的時間以此為準）
+		renderPath := segmentPath
+		if timing.LoopTo > 0 {
+			renderPath = filepath.Join(outputDir, fmt.Sprintf("segment_%d_base.mp4", chapter.Index))
+		}
+		// 保留原音時一起剪出音軌（放慢時用 atempo 配合畫面），壓在旁白下面的處理在串接時進行
+		originalVolume := chapterOriginalVolume(project, i)
+		keepOriginal := media.HasAudio && (originalVolume > 0 || len(chapter.FullVolumeMoments) > 0)
+		audioArgs := []string{"-an"} // 移除音訊
+		if keepOriginal {
+			audioArgs = []string{"-c:a", "aac", "-ar", "44100"}
+			if timing.AudioFilter != "" {
+				audioArgs = append(audioArgs, "-af", timing.AudioFilter)
+			}
+		}
+		args := []string{
+			"-ss", fmt.Sprintf("%.2f", timing.Start),
+			"-t", fmt.Sprintf("%.2f", timing.Length),
+			"-noautorotate", // 由上面的 rotationFilter 轉正，避免重複旋轉
+			"-i", videoPath,
+			"-vf", videoFilter,
+		}
+		args = append(args, audioArgs...)
+		args = append(args,
+			"-c:v", "libx264",
+			"-preset", "fast",
+			"-pix_fmt", "yuv420p",
+			"-y",
+			renderPath,
+		)
+		cmd := exec.Command("ffmpeg", args...)
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("❌ Failed to create segment %d: %v, output: %s", chapter.Index, err, string(output))
+			continue
+		}
+
+		if timing.LoopTo > 0 {
+			err := loopClip(renderPath, segmentPath, timing.LoopTo)
+			os.Remove(renderPath)
+			if err != nil {
+				log.Printf("❌ Failed to loop segment %d: %v", chapter.Index, err)
+				continue
+			}
+		}
+
+		// 以實際產生的長度為準，xfade 的時間點才會準確
+		clipDuration := getVideoDuration(segmentPath)
+		if clipDuration <= 0 {
+			clipDuration = math.Max(timing.Length, required)
+		}
+
+		log.Printf("✅ Chapter %d segment created: %s (%.2fs)", chapter.Index, segmentPath, clipDuration)
+		clip := renderedClip{ChapterPos: i, Path: segmentPath, AudioPath: chapter.AudioPath, Duration: clipDuration}
+		if keepOriginal {
+			clip.KeepOriginal = true
+			clip.OriginalVolume = originalVolume
+			clip.FullVolume = timing.clipMoments(chapter.FullVolumeMoments, clipDuration)
+			log.Printf("🔉 Chapter %d keeps original audio at %.2f (%d full-volume moments)", chapter.Index, originalVolume, len(clip.FullVolume))
+		}
+		clips = append(clips, clip)
+	}
+
+	if len(clips) == 0 {
+		return fmt.Errorf("❌ no segments created")
+	}
+
+	log.Printf("📦 Total %d segments created, joining with transitions", len(clips))
+
+	err := joinClipsWithTransitions(project, clips, outputPath)
+
+	// 清理
+	for _, clip := range clips {
+		os.Remove(clip.Path)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("✅ Created video with transitions and TTS audio")
+	return nil
+}
+
+// addEndingImage - 添加結尾卡片並顯示狗狗的回應（版面見 endingTemplates）
+// 使用 concat 協議合併影片，確保結尾圖片正確顯示
+func addEndingImage(project *Project, format *OutputFormat, inputVideo, outputVideo string) error {
+	log.Printf("Adding ending image with dog response (concat approach)")
+
+	outputDir := filepath.Dir(inputVideo)
+	// 有結尾語音時長度由語音決定，否則使用專案設定的秒數
+	endingDuration, layerStarts := endingTimeline(project)
+
+	// 獲取輸入影片時長和原始解析度
+	inputDuration := getVideoDuration(inputVideo)
+	originalWidth, originalHeight := getVideoResolution(inputVideo)
+	if inputDuration == 0 || originalWidth == 0 || originalHeight == 0 {
+		log.Printf("⚠️ Warning: Could not get input video info (duration: %.2f, size: %dx%d), copying input as-is", inputDuration, originalWidth, originalHeight)
+		return exec.Command("cp", inputVideo, outputVideo).Run()
+	}
+	log.Printf("📹 Input video info: duration=%.2fs, original size=%dx%d", inputDuration, originalWidth, originalHeight)
+
+	// 與主影片使用相同的輸出比例
+	width := format.Width
+	height := format.Height
+	log.Printf("🎬 Target video size: %dx%d (%s), ending %.1fs", width, height, format.ID, endingDuration)
+
+	// 依版面在 Go 中畫出結尾卡片（背景與文字層），文字依實際字寬斷行，放不下時自動縮小
+	bgPath, layerPaths, err := renderEndingCard(project, format, outputDir)
+	if err != nil {
+		return fmt.Errorf("failed to render ending card: %v", err)
+	}
+	defer os.Remove(bgPath)
+	for _, layerPath := range layerPaths {
+		defer os.Remove(layerPath)
+	}
+
+	endingVideoPath := filepath.Join(outputDir, "ending_segment.mp4")
+
+	// 使用 FFmpeg 將結尾卡片做成動態片段
+	// 1. 背景緩慢放大（先放大到兩倍尺寸再運鏡，避免抖動）
+	// 2. 文字層依序淡入：有語音時主人的話、毛小孩的回應在開始說話時出現
+	// 3. 主人的話與毛小孩的回應依序播放，沒有語音時使用靜音音軌 (anullsrc)
+	// 注意：確保顏色空間與主影片一致
+	fps := 30
+	frames := int(endingDuration * float64(fps))
+	z, x, y := zoompanExpressions("zoom_in", 1.06, frames)
+	args := []string{"-i", bgPath}
+	filters := []string{fmt.Sprintf("[0:v]scale=%d:%d,zoompan=z='%s':x='%s':y='%s':d=%d:s=%dx%d:fps=%d[bg]",
+		width*2, height*2, z, x, y, frames, width, height, fps)}
+	videoOut := "bg"
+	for i, layerPath := range layerPaths {
+		args = append(args, "-loop", "1", "-framerate", fmt.Sprintf("%d", fps), "-i", layerPath)
+		filters = append(filters,
+			fmt.Sprintf("[%d:v]format=rgba,fade=t=in:st=%.2f:d=%.1f:alpha=1[t%d]", i+1, layerStarts[i], endingTextFade, i),
+			fmt.Sprintf("[%s][t%d]overlay=0:0[vt%d]", videoOut, i, i))
+		videoOut = fmt.Sprintf("vt%d", i)
+	}
+	filters = append(filters, fmt.Sprintf(
+		"[%s]fade=t=in:st=0:d=0.5,fade=t=out:st=%.2f:d=0.5,format=yuv420p,colorspace=bt709:iall=bt601-6-625:fast=1[v]",
+		videoOut, endingDuration-0.5))
+
+	// 每段語音補上前面的空白，並補靜音到下一段開始（最後一段到結尾），再依序接起來
+	speeches := endingSpeeches(project.Story)
+	if len(speeches) == 0 {
+		args = append(args, "-f", "lavfi", "-i", "anullsrc=r=44100:cl=stereo")
+		filters = append(filters, fmt.Sprintf("[%d:a]anull[a]", len(layerPaths)+1))
+	} else {
+		labels := ""
+		boundary := 0.0
+		for i, speech := range speeches {
+			next := endingDuration
+			if i+1 < len(speeches) {
+				next = speeches[i+1].Start
+			}
+			args = append(args, "-i", speech.AudioPath)
+			filters = append(filters, fmt.Sprintf(
+				"[%d:a]aresample=44100,aformat=channel_layouts=stereo,adelay=%d:all=1,apad,atrim=0:%.3f,asetpts=PTS-STARTPTS[e%d]",
+				len(layerPaths)+1+i, int((speech.Start-boundary)*1000), next-boundary, i))
+			labels += fmt.Sprintf("[e%d]", i)
+			boundary = next
+		}
+		filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=0:a=1[a]", labels, len(speeches)))
+		log.Printf("🗣️ Ending voices: %d speech(es), ending %.2fs", len(speeches), endingDuration)
+	}
+
+	args = append(args,
+		"-filter_complex", strings.Join(filters, ";"),
+		"-map", "[v]",
+		"-map", "[a]",
+		"-t", fmt.Sprintf("%.2f", endingDuration),
+		"-c:v", "libx264",
+		"-c:a", "aac",
+		"-pix_fmt", "yuv420p",
+		"-color_range", "tv",
+		"-colorspace", "bt709",
+		"-color_primaries", "bt709",
+		"-color_trc", "bt709",
+		"-y",
+		endingVideoPath,
+	)
+	endingCmd := exec.Command("ffmpeg", args...)
+
+	endingOutput, err := endingCmd.CombinedOutput()
+	if err != nil {
+		log.Printf("Failed to create ending segment: %v, output: %s", err, string(endingOutput))
+		return fmt.Errorf("failed to create ending: %v", err)
+	}
+
+	// 驗證結尾影片
+	if stat, err := os.Stat(endingVideoPath); err != nil || stat.Size() == 0 {
+		return fmt.Errorf("ending segment not created properly")
+	}
+
+	log.Printf("Created ending segment: %s", endingVideoPath)
+
+	// 使用 concat filter 合併影片
+	// [0:v][0:a][1:v][1:a]concat=n=2:v=1:a=1[outv][outa]
+	concatCmd := exec.Command("ffmpeg",
+		"-i", inputVideo,
+		"-i", endingVideoPath,
+		"-filter_complex", "[0:v][0:a][1:v][1:a]concat=n=2:v=1:a=1[outv][outa]",
+		"-map", "[outv]",
+		"-map", "[outa]",
+		"-c:v", "libx264",
+		"-c:a", "aac",
+		"-preset", "fast",
+		"-y",
+		outputVideo,
+	)
+
+	// 結尾一定有主人與毛小孩的語音，合併失敗時回傳錯誤，不輸出沒有聲音的結尾
+	if concatOutput, err := concatCmd.CombinedOutput(); err != nil {
+		log.Printf("Concat failed: %v, output: %s", err, string(concatOutput))
+		os.Remove(endingVideoPath)
+		return fmt.Errorf("failed to concat ending: %v", err)
+	}
+
+	// 驗證輸出
+	finalDuration := getVideoDuration(outputVideo)
+	log.Printf("Created video with ending: duration=%.2fs (expected: %.2fs)", finalDuration, inputDuration+endingDuration)
+
+	// 清理
+	os.Remove(endingVideoPath)
+
+	log.Printf("✅ Added ending image with duration %.2fs", endingDuration)
+	return nil
+}
+
+func compositeVideoOnly(project *Project, outputPath string) error {
+	outputDir := filepath.Dir(outputPath)
+
+	// 建立影片片段列表檔案
+	listFile := filepath.Join(outputDir, "concat_list.txt")
+	f, err := os.Create(listFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, chapter := range project.Story.Chapters {
+		// 找到對應的影片
+		var videoPath string
+		for _, video := range project.Videos {
+			if video.ID == chapter.VideoID {
+				videoPath = video.Path
+				break
+			}
+		}
+
+		if videoPath == "" {
+			continue
+		}
+
+		// 剪出這個片段
+		segmentPath := filepath.Join(outputDir, fmt.Sprintf("segment_%d.mp4", chapter.Index))
+		cmd := exec.Command("ffmpeg",
+			"-i", videoPath,
+			"-ss", fmt.Sprintf("%.2f", chapter.StartTime),
+			"-to", fmt.Sprintf("%.2f", chapter.EndTime),
+			"-c:v", "libx264",
+			"-c:a", "aac",
+			"-y",
+			segmentPath,
+		)
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("Failed to create segment %d: %v, output: %s", chapter.Index, err, string(output))
+			continue
+		}
+
+		fmt.Fprintf(f, "file '%s'\n", filepath.Base(segmentPath))
+	}
+
+	// 拼接所有片段
+	cmd := exec.Command("ffmpeg",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", listFile,
+		"-c", "copy",
+		"-y",
+		outputPath,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg concat error: %v, output: %s", err, string(output))
+	}
+
+	projectsMutex.Lock()
+	project.FinalVideo = outputPath
+	projectsMutex.Unlock()
+
+	log.Printf("Created final video (no audio) for project %s", project.ID)
+	return nil
+}
+
+func compositeVideoWithAudio(project *Project, outputPath string) error {
+	outputDir := filepath.Dir(outputPath)
+
+	log.Printf("Compositing video with TTS audio for project %s", project.ID)
+
+	// 處理每個章節：調整影片時長以匹配音訊時長
+	processedSegments := []string{}
+
+	for i, chapter := range project.Story.Chapters {
+		// 找到對應的影片
+		var videoPath string
+		for _, video := range project.Videos {
+			if video.ID == chapter.VideoID {
+				videoPath = video.Path
+				break
+			}
+		}
+
+		if videoPath == "" {
+			log.Printf("Warning: video not found for chapter %d", i+1)
+			continue
+		}
+
+		segmentPath := filepath.Join(outputDir, fmt.Sprintf("segment_%d.mp4", i+1))
+
+		// 剪輯影片為 15 秒左右
+		targetDuration := 15.0 // 目標 15 秒
+		actualEndTime := chapter.StartTime + targetDuration
+		if actualEndTime > chapter.EndTime {
+			actualEndTime = chapter.EndTime
+		}
+
+		if chapter.AudioPath != "" && chapter.Duration > 0 {
+			// 有音訊：調整影片速度以匹配音訊時長
+			videoDuration := actualEndTime - chapter.StartTime
+
+			// 如果音訊比影片長，減慢影片播放速度
+			// 如果音訊比影片短，加快影片播放速度
+			speedFactor := videoDuration / chapter.Duration
+
+			// 限制速度範圍（0.5x - 2.0x）
+			if speedFactor < 0.5 {
+				speedFactor = 0.5
+			} else if speedFactor > 2.0 {
+				speedFactor = 2.0
+			}
+
+			log.Printf("Chapter %d: video=%.2fs, audio=%.2fs, speed=%.2fx",
+				i+1, videoDuration, chapter.Duration, speedFactor)
+
+			// 剪出影片片段並調整速度（移除原音）+ 淡入淡出
+			log.Printf("Creating segment %d with speed adjustment (%.2fx) and fade: %s to %s", i+1,
+				speedFactor, fmt.Sprintf("%.2f", chapter.StartTime), fmt.Sprintf("%.2f", actualEndTime))
+
+			segmentDuration := actualEndTime - chapter.StartTime
+			fadeDuration := 0.5
+
+			// 組合濾鏡：速度調整 + 淡入淡出
+			filterComplex := fmt.Sprintf("setpts=%.4f*PTS,fade=t=in:st=0:d=%.2f,fade=t=out:st=%.2f:d=%.2f",
+				1.0/speedFactor, fadeDuration, segmentDuration-fadeDuration, fadeDuration)
+
+			cmd := exec.Command("ffmpeg",
+				"-i", videoPath,
+				"-ss", fmt.Sprintf("%.2f", chapter.StartTime),
+				"-t", fmt.Sprintf("%.2f", segmentDuration),
+				"-filter:v", filterComplex,
+				"-an", // 移除原音訊
+				"-c:v", "libx264",
+				"-preset", "fast",
+				"-y",
+				segmentPath+"_video.mp4",
+			)
+
+			if output, err := cmd.CombinedOutput(); err != nil {
+				log.Printf("Failed to process video for chapter %d: %v, output: %s", i+1, err, string(output))
+				continue
+			}
+
+			// 合併音訊與影片
+			cmd = exec.Command("ffmpeg",
+				"-i", segmentPath+"_video.mp4",
+				"-i", chapter.AudioPath,
+				"-c:v", "copy",
+				"-c:a", "aac",
+				"-shortest",
+				"-y",
+				segmentPath,
+			)
+
+			if output, err := cmd.CombinedOutput(); err != nil {
+				log.Printf("Failed to merge audio for chapter %d: %v, output: %s", i+1, err, string(output))
+				continue
+			}
+
+			// 清理臨時檔案
+			os.Remove(segmentPath + "_video.mp4")
+
+		} else {
+			// 沒有音訊，只剪出影片（移除原音）+ 淡入淡出
+			log.Printf("Creating segment %d without audio with fade effects: %s to %s", i+1,
+				fmt.Sprintf("%.2f", chapter.StartTime), fmt.Sprintf("%.2f", actualEndTime))
+
+			segmentDuration := actualEndTime - chapter.StartTime
+			fadeDuration := 0.5 // 淡入淡出 0.5 秒
+
+			// 淡入淡出濾鏡
+			fadeFilter := fmt.Sprintf("fade=t=in:st=0:d=%.2f,fade=t=out:st=%.2f:d=%.2f",
+				fadeDuration, segmentDuration-fadeDuration, fadeDuration)
+
+			cmd := exec.Command("ffmpeg",
+				"-i", videoPath,
+				"-ss", fmt.Sprintf("%.2f", chapter.StartTime),
+				"-t", fmt.Sprintf("%.2f", segmentDuration),
+				"-vf", fadeFilter, // 加入淡入淡出
+				"-an", // 移除原音訊
+				"-c:v", "libx264",
+				"-preset", "fast",
+				"-y",
+				segmentPath,
+			)
+
+			if output, err := cmd.CombinedOutput(); err != nil {
+				log.Printf("Failed to create segment %d: %v, output: %s", i+1, err, string(output))
+				continue
+			}
+
+			log.Printf("Segment %d created with fade effects", i+1)
+		}
+
+		processedSegments = append(processedSegments, segmentPath)
+	}
+
+	if len(processedSegments) == 0 {
+		return fmt.Errorf("no segments were successfully processed")
+	}
+
+	// 建立拼接列表
+	listFile := filepath.Join(outputDir, "concat_list.txt")
+	f, err := os.Create(listFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, segmentPath := range processedSegments {
+		fmt.Fprintf(f, "file '%s'\n", filepath.Base(segmentPath))
+	}
+
+	// 拼接所有片段
+	tempConcatPath := filepath.Join(outputDir, "temp_concat.mp4")
+	cmd := exec.Command("ffmpeg",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", listFile,
+		"-c", "copy",
+		"-y",
+		tempConcatPath,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg concat error: %v, output: %s", err, string(output))
+	}
+
+	// 如果有結尾圖片，加入結尾圖片和文字
+	log.Printf("Checking ending image: path=%s, message=%s", project.EndingImage, project.Story.FinalMessage)
+
+	if project.EndingImage != "" && project.Story != nil && project.Story.FinalMessage != "" {
+		log.Printf("Adding ending image to video...")
+		// 使用一個新的臨時檔案來存儲帶有結尾的影片
+		videoWithEndingPath := filepath.Join(outputDir, "video_with_ending.mp4")
+
+		format := getOutputFormat(projectOutputFormats(project)[0])
+		if err := addEndingImage(project, format, tempConcatPath, videoWithEndingPath); err != nil {
+			log.Printf("❌ Failed to add ending image: %v", err)
+			// 如果失敗，使用沒有結尾的版本
+			os.Rename(tempConcatPath, outputPath)
+		} else {
+			log.Printf("✅ Ending image added successfully")
+			// 成功加入結尾，將結果移動到最終輸出路徑
+			os.Rename(videoWithEndingPath, outputPath)
+			os.Remove(tempConcatPath)
+		}
+	} else {
+		log.Printf("No ending image or message, skipping. EndingImage=%s, FinalMessage=%v",
+			project.EndingImage, project.Story != nil && project.Story.FinalMessage != "")
+		os.Rename(tempConcatPath, outputPath)
+	}
+
+	projectsMutex.Lock()
+	project.FinalVideo = outputPath
+	projectsMutex.Unlock()
+
+	log.Printf("Created final video with TTS audio for project %s", project.ID)
+	return nil
+}
+
+// findChapterPositionLocked 將 URL 中的章節編號（從 1 開始）轉成 Chapters 的索引，回傳的錯誤訊息為空字串代表成功
+// 呼叫者必須已持有 projectsMutex；要修改章節時請在同一個 Lock 中查詢與修改，避免故事在中間被換掉而寫到錯的章節
+func findChapterPositionLocked(project *Project, indexParam string) (int, string) {
+	index, err := strconv.Atoi(indexParam)
+	if err != nil {
+		return 0, "Invalid chapter index"
+	}
+	if project.Story == nil {
+		return 0, "Project has no story yet"
+	}
+	if isProjectProcessing(project) {
+		return 0, "Project is still processing"
+	}
+	if pos := chapterPositionByIndex(project.Story, index); pos >= 0 {
+		return pos, ""
+	}
+	return 0, "Chapter not found"
+}
+
+// chapterPositionByIndex 依章節編號找出在 Chapters 中的位置，找不到時回傳 -1
+func chapterPositionByIndex(story *Story, index int) int {
+	for i, chapter := range story.Chapters {
+		if chapter.Index == index {
+			return i
+		}
+	}
+	return -1
+}
+
+// isProjectProcessing 專案正在分析、產生故事或合成影片
+func isProjectProcessing(project *Project) bool {
+	return project.Status == "analyzing" || project.Status == "generating_story" || project.Status == "generating_video"
+}
+
+func markProjectFailed(projectID, errorMsg string) {
+	log.Printf("Project %s failed: %s", projectID, errorMsg)
+
+	projectsMutex.Lock()
+	if project, exists := projects[projectID]; exists {
+		project.Status = "failed"
+		project.Error = errorMsg
+		project.UpdatedAt = time.Now()
+	}
+	projectsMutex.Unlock()
+}
+
+func getVideoDuration(videoPath string) float64 {
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		videoPath,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0
+	}
+
+	duration := 0.0
+	fmt.Sscanf(string(output), "%f", &duration)
+	return duration
+}
+
+// getVideoResolution 回傳旋轉後實際顯示的寬高
+func getVideoResolution(videoPath string) (int, int) {
+	probe, err := probeMedia(videoPath)
+	if err != nil {
+		log.Printf("Error getting video resolution: %v", err)
+		return 0, 0
+	}
+	return probe.DisplayWidth, probe.DisplayHeight
+}
+
+// wrapTextForFFmpeg 將長文字按最大字數換行，避免在 drawtext 中被左右切掉
+// maxChars 是「每行最多的字數」（以 rune 計算，適合中英文摻雜的情況）
+func wrapTextForFFmpeg(text string, maxChars int) string {
+	if maxChars <= 0 {
+		return text
+	}
+
+	// 先以原本的換行切開，每一段再做一次包裝
+	parts := strings.Split(text, "\n")
+	wrappedParts := make([]string, 0, len(parts))
+
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			wrappedParts = append(wrappedParts, "")
+			continue
+		}
+
+		runes := []rune(p)
+		lineStart := 0
+		for lineStart < len(runes) {
+			end := lineStart + maxChars
+			if end > len(runes) {
+				end = len(runes)
+			}
+			// 標點不要放在行首，併到上一行
+			for end < len(runes) && isClosingPunctuation(runes[end]) {
+				end++
+			}
+			wrappedParts = append(wrappedParts, string(runes[lineStart:end]))
+			lineStart = end
+		}
+	}
+
+	// 使用真正的換行字元，讓 FFmpeg drawtext 正確換行
+	return strings.Join(wrappedParts, "\n")
+}
+
+// generateOwnerMessageTTS 以主人的聲音唸出留言，回傳每一句的開始時間
+func generateOwnerMessageTTS(lang *LanguageProfile, message, outputPath string) ([]float64, error) {
+	log.Printf("Generating TTS for owner message: %s", message)
+
+	sentences := splitSentences(message)
+	requestBody := map[string]interface{}{
+		"input": map[string]string{
+			"ssml": narrationSSML(sentences),
+		},
+		"enableTimePointing": []string{"SSML_MARK"},
+		"voice": map[string]interface{}{
+			"languageCode": lang.TTSLanguageCode,
+			"name":         lang.OwnerVoice.Name, // 主人的聲音（男聲）
+			"ssmlGender":   lang.OwnerVoice.Gender,
+		},
+		"audioConfig": map[string]interface{}{
+			"audioEncoding": "MP3",
+			"speakingRate":  lang.OwnerVoice.SpeakingRate,
+			"pitch":         lang.OwnerVoice.Pitch, // 稍微低沉一點
+		},
+	}
+
+	return executeTTSRequest(requestBody, outputPath, len(sentences))
+}
+
+// generateDogResponseTTS 以毛小孩的聲音唸出回應，回傳每一句的開始時間
+func generateDogResponseTTS(lang *LanguageProfile, message, outputPath string) ([]float64, error) {
+	log.Printf("Generating TTS for dog response: %s", message)
+
+	sentences := splitSentences(message)
+	requestBody := map[string]interface{}{
+		"input": map[string]string{
+			"ssml": narrationSSML(sentences),
+		},
+		"enableTimePointing": []string{"SSML_MARK"},
+		"voice": map[string]interface{}{
+			"languageCode": lang.TTSLanguageCode,
+			"name":         lang.DogVoice.Name, // 狗狗的聲音
+			"ssmlGender":   lang.DogVoice.Gender,
+		},
+		"audioConfig": map[string]interface{}{
+			"audioEncoding": "MP3",
+			"speakingRate":  lang.DogVoice.SpeakingRate,
+			"pitch":         lang.DogVoice.Pitch, // 稍微高一點，更可愛
+		},
+	}
+
+	return executeTTSRequest(requestBody, outputPath, len(sentences))
+}
+
+// generateEndingSpeech 產生結尾的兩段語音：主人的話（主人的聲音）、停頓、毛小孩的回應（毛小孩的聲音）
+// 文字沒有改變且音訊還在時沿用上次的結果；失敗的那一段不唸，結尾只顯示文字
+func generateEndingSpeech(project *Project) {
+	lang := getLanguageProfile(project.Language)
+	outputDir := filepath.Join(storagePath, "projects", project.ID, "audio")
+	os.MkdirAll(outputDir, 0755)
+
+	synthesize := func(previous *EndingSpeech, text, fileName string, tts func(*LanguageProfile, string, string) ([]float64, error)) *EndingSpeech {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			return nil
+		}
+		if previous != nil && previous.Text == text && previous.Duration > 0 {
+			if _, err := os.Stat(previous.AudioPath); err == nil {
+				speech := *previous
+				return &speech
+			}
+		}
+		audioPath := filepath.Join(outputDir, fileName)
+		sentenceTimes, err := tts(lang, text, audioPath)
+		if err != nil {
+			log.Printf("⚠️ Failed to generate ending speech %s: %v", fileName, err)
+			return nil
+		}
+		duration := getAudioDuration(audioPath)
+		if duration == 0 {
+			log.Printf("⚠️ Could not read duration of %s, ending will be silent", audioPath)
+			return nil
+		}
+		return &EndingSpeech{Text: text, AudioPath: audioPath, Duration: duration, SentenceTimes: sentenceTimes}
+	}
+
+	owner := synthesize(project.Story.OwnerSpeech, project.OwnerMessage, "ending_owner.mp3", generateOwnerMessageTTS)
+	pet := synthesize(project.Story.PetSpeech, project.Story.DogResponse, "ending_pet.mp3", generateDogResponseTTS)
+
+	start := endingVoiceLeadIn
+	if owner != nil {
+		owner.Start = start
+		start += owner.Duration + endingVoicePause
+	}
+	if pet != nil {
+		pet.Start = start
+	}
+
+	projectsMutex.Lock()
+	project.Story.OwnerSpeech = owner
+	project.Story.PetSpeech = pet
+	projectsMutex.Unlock()
+}
+
+// executeTTSRequest 呼叫 Google TTS 並把音訊寫到 outputPath
+// 使用 SSML mark 時回傳每一句的開始時間（mark 名稱為 s0、s1…），數量對不上 sentences 時回傳 nil
+func executeTTSRequest(requestBody map[string]interface{}, outputPath string, sentences int) ([]float64, error) {
+	if sentences == 0 {
+		return nil, fmt.Errorf("no text to speak")
+	}
+	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal TTS request: %v", err)
+	}
+
+	// 使用與 Gemini 相同的 API Key（時間點功能只在 v1beta1 提供）
+	url := fmt.Sprintf("https://texttospeech.googleapis.com/v1beta1/text:synthesize?key=%s", aiAPIKey)
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TTS request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send TTS request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("TTS API error %d: %s", resp.StatusCode, string(body))
+	}
+
+	// 解析回應
+	var ttsResponse struct {
+		AudioContent string `json:"audioContent"` // Base64 encoded MP3
+		Timepoints   []struct {
+			MarkName    string  `json:"markName"`
+			TimeSeconds float64 `json:"timeSeconds"`
+		} `json:"timepoints"`
+	}
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TTS response: %v", err)
+	}
+
+	if err := json.Unmarshal(bodyBytes, &ttsResponse); err != nil {
+		return nil, fmt.Errorf("failed to parse TTS response: %v", err)
+	}
+
+	if ttsResponse.AudioContent == "" {
+		return nil, fmt.Errorf("no audio content in TTS response")
+	}
+
+	// 解碼 Base64 音訊
+	audioData, err := base64.StdEncoding.DecodeString(ttsResponse.AudioContent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode audio: %v", err)
+	}
+
+	if err := os.WriteFile(outputPath, audioData, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write audio file: %v", err)
+	}
+
+	// 每一句的開始時間，缺少任何一句時改用字數比例
+	if sentences == 0 || len(ttsResponse.Timepoints) != sentences {
+		return nil, nil
+	}
+	sentenceTimes := make([]float64, sentences)
+	for _, tp := range ttsResponse.Timepoints {
+		var index int
+		if _, err := fmt.Sscanf(tp.MarkName, "s%d", &index); err != nil || index < 0 || index >= sentences {
+			return nil, nil
+		}
+		sentenceTimes[index] = tp.TimeSeconds
+	}
+	return sentenceTimes, nil
+}
+
+// 壓縮圖片到指定大小
+func compressImage(inputPath string, maxWidth, maxHeight int) ([]byte, error) {
+	// 使用 FFmpeg 壓縮圖片
+	cmd := exec.Command("ffmpeg",
+		"-i", inputPath,
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':min'(%d,ih)':force_original_aspect_ratio=decrease", maxWidth, maxHeight),
+		"-q:v", "5", // 品質 5（1-31，數字越小品質越高）
+		"-f", "image2",
+		"-",
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg compress error: %v", err)
+	}
+
+	return output, nil
+}
+
+// ============================================================================
+// Subtitles and Background Music
+// ============================================================================
+
+func addSubtitles(project *Project, format *OutputFormat, inputVideo, outputVideo string) error {
+	log.Printf("Burning subtitles into video for project %s", project.ID)
+
+	// 以 ASS 格式寫在工作目錄，樣式（字體、字級、邊距）都在檔案裡，與下載的字幕相同
+	outputDir := filepath.Dir(inputVideo)
+	assPath := filepath.Join(outputDir, "subtitles.ass")
+
+	lang := getLanguageProfile(project.Language)
+	typo := projectTypography(project)
+	cues := burnedSubtitleCues(project, format)
+	if len(cues) == 0 {
+		return fmt.Errorf("no subtitle cues")
+	}
+	if err := os.WriteFile(assPath, []byte(renderSubtitleFile("ass", cues, typo, format)), 0644); err != nil {
+		return fmt.Errorf("failed to write subtitle file: %v", err)
+	}
+	defer os.Remove(assPath)
+
+	log.Printf("📝 %d subtitle cues, font %s → %s", len(cues), typo.FontFamily, resolveFontFile(typo.FontFamily, lang))
+
+	cmd := exec.Command("ffmpeg",
+		"-i", inputVideo,
+		"-vf", fmt.Sprintf("subtitles=filename='%s'%s", escapeFilterPath(assPath), subtitleFontsDir()),
+		"-c:a", "copy",
+		"-y",
+		outputVideo,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg subtitle error: %v, output: %s", err, string(output))
+	}
+
+	log.Printf("✅ Burned subtitles for project %s", project.ID)
+	return nil
+}
+
+// addSoftSubtitles 將字幕以 mov_text 字幕軌放進 MP4，播放時可以開關
+func addSoftSubtitles(project *Project, format *OutputFormat, inputVideo, outputVideo string) error {
+	lang := getLanguageProfile(project.Language)
+	cues := projectSubtitleCues(project, format)
+	if len(cues) == 0 {
+		return fmt.Errorf("no subtitle cues")
+	}
+
+	srtPath := filepath.Join(filepath.Dir(outputVideo), "subtitles_track.srt")
+	if err := os.WriteFile(srtPath, []byte(renderSubtitleFile("srt", cues, projectTypography(project), format)), 0644); err != nil {
+		return fmt.Errorf("failed to write subtitle file: %v", err)
+	}
+	defer os.Remove(srtPath)
+
+	cmd := exec.Command("ffmpeg",
+		"-i", inputVideo,
+		"-i", srtPath,
+		"-map", "0:v",
+		"-map", "0:a?",
+		"-map", "1:s",
+		"-c:v", "copy",
+		"-c:a", "copy",
+		"-c:s", "mov_text",
+		"-metadata:s:s:0", "language="+lang.SubtitleLanguage,
+		"-metadata:s:s:0", "title="+lang.Name,
+		"-y",
+		outputVideo,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg soft subtitle error: %v, output: %s", err, string(output))
+	}
+
+	log.Printf("✅ Added soft subtitle track (%s) for project %s", lang.SubtitleLanguage, project.ID)
+	return nil
+}
+
+func formatSRTTime(seconds float64) string {
+	hours := int(seconds / 3600)
+	minutes := int((seconds - float64(hours*3600)) / 60)
+	secs := int(seconds) % 60
+	millis := int((seconds - float64(int(seconds))) * 1000)
+
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", hours, minutes, secs, millis)
+}
+
+// formatVTTTime WebVTT 的時間格式 00:00:01.000
+func formatVTTTime(seconds float64) string {
+	return strings.Replace(formatSRTTime(seconds), ",", ".", 1)
+}
+
+// formatASSTime ASS 的時間格式 0:00:01.00
+func formatASSTime(seconds float64) string {
+	centis := int(math.Round(seconds * 100))
+	return fmt.Sprintf("%d:%02d:%02d.%02d", centis/360000, centis/6000%60, centis/100%60, centis%100)
+}
+
+// subtitleFileTypes 可以下載的字幕格式與 Content-Type
+var subtitleFileTypes = map[string]string{
+	"srt": "application/x-subrip; charset=utf-8",
+	"vtt": "text/vtt; charset=utf-8",
+	"ass": "text/x-ssa; charset=utf-8",
+}
+
+// renderSubtitleFile 將字幕輸出成 srt、vtt 或 ass
+func renderSubtitleFile(kind string, cues []SubtitleCue, typo Typography, format *OutputFormat) string {
+	var b strings.Builder
+	switch kind {
+	case "vtt":
+		b.WriteString("WEBVTT\n\n")
+		for i, cue := range cues {
+			fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", i+1, formatVTTTime(cue.Start), formatVTTTime(cue.End), cue.Text)
+		}
+	case "ass":
+		// 以輸出尺寸作為 PlayRes，字級與邊距從 288 高的基準換算成像素，燒錄時與下載的版本一致
+		fmt.Fprintf(&b, "[Script Info]\nScriptType: v4.00+\nPlayResX: %d\nPlayResY: %d\nWrapStyle: 2\nScaledBorderAndShadow: yes\n\n",
+			format.Width, format.Height)
+		b.WriteString("[V4+ Styles]\n")
+		b.WriteString("Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding\n")
+		b.WriteString(typo.assStyle(format, format.SubtitleFontSize, format.SubtitleMarginV) + "\n\n")
+		b.WriteString("[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n")
+		for _, cue := range cues {
+			text := strings.NewReplacer("\n", `\N`, "{", "(", "}", ")").Replace(cue.Text)
+			fmt.Fprintf(&b, "Dialogue: 0,%s,%s,Default,,0,0,0,,%s\n", formatASSTime(cue.Start), formatASSTime(cue.End), text)
+		}
+	default:
+		for i, cue := range cues {
+			fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", i+1, formatSRTTime(cue.Start), formatSRTTime(cue.End), cue.Text)
+		}
+	}
+	return b.String()
+}
+
+// escapeFilterPath 跳脫放在 ffmpeg 濾鏡參數裡的檔案路徑
+func escapeFilterPath(p string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`, `'`, `\'`).Replace(filepath.ToSlash(p))
+}
+
+// AudioMixSettings 使用者設定的背景音樂音量、閃避（旁白時自動壓低音樂）與淡入淡出
+// 欄位為指標，沒有傳的欄位使用預設值，傳 0 就是 0（例如 music_volume 0 靜音、fade_in 0 不淡入）
+type AudioMixSettings struct {
+	MusicVolume *float64 `json:"music_volume,omitempty"` // 沒有旁白時的音樂音量 0～1，預設 0.6
+	DuckDepth   *float64 `json:"duck_depth,omitempty"`   // 旁白時音樂再壓低的 dB 數 0～18，預設 12
+	Attack      *float64 `json:"attack,omitempty"`       // 旁白開始後壓低音樂的速度（毫秒），預設 20
+	Release     *float64 `json:"release,omitempty"`      // 旁白結束後音樂恢復的速度（毫秒），預設 400
+	FadeIn      *float64 `json:"fade_in,omitempty"`      // 開頭淡入秒數，預設 1.5
+	FadeOut     *float64 `json:"fade_out,omitempty"`     // 結尾淡出秒數，預設 3
+	Loudness    *float64 `json:"loudness,omitempty"`     // 成品的整合響度 LUFS -30～-5，預設 -14（社群平台常用）
+	TruePeak    *float64 `json:"true_peak,omitempty"`    // 真實峰值上限 dBTP -9～0，預設 -1（0 為不超過 0 dBTP）
+
+	OriginalVolume *float64 `json:"original_volume,omitempty"` // 保留影片原音的音量 0～1，旁白時會再壓低，預設 0（不保留）
+}
+
+// AudioMix 實際使用的混音設定（AudioMixSettings 補上預設值）
+type AudioMix struct {
+	MusicVolume    float64 `json:"music_volume"`
+	DuckDepth      float64 `json:"duck_depth"`
+	Attack         float64 `json:"attack"`
+	Release        float64 `json:"release"`
+	FadeIn         float64 `json:"fade_in"`
+	FadeOut        float64 `json:"fade_out"`
+	Loudness       float64 `json:"loudness"`
+	TruePeak       float64 `json:"true_peak"`
+	OriginalVolume float64 `json:"original_volume"`
+}
+
+const (
+	defaultMusicVolume  = 0.6
+	defaultDuckDepth    = 12.0
+	defaultDuckAttack   = 20.0
+	defaultDuckRelease  = 400.0
+	defaultMusicFadeIn  = 1.5
+	defaultMusicFadeOut = 3.0
+	defaultLoudness     = -14.0
+	defaultTruePeak     = -1.0
+
+	duckThreshold    = 0.01  // -40 dB，旁白一出聲就開始壓低音樂
+	narrationLevelDB = -18.0 // 旁白的大約音量，用來把壓低的 dB 數換算成壓縮比
+	minDuckTime      = 0.01  // sidechaincompress 的 attack/release 最小值（毫秒）
+)
+
+// floatInRange 沒有設定或在 lo～hi 之間
+func floatInRange(v *float64, lo, hi float64) bool {
+	return v == nil || (*v >= lo && *v <= hi)
+}
+
+// floatOrDefault 沒有設定時使用預設值
+func floatOrDefault(v *float64, def float64) float64 {
+	if v == nil {
+		return def
+	}
+	return *v
+}
+
+// normalizeAudioMix 驗證使用者傳入的混音設定，nil 代表沿用預設
+func normalizeAudioMix(m *AudioMixSettings) (*AudioMixSettings, error) {
+	if m == nil {
+		return nil, nil
+	}
+	if !floatInRange(m.MusicVolume, 0, 1) {
+		return nil, fmt.Errorf("music_volume must be between 0 and 1")
+	}
+	if !floatInRange(m.OriginalVolume, 0, 1) {
+		return nil, fmt.Errorf("original_volume must be between 0 and 1")
+	}
+	if !floatInRange(m.DuckDepth, 0, 18) {
+		return nil, fmt.Errorf("duck_depth must be between 0 and 18 dB")
+	}
+	if !floatInRange(m.Attack, 0, 2000) {
+		return nil, fmt.Errorf("attack must be between 0 and 2000 ms")
+	}
+	if !floatInRange(m.Release, 0, 9000) {
+		return nil, fmt.Errorf("release must be between 0 and 9000 ms")
+	}
+	if !floatInRange(m.FadeIn, 0, 10) || !floatInRange(m.FadeOut, 0, 15) {
+		return nil, fmt.Errorf("fade_in must be between 0 and 10 seconds and fade_out between 0 and 15 seconds")
+	}
+	if !floatInRange(m.Loudness, -30, -5) {
+		return nil, fmt.Errorf("loudness must be between -30 and -5 LUFS")
+	}
+	if !floatInRange(m.TruePeak, -9, 0) {
+		return nil, fmt.Errorf("true_peak must be between -9 and 0 dBTP")
+	}
+	result := *m
+	return &result, nil
+}
+
+// projectAudioMix 專案實際使用的混音設定（已補上預設值）
+func projectAudioMix(project *Project) AudioMix {
+	settings := AudioMixSettings{}
+	if project.AudioMix != nil {
+		settings = *project.AudioMix
+	}
+	mix := AudioMix{
+		MusicVolume:    floatOrDefault(settings.MusicVolume, defaultMusicVolume),
+		DuckDepth:      floatOrDefault(settings.DuckDepth, defaultDuckDepth),
+		Attack:         floatOrDefault(settings.Attack, defaultDuckAttack),
+		Release:        floatOrDefault(settings.Release, defaultDuckRelease),
+		FadeIn:         floatOrDefault(settings.FadeIn, defaultMusicFadeIn),
+		FadeOut:        floatOrDefault(settings.FadeOut, defaultMusicFadeOut),
+		Loudness:       floatOrDefault(settings.Loudness, defaultLoudness),
+		TruePeak:       floatOrDefault(settings.TruePeak, defaultTruePeak),
+		OriginalVolume: floatOrDefault(settings.OriginalVolume, 0),
+	}
+	return mix
+}
+
+// duckRatio 把想壓低的 dB 數換算成 sidechaincompress 的壓縮比
+// 旁白大約比門檻高 22 dB，壓縮後超過門檻的部分只剩 1/ratio
+func duckRatio(depth float64) float64 {
+	over := narrationLevelDB - 20*math.Log10(duckThreshold)
+	return math.Min(over/(over-depth), 20)
+}
+
+// musicFilter 音樂的音量與開頭淡入
+func (m AudioMix) musicFilter() string {
+	filter := fmt.Sprintf("volume=%.3f", m.MusicVolume)
+	// afade 的 d=0 會被當成預設長度，所以 fade_in 為 0 時不加淡入
+	if m.FadeIn > 0 {
+		filter += fmt.Sprintf(",afade=t=in:st=0:d=%.2f", m.FadeIn)
+	}
+	return filter
+}
+
+// fadeOutFilter 在影片最後淡出
+func (m AudioMix) fadeOutFilter(duration float64) string {
+	if m.FadeOut <= 0 {
+		return "anull"
+	}
+	return fmt.Sprintf("afade=t=out:st=%.2f:d=%.2f", math.Max(0, duration-m.FadeOut), m.FadeOut)
+}
+
+// sidechainFilter 第一個輸入在第二個輸入（旁白）出聲時被壓低
+func (m AudioMix) sidechainFilter() string {
+	return fmt.Sprintf("sidechaincompress=threshold=%.4f:ratio=%.2f:attack=%.2f:release=%.2f",
+		duckThreshold, duckRatio(m.DuckDepth), math.Max(m.Attack, minDuckTime), math.Max(m.Release, minDuckTime))
+}
+
+// duckingFilter 以影片原本的音訊（旁白）當觸發訊號壓低音樂，再與旁白混合後淡出
+func (m AudioMix) duckingFilter(duration float64) string {
+	return fmt.Sprintf("[0:a]aformat=sample_rates=44100:channel_layouts=stereo,asplit=2[voice][key];"+
+		"[1:a]aformat=sample_rates=44100:channel_layouts=stereo,%s[music];"+
+		"[music][key]%s[ducked];"+
+		"[voice][ducked]amix=inputs=2:duration=first:normalize=0,%s[aout]",
+		m.musicFilter(), m.sidechainFilter(), m.fadeOutFilter(duration))
+}
+
+func addBackgroundMusic(project *Project, inputVideo, outputVideo string) error {
+	log.Printf("Adding background music to video for project %s", project.ID)
+
+	// 背景音樂：上傳的歌曲、指定的曲目，或依場合與故事模式自動挑選
+	outputDir := filepath.Dir(inputVideo)
+	track := resolveProjectMusic(project)
+	ext := ".mp3"
+	if track != nil {
+		ext = strings.ToLower(filepath.Ext(track.Path))
+	}
+	musicPath := filepath.Join(outputDir, "background_music"+ext)
+
+	// 先刪除舊的音樂文件（如果存在）
+	oldFiles, _ := filepath.Glob(filepath.Join(outputDir, "background_music.*"))
+	for _, oldFile := range oldFiles {
+		log.Printf("🗑️ Removing old background music file: %s", oldFile)
+		os.Remove(oldFile)
+	}
+
+	musicCopied := false
+	if track != nil {
+		log.Printf("🎵 Using music track %s: %s", track.ID, track.Title)
+
+		// 複製到輸出目錄以避免檔名問題
+		inputMusic, err := os.ReadFile(track.Path)
+		if err != nil {
+			log.Printf("❌ Failed to read music track, falling back to generation: %v", err)
+		} else if err := os.WriteFile(musicPath, inputMusic, 0644); err != nil {
+			log.Printf("❌ Failed to copy music track, falling back to generation: %v", err)
+		} else {
+			log.Printf("✅ Copied music track to: %s (size: %d bytes)", musicPath, len(inputMusic))
+			musicCopied = true
+		}
 	}
 
-	jobsMutex.Lock()
-	job.Segments = segments
-	jobsMutex.Unlock()
+	// 如果沒有合適的曲目，則用場合的和弦生成
+	if !musicCopied {
+		musicPath = filepath.Join(outputDir, "background_music.mp3")
 
-	log.Printf("Created %d segments for job %s", len(segments), job.ID)
+		// 取得影片時長
+		videoDuration := getVideoDuration(inputVideo)
+		if videoDuration == 0 {
+			return fmt.Errorf("failed to get video duration")
+		}
+
+		log.Printf("Generating background music with duration %.2fs", videoDuration)
+		// 生成柔和的背景音樂
+		if err := generateBackgroundMusic(musicPath, videoDuration, resolveProjectOccasion(project).Music.Chord); err != nil {
+			return fmt.Errorf("failed to generate music: %v", err)
+		}
+	}
+
+	// 將背景音樂與影片合併：旁白出現時自動壓低音樂，開頭淡入、結尾淡出
+	mix := projectAudioMix(project)
+	videoDuration := getVideoDuration(inputVideo)
+	filterComplex := mix.duckingFilter(videoDuration)
+	log.Printf("Audio filter: %s (video duration: %.2fs)", filterComplex, videoDuration)
+
+	// 歌曲比影片短時重複播放
+	cmd := exec.Command("ffmpeg",
+		"-i", inputVideo,
+		"-stream_loop", "-1",
+		"-i", musicPath,
+		"-filter_complex", filterComplex,
+		"-map", "0:v",
+		"-map", "[aout]",
+		"-c:v", "copy",
+		"-c:a", "aac",
+		"-y",
+		outputVideo,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		// 如果混合失敗（可能沒有原始音訊），嘗試直接加入音樂並淡出
+		log.Printf("Audio mix failed, trying direct add with fade: %v", err)
+		fadeFilter := mix.musicFilter() + "," + mix.fadeOutFilter(videoDuration)
+		cmd = exec.Command("ffmpeg",
+			"-i", inputVideo,
+			"-stream_loop", "-1",
+			"-i", musicPath,
+			"-filter_complex", fmt.Sprintf("[1:a]%s[aout]", fadeFilter),
+			"-map", "0:v",
+			"-map", "[aout]",
+			"-c:v", "copy",
+			"-c:a", "aac",
+			"-shortest",
+			"-y",
+			outputVideo,
+		)
+
+		output, err = cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ffmpeg music add error: %v, output: %s", err, string(output))
+		}
+	}
+
+	log.Printf("Added background music for project %s", project.ID)
 	return nil
 }
 
-func analyzeSegments(job *Job) error {
-	if aiAPIKey == "" || aiAPIKey == "your_api_key_here" || aiAPIKey == "your_gemini_api_key_here" {
-		return fmt.Errorf("AI API key not configured. Please set AI_API_KEY in .env file")
+// generateBackgroundMusic 用和弦生成背景音樂，chord 為空時使用 C 大調和弦 (C-E-G)
+func generateBackgroundMusic(outputPath string, duration float64, chord []float64) error {
+	if len(chord) == 0 {
+		chord = []float64{261.63, 329.63, 392.00}
+	}
+
+	// 根音最大聲，越高的音越小聲，聽起來比較柔和
+	args := []string{}
+	filters := []string{}
+	labels := ""
+	for i, frequency := range chord {
+		args = append(args, "-f", "lavfi", "-i", fmt.Sprintf("sine=frequency=%.2f:duration=%.2f", frequency, duration))
+		volume := 0.3 - 0.075*float64(i)
+		if volume < 0.05 {
+			volume = 0.05
+		}
+		filters = append(filters, fmt.Sprintf("[%d:a]volume=%.3f[a%d]", i, volume, i))
+		labels += fmt.Sprintf("[a%d]", i)
 	}
+	filterComplex := strings.Join(filters, ";") + fmt.Sprintf(";%samix=inputs=%d:duration=first[aout]", labels, len(chord))
 
-	log.Printf("Using Gemini AI analysis for job %s", job.ID)
+	args = append(args,
+		"-filter_complex", filterComplex,
+		"-map", "[aout]",
+		"-c:a", "libmp3lame",
+		"-b:a", "128k",
+		"-y",
+		outputPath,
+	)
+	cmd := exec.Command("ffmpeg", args...)
 
-	successCount := 0
-	// 使用真實 AI 分析每個 segment
-	for i := range job.Segments {
-		analysis, err := analyzeSegmentWithAI(&job.Segments[i])
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to generate music: %v, output: %s", err, string(output))
+	}
+
+	return nil
+}
+
+// LoudnessStats 成品的響度量測（EBU R128），input 為正規化前、output 為正規化後
+type LoudnessStats struct {
+	Target            float64 `json:"target"`          // 目標整合響度 LUFS
+	TruePeakLimit     float64 `json:"true_peak_limit"` // 真實峰值上限 dBTP
+	InputI            float64 `json:"input_i"`         // 整合響度 LUFS
+	InputTP           float64 `json:"input_tp"`        // 真實峰值 dBTP
+	InputLRA          float64 `json:"input_lra"`       // 響度範圍 LU
+	InputThresh       float64 `json:"input_thresh"`    // 量測門檻 LUFS
+	OutputI           float64 `json:"output_i"`
+	OutputTP          float64 `json:"output_tp"`
+	OutputLRA         float64 `json:"output_lra"`
+	NormalizationType string  `json:"normalization_type"` // linear（整體調整音量）或 dynamic（動態壓縮）
+}
+
+// loudnormReport loudnorm 濾鏡 print_format=json 的輸出，數值都是字串
+type loudnormReport struct {
+	InputI            string `json:"input_i"`
+	InputTP           string `json:"input_tp"`
+	InputLRA          string `json:"input_lra"`
+	InputThresh       string `json:"input_thresh"`
+	OutputI           string `json:"output_i"`
+	OutputTP          string `json:"output_tp"`
+	OutputLRA         string `json:"output_lra"`
+	NormalizationType string `json:"normalization_type"`
+	TargetOffset      string `json:"target_offset"`
+}
+
+const loudnessRange = 11.0 // loudnorm 的目標響度範圍 LU
+
+// runLoudnorm 執行 ffmpeg 並解析 loudnorm 印在最後的 JSON 報告
+func runLoudnorm(args ...string) (*loudnormReport, error) {
+	output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg loudnorm error: %v, output: %s", err, string(output))
+	}
+	text := string(output)
+	start, end := strings.LastIndex(text, "{"), strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("loudnorm report not found in ffmpeg output")
+	}
+	var report loudnormReport
+	if err := json.Unmarshal([]byte(text[start:end+1]), &report); err != nil {
+		return nil, fmt.Errorf("failed to parse loudnorm report: %v", err)
+	}
+	return &report, nil
+}
+
+// parseLoudnessValue 把 loudnorm 報告中的數值轉成 float，無聲時會是 -inf
+func parseLoudnessValue(value string) (float64, error) {
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsInf(number, 0) || math.IsNaN(number) {
+		return 0, fmt.Errorf("value %q is not finite", value)
+	}
+	return number, nil
+}
+
+// normalizeLoudness 兩階段 loudnorm：先量測整支影片的響度，再用量測值線性調整到目標響度並限制真實峰值
+func normalizeLoudness(project *Project, inputVideo, outputVideo string) (*LoudnessStats, error) {
+	mix := projectAudioMix(project)
+	target := fmt.Sprintf("I=%.1f:TP=%.1f:LRA=%.1f", mix.Loudness, mix.TruePeak, loudnessRange)
+
+	// 第一階段：只量測，不輸出檔案
+	measured, err := runLoudnorm("-hide_banner", "-nostats",
+		"-i", inputVideo,
+		"-map", "0:a:0",
+		"-af", "loudnorm="+target+":print_format=json",
+		"-f", "null", "-",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &LoudnessStats{Target: mix.Loudness, TruePeakLimit: mix.TruePeak}
+	for _, field := range []struct {
+		value string
+		dest  *float64
+	}{
+		{measured.InputI, &stats.InputI},
+		{measured.InputTP, &stats.InputTP},
+		{measured.InputLRA, &stats.InputLRA},
+		{measured.InputThresh, &stats.InputThresh},
+	} {
+		if *field.dest, err = parseLoudnessValue(field.value); err != nil {
+			return nil, fmt.Errorf("invalid loudness measurement (silent audio?): %v", err)
+		}
+	}
+	log.Printf("🔊 Measured loudness: %.1f LUFS, true peak %.1f dBTP, LRA %.1f LU (target %.1f LUFS)",
+		stats.InputI, stats.InputTP, stats.InputLRA, mix.Loudness)
+
+	// 第二階段：帶入量測值，loudnorm 會輸出 192kHz，最後轉回 48kHz
+	filter := fmt.Sprintf("loudnorm=%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true:print_format=json,aresample=48000",
+		target, measured.InputI, measured.InputTP, measured.InputLRA, measured.InputThresh, measured.TargetOffset)
+	normalized, err := runLoudnorm("-hide_banner", "-nostats",
+		"-i", inputVideo,
+		"-map", "0:v",
+		"-map", "0:a:0",
+		"-af", filter,
+		"-c:v", "copy",
+		"-c:a", "aac",
+		"-b:a", "192k",
+		"-y",
+		outputVideo,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.NormalizationType = normalized.NormalizationType
+	for _, field := range []struct {
+		value string
+		dest  *float64
+	}{
+		{normalized.OutputI, &stats.OutputI},
+		{normalized.OutputTP, &stats.OutputTP},
+		{normalized.OutputLRA, &stats.OutputLRA},
+	} {
+		if value, err := parseLoudnessValue(field.value); err == nil {
+			*field.dest = value
+		}
+	}
+	log.Printf("✅ Normalized loudness: %.1f LUFS, true peak %.1f dBTP (%s)", stats.OutputI, stats.OutputTP, stats.NormalizationType)
+	return stats, nil
+}
+
+// ============================================================================
+// Music Library
+// ============================================================================
+
+// 背景音樂庫放在 MUSIC_PATH（預設 ./music），每首歌一個 JSON 描述檔，音樂檔放在同一個目錄
+
+const customMusicTrackID = "custom"
+
+// musicFileTypes 音樂庫與上傳可以使用的音樂檔格式
+var musicFileTypes = map[string]bool{".mp3": true, ".m4a": true, ".aac": true, ".wav": true, ".ogg": true, ".flac": true}
+
+// MusicTrack 音樂庫中的一首歌，對應 music/*.json
+type MusicTrack struct {
+	ID        string   `json:"id"`
+	Title     string   `json:"title"`
+	Artist    string   `json:"artist,omitempty"`
+	File      string   `json:"file,omitempty"` // 相對於音樂庫目錄的檔名
+	Mood      string   `json:"mood,omitempty"` // gentle, cheerful, warm, playful
+	BPM       int      `json:"bpm,omitempty"`
+	License   string   `json:"license,omitempty"`
+	Occasions []string `json:"occasions,omitempty"` // 特別適合的場合
+	Modes     []string `json:"modes,omitempty"`     // 特別適合的故事模式
+	URL       string   `json:"url,omitempty"`       // 試聽網址
+	Path      string   `json:"-"`
+}
+
+var (
+	musicTracks      = make(map[string]*MusicTrack)
+	musicTracksMutex sync.RWMutex
+)
+
+// legacyMusicFiles 音樂庫之前的版本寫在場合設定裡的音樂檔，對應到音樂庫中的檔名
+var legacyMusicFiles = map[string]string{
+	"./狗狗影片/bibi-pianopachelbels-canon-终于弹了这首-世界上最治愈的钢琴曲卡农.mp3": "canon.mp3",
+}
+
+// migrateLegacyMusic 音樂庫中還沒有、舊位置有的音樂檔複製到音樂庫，讓 canon.json 等描述檔找得到
+func migrateLegacyMusic() {
+	for legacyPath, name := range legacyMusicFiles {
+		target := filepath.Join(musicLibraryPath, name)
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		if _, err := os.Stat(legacyPath); err != nil {
+			continue
+		}
+		if err := copyFile(legacyPath, target); err != nil {
+			log.Printf("⚠️ Failed to move %s into the music library: %v", legacyPath, err)
+			continue
+		}
+		log.Printf("🎵 Copied %s into the music library as %s", legacyPath, name)
+	}
+}
+
+// copyFile 複製檔案，失敗時不留下寫到一半的檔案
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// loadMusicLibrary 重新讀取音樂庫，描述檔有誤或音樂檔不存在的曲目會被略過
+func loadMusicLibrary() {
+	tracks := make(map[string]*MusicTrack)
+	entries, err := os.ReadDir(musicLibraryPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠️ Failed to read music library %s: %v", musicLibraryPath, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.ToLower(filepath.Ext(entry.Name())) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(musicLibraryPath, entry.Name()))
 		if err != nil {
-			// 記錄錯誤但繼續處理其他 segments
-			log.Printf("Warning: AI analysis failed for segment %d: %v (skipping)", i, err)
-			// 設定一個預設的分析結果
-			job.Segments[i].Analysis = &Analysis{
-				HasDog:          false,
-				HasHuman:        false,
-				InteractionType: "none",
-				Emotion:         "neutral",
-				ShortCaption:    "分析失敗",
-			}
+			log.Printf("⚠️ Skipping music track %s: %v", entry.Name(), err)
 			continue
 		}
-		job.Segments[i].Analysis = analysis
-		successCount++
+		var track MusicTrack
+		if err := json.Unmarshal(data, &track); err != nil {
+			log.Printf("⚠️ Skipping music track %s: %v", entry.Name(), err)
+			continue
+		}
+		if track.ID == "" {
+			track.ID = strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		}
+		if track.Title == "" {
+			track.Title = track.ID
+		}
+		if track.ID == customMusicTrackID || !musicFileTypes[strings.ToLower(filepath.Ext(track.File))] {
+			log.Printf("⚠️ Skipping music track %s: invalid id or unsupported file %q", entry.Name(), track.File)
+			continue
+		}
+		track.Path = filepath.Join(musicLibraryPath, filepath.Clean("/"+track.File))
+		if _, err := os.Stat(track.Path); err != nil {
+			log.Printf("⚠️ Skipping music track %s: %v", track.ID, err)
+			continue
+		}
+		track.URL = "/music/" + filepath.ToSlash(filepath.Clean(track.File))
+		tracks[track.ID] = &track
+	}
 
-		// 避免 API 限流，稍微延遲
-		time.Sleep(500 * time.Millisecond)
+	musicTracksMutex.Lock()
+	musicTracks = tracks
+	musicTracksMutex.Unlock()
+
+	log.Printf("🎵 Loaded %d music tracks from %s", len(tracks), musicLibraryPath)
+}
+
+// lookupMusicTrack 取得音樂庫中的曲目
+func lookupMusicTrack(id string) *MusicTrack {
+	musicTracksMutex.RLock()
+	defer musicTracksMutex.RUnlock()
+	return musicTracks[id]
+}
+
+// listMusicTracks 依 ID 排序列出音樂庫中的所有曲目
+func listMusicTracks() []*MusicTrack {
+	musicTracksMutex.RLock()
+	defer musicTracksMutex.RUnlock()
+
+	list := make([]*MusicTrack, 0, len(musicTracks))
+	for _, track := range musicTracks {
+		list = append(list, track)
 	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
 
-	log.Printf("AI analyzed %d/%d segments successfully for job %s", successCount, len(job.Segments), job.ID)
+// selectMusicTrack 依場合與故事模式替曲目打分數，挑出最適合的一首，都不相符時回傳 nil
+// 指定了場合的曲目最優先，其次是氣氛與場合相同、指定了故事模式、氣氛與故事模式相同
+func selectMusicTrack(occasion *OccasionDefinition, mode *StoryModeDefinition) *MusicTrack {
+	var best *MusicTrack
+	bestScore := 0
+	for _, track := range listMusicTracks() {
+		score := 0
+		if occasion != nil {
+			for _, id := range track.Occasions {
+				if id == occasion.ID {
+					score += 4
+				}
+			}
+			if track.Mood != "" && track.Mood == occasion.Music.Mood {
+				score += 2
+			}
+		}
+		if mode != nil {
+			for _, id := range track.Modes {
+				if id == mode.ID {
+					score += 2
+				}
+			}
+			if track.Mood != "" && track.Mood == mode.MusicMood {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = track, score
+		}
+	}
+	return best
+}
 
-	// 只要有至少一半的 segments 分析成功就繼續
-	if successCount < len(job.Segments)/2 {
-		return fmt.Errorf("too many segments failed analysis (%d/%d succeeded)", successCount, len(job.Segments))
+// resolveProjectMusic 取得專案的背景音樂：上傳的歌曲、指定的曲目，或依場合與故事模式自動挑選
+func resolveProjectMusic(project *Project) *MusicTrack {
+	switch project.MusicTrackID {
+	case "":
+	case customMusicTrackID:
+		if project.CustomMusic != "" {
+			return &MusicTrack{
+				ID:    customMusicTrackID,
+				Title: project.CustomMusicTitle,
+				URL:   fmt.Sprintf("/storage/projects/%s/%s", project.ID, filepath.Base(project.CustomMusic)),
+				Path:  project.CustomMusic,
+			}
+		}
+	default:
+		if track := lookupMusicTrack(project.MusicTrackID); track != nil {
+			return track
+		}
+		log.Printf("⚠️ Music track %s not found, selecting automatically", project.MusicTrackID)
 	}
+	return selectMusicTrack(resolveProjectOccasion(project), resolveProjectStoryMode(project))
+}
 
-	return nil
+// ============================================================================
+// Media Ingest
+// ============================================================================
+
+// MediaProbe ffprobe 檢查上傳檔案的結果
+type MediaProbe struct {
+	FormatName    string  `json:"format_name"`
+	VideoCodec    string  `json:"video_codec"`
+	Width         int     `json:"width"`          // 編碼的寬度
+	Height        int     `json:"height"`         // 編碼的高度
+	Rotation      int     `json:"rotation"`       // 播放時要順時針旋轉的角度: 0, 90, 180, 270
+	DisplayWidth  int     `json:"display_width"`  // 旋轉後實際顯示的寬度
+	DisplayHeight int     `json:"display_height"` // 旋轉後實際顯示的高度
+	Duration      float64 `json:"duration"`
+	IsImage       bool    `json:"is_image"`
+	HasAudio      bool    `json:"has_audio"`
 }
 
-// analyzeVideoWithAI - 整個影片只打一次 API，傳送最多 10 張代表性圖片
-// 有ＡＩ
-func analyzeVideoWithAI(framePaths []string, videoID string) (*Analysis, error) {
-	if len(framePaths) == 0 {
-		return nil, fmt.Errorf("no frames provided")
+// normalizeRotation 將 rotate 標籤或 display matrix 的角度換成 0/90/180/270（順時針）
+func normalizeRotation(degrees float64) int {
+	rotation := int(math.Round(degrees/90)) * 90 % 360
+	if rotation < 0 {
+		rotation += 360
 	}
+	return rotation
+}
 
-	// 智能選擇最多 10 張代表性圖片（均勻分佈）
-	maxImages := 10
-	selectedFrames := []string{}
+// mediaOrientation 依顯示尺寸判斷方向
+func mediaOrientation(width, height int) string {
+	switch {
+	case width > height:
+		return "landscape"
+	case width < height:
+		return "portrait"
+	default:
+		return "square"
+	}
+}
 
-	if len(framePaths) <= maxImages {
-		// 圖片數量不多，全部使用
-		selectedFrames = framePaths
-	} else {
-		// 均勻選擇 10 張圖片
-		step := float64(len(framePaths)) / float64(maxImages)
-		for i := 0; i < maxImages; i++ {
-			idx := int(float64(i) * step)
-			if idx < len(framePaths) {
-				selectedFrames = append(selectedFrames, framePaths[idx])
+// rotationFilter 依旋轉角度產生 FFmpeg 濾鏡，搭配 -noautorotate 使用，結果不受 FFmpeg 版本影響
+func rotationFilter(rotation int) string {
+	switch rotation {
+	case 90:
+		return "transpose=clock"
+	case 180:
+		return "hflip,vflip"
+	case 270:
+		return "transpose=cclock"
+	default:
+		return ""
+	}
+}
+
+// RejectedUpload 沒有被接受的上傳檔案與原因
+type RejectedUpload struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+// imageCodecs 單張圖片常見的編碼，搭配只有一幀時視為照片
+var imageCodecs = map[string]bool{
+	"mjpeg": true, "png": true, "webp": true, "bmp": true, "tiff": true, "gif": true,
+}
+
+// probeMedia 用 ffprobe 讀取檔案內容判斷格式，不依賴副檔名
+func probeMedia(path string) (*MediaProbe, error) {
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_entries", "format=format_name,duration:stream=codec_type,codec_name,width,height,nb_frames,duration:stream_tags=rotate:stream_side_data=rotation",
+		"-of", "json",
+		path,
+	)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("not a readable media file")
+	}
+
+	var result struct {
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+			NbFrames  string `json:"nb_frames"`
+			Duration  string `json:"duration"`
+			Tags      struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			SideDataList []struct {
+				Rotation *float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+
+	probe := &MediaProbe{FormatName: result.Format.FormatName}
+	probe.Duration, _ = strconv.ParseFloat(result.Format.Duration, 64)
+	for _, stream := range result.Streams {
+		if stream.CodecType == "audio" {
+			probe.HasAudio = true
+		}
+	}
+
+	for _, stream := range result.Streams {
+		if stream.CodecType != "video" {
+			continue
+		}
+		probe.VideoCodec = stream.CodecName
+		probe.Width = stream.Width
+		probe.Height = stream.Height
+
+		// 手機影片的旋轉資訊：舊版 FFmpeg 放在 rotate 標籤，新版放在 display matrix（逆時針角度）
+		if rotate, err := strconv.ParseFloat(stream.Tags.Rotate, 64); err == nil {
+			probe.Rotation = normalizeRotation(rotate)
+		}
+		for _, sideData := range stream.SideDataList {
+			if sideData.Rotation != nil {
+				probe.Rotation = normalizeRotation(-*sideData.Rotation)
+				break
 			}
 		}
-	}
-
-	log.Printf("Video %s: Analyzing with %d images (total frames: %d)", videoID, len(selectedFrames), len(framePaths))
+		probe.DisplayWidth, probe.DisplayHeight = probe.Width, probe.Height
+		if probe.Rotation == 90 || probe.Rotation == 270 {
+			probe.DisplayWidth, probe.DisplayHeight = probe.Height, probe.Width
+		}
 
-	// 壓縮並編碼所有選中的圖片
-	base64Images := []string{}
-	for _, framePath := range selectedFrames {
-		compressedData, err := compressImage(framePath, 320, 240) // 壓縮到 320x240
-		if err != nil {
-			log.Printf("Warning: failed to compress image %s: %v", framePath, err)
-			continue
+		if probe.Duration == 0 {
+			probe.Duration, _ = strconv.ParseFloat(stream.Duration, 64)
 		}
+		// 圖片解碼器也能解 MJPEG 影片，nb_frames 常常是 "N/A"（不知道幾格），
+		// 所以只有圖片格式、或明確只有一格且沒有長度時才當成圖片
+		singleFrame := strings.TrimSpace(stream.NbFrames) == "1" && probe.Duration <= 0
+		probe.IsImage = imageCodecs[stream.CodecName] &&
+			(strings.Contains(probe.FormatName, "image2") || strings.HasSuffix(probe.FormatName, "_pipe") || singleFrame)
+		break
+	}
 
-		base64Image := base64.StdEncoding.EncodeToString(compressedData)
-		base64Images = append(base64Images, base64Image)
+	if probe.VideoCodec == "" {
+		return nil, fmt.Errorf("no video stream")
 	}
+	return probe, nil
+}
 
-	if len(base64Images) == 0 {
-		return nil, fmt.Errorf("no frames could be processed")
+// canDecodeVideo 實際解碼第一幀，確認這台機器的 FFmpeg 能處理（例如 HEVC）
+func canDecodeVideo(path string) error {
+	cmd := exec.Command("ffmpeg", "-v", "error", "-i", path, "-map", "0:v:0", "-frames:v", "1", "-f", "null", "-")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("video stream cannot be decoded: %s", strings.TrimSpace(string(output)))
 	}
+	return nil
+}
 
-	log.Printf("Successfully compressed %d images for video %s", len(base64Images), videoID)
+// ingestProjectMedia 檢查已存到專案目錄的檔案，可用時回傳素材資訊，不可用時刪除檔案並回傳原因
+func ingestProjectMedia(projectDir, tempPath, originalName string) (*VideoInfo, string) {
+	reject := func(reason string) (*VideoInfo, string) {
+		os.Remove(tempPath)
+		log.Printf("⚠️ Rejected upload %s: %s", originalName, reason)
+		return nil, reason
+	}
 
-	// 構建 API 請求
-	parts := []map[string]interface{}{
-		{
-			"text": fmt.Sprintf(`這些是來自同一個影片的 %d 張連續截圖（每隔 2 秒一張）。請綜合分析整個影片，判斷以下內容並以 JSON 格式回應：
+	probe, err := probeMedia(tempPath)
+	if err != nil {
+		return reject(err.Error())
+	}
+	if probe.Width == 0 || probe.Height == 0 {
+		return reject("video stream has no resolution")
+	}
+	if err := canDecodeVideo(tempPath); err != nil {
+		return reject(err.Error())
+	}
 
-{
-  "has_dog": true/false,
-  "has_human": true/false,
-  "interaction_type": "running_towards_owner" | "playing" | "being_petted" | "fetching" | "cuddling" | "none",
-  "emotion": "happy" | "excited" | "calm" | "neutral" | "sad",
-  "short_caption": "用中文簡短描述這個影片的主要內容（15字以內）"
+	mediaType := mediaTypeVideo
+	duration := probe.Duration
+	if probe.IsImage {
+		mediaType = mediaTypePhoto
+		duration = defaultPhotoDuration
+	} else {
+		if duration <= 0 {
+			return reject("video has zero duration")
+		}
+		if maxVideoDuration > 0 && duration > maxVideoDuration {
+			return reject(fmt.Sprintf("video is %.0fs long, limit is %.0fs", duration, maxVideoDuration))
+		}
+	}
+
+	videoID := uuid.New().String()
+	ext := strings.ToLower(filepath.Ext(originalName))
+	videoPath := filepath.Join(projectDir, videoID+ext)
+	// 分段上傳的暫存目錄可能在另一個磁碟上，rename 失敗（EXDEV）時改用複製
+	if err := os.Rename(tempPath, videoPath); err != nil {
+		if err := copyFile(tempPath, videoPath); err != nil {
+			log.Printf("⚠️ Failed to store %s: %v", originalName, err)
+			return reject("failed to store file")
+		}
+		os.Remove(tempPath)
+	}
+
+	log.Printf("✅ Ingested %s as %s (%s, %s, %dx%d rotated %d° → %dx%d, %.2fs)", originalName, mediaType, probe.FormatName, probe.VideoCodec,
+		probe.Width, probe.Height, probe.Rotation, probe.DisplayWidth, probe.DisplayHeight, duration)
+
+	return &VideoInfo{
+		ID:            videoID,
+		OriginalName:  originalName,
+		MediaType:     mediaType,
+		Path:          videoPath,
+		Duration:      duration,
+		Width:         probe.Width,
+		Height:        probe.Height,
+		Rotation:      probe.Rotation,
+		DisplayWidth:  probe.DisplayWidth,
+		DisplayHeight: probe.DisplayHeight,
+		Orientation:   mediaOrientation(probe.DisplayWidth, probe.DisplayHeight),
+		HasAudio:      probe.HasAudio && !probe.IsImage,
+		FramesDir:     filepath.Join(projectDir, videoID+"_frames"),
+		Analyzed:      false,
+	}, ""
 }
 
-判斷標準：
-- has_dog: 影片中是否有狗
-- has_human: 影片中是否有人
-- interaction_type: 狗和人之間的主要互動類型
-- emotion: 狗的整體情緒
-- short_caption: 簡短描述影片內容
+// ============================================================================
+// Resumable Uploads
+// ============================================================================
 
-**重要**：這些圖片來自同一個完整影片，請綜合所有圖片進行分析。
+const maxUploadChunkSize = 64 * 1024 * 1024 // 單一 PATCH 最多 64 MB
+
+// UploadSession 分段上傳的進度，中斷後可以從 Offset 繼續
+type UploadSession struct {
+	ID        string    `json:"upload_id"`
+	ProjectID string    `json:"project_id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	Checksum  string    `json:"checksum,omitempty"` // 整個檔案的 sha256（hex），finalize 時驗證
+	Path      string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	mu      sync.Mutex // 同一個上傳的 PATCH 依序寫入
+	expired bool       // 已被 expireUploadSessions 清掉，.part 檔已刪除
+}
 
-只回傳 JSON，不要其他文字。`, len(base64Images)),
-		},
-	}
+// getUploadSession 取得屬於該專案的上傳
+func getUploadSession(projectID, uploadID string) (*UploadSession, bool) {
+	uploadsMutex.RLock()
+	defer uploadsMutex.RUnlock()
 
-	// 添加所有圖片
-	for _, imgData := range base64Images {
-		parts = append(parts, map[string]interface{}{
-			"inline_data": map[string]string{
-				"mime_type": "image/jpeg",
-				"data":      imgData,
-			},
-		})
+	session, ok := uploads[uploadID]
+	if !ok || session.ProjectID != projectID {
+		return nil, false
 	}
+	return session, true
+}
 
-	requestBody := map[string]interface{}{
-		"contents": []map[string]interface{}{
-			{
-				"parts": parts,
-			},
-		},
-		"generationConfig": map[string]interface{}{
-			"temperature":      0.4,
-			"maxOutputTokens":  2000, // 增加到 2000，避免 MAX_TOKENS 錯誤
-			"responseMimeType": "application/json",
-		},
+// expireUploadSessions 定期刪除閒置超過 uploadSessionTTL 的分段上傳與 .part 檔，
+// 也清掉伺服器重新啟動前留下、已經沒有對應上傳的 .part 檔
+func expireUploadSessions() {
+	if uploadSessionTTL <= 0 {
+		return
 	}
-
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	interval := uploadSessionTTL / 4
+	if interval > time.Hour {
+		interval = time.Hour
 	}
+	for {
+		cutoff := time.Now().Add(-uploadSessionTTL)
+		active := map[string]bool{}
 
-	// 發送請求
-	url := fmt.Sprintf("%s?key=%s", aiAPIEndpoint, aiAPIKey)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
+		uploadsMutex.Lock()
+		for id, session := range uploads {
+			// 正在寫入或 finalize 的上傳不算閒置
+			if !session.mu.TryLock() {
+				active[session.Path] = true
+				continue
+			}
+			if session.UpdatedAt.Before(cutoff) {
+				os.Remove(session.Path)
+				session.expired = true
+				delete(uploads, id)
+				log.Printf("🧹 Upload %s for project %s expired after %v idle", id, session.ProjectID, uploadSessionTTL)
+			} else {
+				active[session.Path] = true
+			}
+			session.mu.Unlock()
+		}
+		uploadsMutex.Unlock()
 
-	req.Header.Set("Content-Type", "application/json")
+		filepath.WalkDir(uploadTempPath, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(path, ".part") || active[path] {
+				return nil
+			}
+			if info, err := d.Info(); err == nil && info.ModTime().Before(cutoff) {
+				os.Remove(path)
+				log.Printf("🧹 Removed orphaned upload file %s", path)
+			}
+			return nil
+		})
 
-	client := &http.Client{Timeout: 60 * time.Second} // 增加超時時間
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
+		time.Sleep(interval)
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
+// parseChunkChecksum 解析 Upload-Checksum 標頭，格式為 "sha256 <hex>"
+func parseChunkChecksum(header string) (string, error) {
+	if header == "" {
+		return "", nil
+	}
+	parts := strings.Fields(header)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "sha256" {
+		return "", fmt.Errorf("unsupported checksum %q, expected \"sha256 <hex>\"", header)
 	}
+	return strings.ToLower(parts[1]), nil
+}
 
-	// 讀取回應
-	bodyBytes, err := io.ReadAll(resp.Body)
+// writeUploadChunk 從 offset 寫入一段資料；超過檔案大小或 checksum 不符時捨棄這段並回傳錯誤
+func writeUploadChunk(session *UploadSession, body io.Reader, checksum string) error {
+	f, err := os.OpenFile(session.Path, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+		return fmt.Errorf("failed to open upload file: %v", err)
 	}
+	defer f.Close()
 
-	// 解析回應
-	var apiResponse struct {
-		Candidates []struct {
-			Content struct {
-				Parts []struct {
-					Text string `json:"text"`
-				} `json:"parts"`
-			} `json:"content"`
-			FinishReason string `json:"finishReason"`
-		} `json:"candidates"`
-		Error *struct {
-			Code    int    `json:"code"`
-			Message string `json:"message"`
-		} `json:"error"`
+	if _, err := f.Seek(session.Offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek upload file: %v", err)
 	}
 
-	if err := json.Unmarshal(bodyBytes, &apiResponse); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
-	}
+	hasher := sha256.New()
+	remaining := session.Size - session.Offset
+	written, err := io.Copy(f, io.TeeReader(io.LimitReader(body, remaining+1), hasher))
 
-	// 檢查錯誤
-	if apiResponse.Error != nil {
-		return nil, fmt.Errorf("Gemini API error: %d - %s", apiResponse.Error.Code, apiResponse.Error.Message)
+	discard := func(reason error) error {
+		f.Truncate(session.Offset)
+		return reason
 	}
-
-	if len(apiResponse.Candidates) == 0 {
-		return nil, fmt.Errorf("no candidates in response")
+	if err != nil {
+		return discard(fmt.Errorf("failed to write chunk: %v", err))
 	}
-
-	candidate := apiResponse.Candidates[0]
-
-	// 檢查內容
-	if candidate.Content.Parts == nil || len(candidate.Content.Parts) == 0 {
-		log.Printf("Gemini returned empty content for video %s. FinishReason: %s, Response: %s",
-			videoID, candidate.FinishReason, string(bodyBytes))
-		return nil, fmt.Errorf("no content (finishReason: %s)", candidate.FinishReason)
+	if written > remaining {
+		return discard(fmt.Errorf("chunk exceeds declared size %d", session.Size))
 	}
-
-	// 解析 JSON
-	content := candidate.Content.Parts[0].Text
-	content = strings.TrimPrefix(content, "```json")
-	content = strings.TrimPrefix(content, "```")
-	content = strings.TrimSuffix(content, "```")
-	content = strings.TrimSpace(content)
-
-	var analysis Analysis
-	if err := json.Unmarshal([]byte(content), &analysis); err != nil {
-		return nil, fmt.Errorf("failed to parse AI response: %v, content: %s", err, content)
+	if checksum != "" && hex.EncodeToString(hasher.Sum(nil)) != checksum {
+		return discard(fmt.Errorf("chunk checksum mismatch"))
 	}
 
-	log.Printf("✅ Video %s analyzed: has_dog=%v, has_human=%v, interaction=%s, emotion=%s, caption=%s",
-		videoID, analysis.HasDog, analysis.HasHuman, analysis.InteractionType, analysis.Emotion, analysis.ShortCaption)
-
-	return &analysis, nil
+	session.Offset += written
+	session.UpdatedAt = time.Now()
+	return nil
 }
 
-// analyzeSegmentWithAI - 保留此函數供 Phase 1 使用
-func analyzeSegmentWithAI(segment *Segment) (*Analysis, error) {
-	if len(segment.FramePaths) == 0 {
-		return nil, fmt.Errorf("no frames in segment")
+// fileSHA256 計算整個檔案的 sha256
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
 
-	// 使用新的函數分析
-	return analyzeVideoWithAI(segment.FramePaths, fmt.Sprintf("segment_%d", segment.Index))
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func findHighlights(job *Job) error {
-	highlights := []Highlight{}
+// ============================================================================
+// Photos
+// ============================================================================
 
-	var currentHighlight *Highlight
+const (
+	mediaTypeVideo       = "video"
+	mediaTypePhoto       = "photo"
+	defaultPhotoDuration = 5.0 // 沒有旁白時照片停留的秒數
+	defaultPhotoMotion   = "auto"
+	defaultPhotoZoom     = 1.2
+)
 
-	for _, segment := range job.Segments {
-		if segment.Analysis == nil {
-			continue
-		}
+// photoMotions 照片可用的運鏡方式，auto 會依章節輪流使用
+var photoMotions = []string{"zoom_in", "pan_right", "zoom_out", "pan_left"}
 
-		// Check if this segment qualifies as highlight
-		if segment.Analysis.HasDog && segment.Analysis.HasHuman &&
-			segment.Analysis.InteractionType != "none" {
+// isPhoto 這個素材是否為照片
+func (v *VideoInfo) isPhoto() bool {
+	return v.MediaType == mediaTypePhoto
+}
 
-			if currentHighlight == nil {
-				// Start new highlight
-				currentHighlight = &Highlight{
-					Start:       segment.Start,
-					End:         segment.End,
-					Caption:     segment.Analysis.ShortCaption,
-					Interaction: segment.Analysis.InteractionType,
-					Emotion:     segment.Analysis.Emotion,
-				}
-			} else {
-				// Extend current highlight
-				currentHighlight.End = segment.End
-				if currentHighlight.Caption != "" {
-					currentHighlight.Caption += " → " + segment.Analysis.ShortCaption
-				}
-			}
-		} else {
-			// No interaction, save current highlight if exists
-			if currentHighlight != nil {
-				highlights = append(highlights, *currentHighlight)
-				currentHighlight = nil
-			}
+// normalizePhotoMotion 驗證運鏡方式，未知的值使用 auto
+func normalizePhotoMotion(motion string) string {
+	if motion == "none" || motion == defaultPhotoMotion {
+		return motion
+	}
+	for _, m := range photoMotions {
+		if m == motion {
+			return motion
 		}
 	}
+	return defaultPhotoMotion
+}
 
-	// Save last highlight if exists
-	if currentHighlight != nil {
-		highlights = append(highlights, *currentHighlight)
+// chapterPhotoMotion 章節使用的運鏡方式：章節設定優先，其次是專案設定
+func chapterPhotoMotion(project *Project, chapterPos int) string {
+	motion := project.PhotoMotion
+	if chapter := project.Story.Chapters[chapterPos]; chapter.Motion != "" {
+		motion = chapter.Motion
 	}
+	motion = normalizePhotoMotion(motion)
+	if motion == defaultPhotoMotion {
+		motion = photoMotions[chapterPos%len(photoMotions)]
+	}
+	return motion
+}
 
-	jobsMutex.Lock()
-	job.Highlights = highlights
-	jobsMutex.Unlock()
-
-	log.Printf("Found %d highlights for job %s", len(highlights), job.ID)
-	return nil
+// zoompanExpressions 依運鏡方式產生 zoompan 的 z/x/y 運算式，frames 為總幀數
+func zoompanExpressions(motion string, zoom float64, frames int) (string, string, string) {
+	centerX := "iw/2-(iw/zoom/2)"
+	centerY := "ih/2-(ih/zoom/2)"
+	delta := zoom - 1
+
+	switch motion {
+	case "zoom_in":
+		return fmt.Sprintf("1+%.4f*on/%d", delta, frames), centerX, centerY
+	case "zoom_out":
+		return fmt.Sprintf("%.4f-%.4f*on/%d", zoom, delta, frames), centerX, centerY
+	case "pan_left":
+		return fmt.Sprintf("%.4f", zoom), fmt.Sprintf("(iw-iw/zoom)*(1-on/%d)", frames), centerY
+	case "pan_right":
+		return fmt.Sprintf("%.4f", zoom), fmt.Sprintf("(iw-iw/zoom)*on/%d", frames), centerY
+	default:
+		return "1", "0", "0"
+	}
 }
 
-func createHighlightVideo(job *Job) error {
-	if len(job.Highlights) == 0 {
-		return nil
+// createPhotoClip 將照片轉成有運鏡效果（Ken Burns）的影片片段
+// cropFilter 會先套用在原始照片上，用來把毛小孩留在畫面中
+func createPhotoClip(photoPath, outputPath string, width, height int, duration float64, motion string, zoom float64, cropFilter string, fill FillSpec, colorFilter string) error {
+	fps := 30
+	frames := int(duration * float64(fps))
+	if frames < 1 {
+		frames = 1
 	}
+	if zoom < 1 {
+		zoom = 1
+	}
+	z, x, y := zoompanExpressions(motion, zoom, frames)
 
-	outputDir := filepath.Join(storagePath, "videos", job.ID)
-	outputPath := filepath.Join(outputDir, "highlight.mp4")
+	// 先放大到兩倍尺寸再運鏡，避免 zoompan 取整造成畫面抖動
+	videoFilter := ""
+	if cropFilter != "" {
+		videoFilter = cropFilter + ","
+	}
+	videoFilter += fillFilter(fill, width*2, height*2) + fmt.Sprintf(
+		",zoompan=z='%s':x='%s':y='%s':d=%d:s=%dx%d:fps=%d,",
+		z, x, y, frames, width, height, fps)
+	if colorFilter != "" {
+		videoFilter += colorFilter + ","
+	}
+	videoFilter += "format=yuv420p"
 
-	// For simplicity, create video from first highlight
-	// In production, you'd concatenate all highlights
-	highlight := job.Highlights[0]
+	log.Printf("🖼️ Photo clip filter (%s, %.2fs): %s", motion, duration, videoFilter)
 
 	cmd := exec.Command("ffmpeg",
-		"-i", job.VideoPath,
-		"-ss", fmt.Sprintf("%.2f", highlight.Start),
-		"-to", fmt.Sprintf("%.2f", highlight.End),
-		"-c", "copy",
+		"-i", photoPath,
+		"-vf", videoFilter,
+		"-t", fmt.Sprintf("%.2f", duration),
+		"-an",
+		"-c:v", "libx264",
+		"-preset", "fast",
+		"-pix_fmt", "yuv420p",
 		"-y",
 		outputPath,
 	)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg photo clip error: %v, output: %s", err, string(output))
 	}
+	return nil
+}
 
-	jobsMutex.Lock()
-	job.HighlightVideo = outputPath
-	jobsMutex.Unlock()
+// ============================================================================
+// Smart Framing
+// ============================================================================
 
-	log.Printf("Created highlight video for job %s", job.ID)
-	return nil
+const (
+	framingSmart = "smart" // 裁切畫面並跟著毛小孩移動，這個檔案沒有位置資料時改用 fit
+	framingFit   = "fit"   // 完整保留畫面，比例不同時補黑邊
+)
+
+// PetBox 毛小孩在某一張截圖中的位置，座標為轉正後畫面的 0～1 比例
+type PetBox struct {
+	Frame int     `json:"frame"`          // AI 回傳時為送出的第幾張圖片，儲存時為原始截圖的編號
+	Time  float64 `json:"time,omitempty"` // 這張截圖在影片中的秒數
+	X     float64 `json:"x"`              // 左上角
+	Y     float64 `json:"y"`
+	W     float64 `json:"w"`
+	H     float64 `json:"h"`
 }
 
-func markJobFailed(jobID, errorMsg string) {
-	log.Printf("Job %s failed: %s", jobID, errorMsg)
+// center 方框中心點
+func (b PetBox) center() (float64, float64) {
+	return b.X + b.W/2, b.Y + b.H/2
+}
 
-	jobsMutex.Lock()
-	if job, exists := jobs[jobID]; exists {
-		job.Status = "failed"
-		job.Error = errorMsg
-		job.UpdatedAt = time.Now()
+// normalizeFraming 驗證構圖方式，未知的值使用 smart
+func normalizeFraming(framing string) string {
+	if framing == framingFit {
+		return framingFit
 	}
-	jobsMutex.Unlock()
+	return framingSmart
 }
 
-// ============================================================================
-// Phase 2 Processing Pipeline
-// ============================================================================
-
-func processProject(projectID string) {
-	projectsMutex.Lock()
-	project := projects[projectID]
-	project.Status = "analyzing"
-	project.UpdatedAt = time.Now()
-	projectsMutex.Unlock()
+// mediaFraming 單一檔案實際使用的構圖方式：smart 需要毛小孩的位置，
+// 沒有位置資料（AI 沒有分析或找不到毛小孩）時改為 fit，讓 fill_mode 生效，而不是盲目置中裁切
+func mediaFraming(framing string, media *VideoInfo) string {
+	if framing == framingSmart && len(media.PetTrack) == 0 {
+		return framingFit
+	}
+	return framing
+}
 
-	log.Printf("Processing project %s with %d videos", projectID, len(project.Videos))
+// clampUnit 限制在 0～1 之間
+func clampUnit(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
 
-	// Step 1: Analyze all videos (繼續處理即使有錯誤)
-	successCount := 0
-	for i := range project.Videos {
-		if err := analyzeVideo(project, i); err != nil {
-			log.Printf("⚠️ Warning: Failed to analyze video %s: %v (continuing)", project.Videos[i].ID, err)
-			// 不要立即返回，繼續處理其他影片
+// sanitizePetBoxes 過濾 AI 回傳的不合理方框，並把圖片順序換回原始截圖的編號
+func sanitizePetBoxes(boxes []PetBox, sentFrames []int) []PetBox {
+	result := []PetBox{}
+	for _, box := range boxes {
+		if box.Frame < 0 || box.Frame >= len(sentFrames) {
 			continue
 		}
-		successCount++
+		box.X, box.Y = clampUnit(box.X), clampUnit(box.Y)
+		box.W = math.Min(box.W, 1-box.X)
+		box.H = math.Min(box.H, 1-box.Y)
+		if box.W <= 0.01 || box.H <= 0.01 {
+			continue
+		}
+		box.Frame = sentFrames[box.Frame]
+		result = append(result, box)
 	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Frame < result[j].Frame })
+	return result
+}
 
-	// 至少要有一半的影片分析成功才能繼續
-	if successCount == 0 {
-		markProjectFailed(projectID, "All videos failed to analyze")
-		return
+// cropWindow 在來源畫面中取出符合目標比例的最大裁切範圍（偶數，方便編碼）
+func cropWindow(srcW, srcH, dstW, dstH int) (int, int) {
+	target := float64(dstW) / float64(dstH)
+	cw, ch := srcW, srcH
+	if float64(srcW)/float64(srcH) > target {
+		cw = int(float64(srcH) * target)
+	} else {
+		ch = int(float64(srcW) / target)
 	}
+	return cw &^ 1, ch &^ 1
+}
 
-	log.Printf("✅ Successfully analyzed %d/%d videos", successCount, len(project.Videos))
+// cropKey 裁切位置的關鍵格
+type cropKey struct {
+	t, x, y float64
+}
 
-	// Step 2: Generate story with AI
-	projectsMutex.Lock()
-	project.Status = "generating_story"
-	project.UpdatedAt = time.Now()
-	projectsMutex.Unlock()
+// smartCropFilter 產生跟著毛小孩移動的 crop 濾鏡，t 為片段開始後的秒數
+// 比例相同時回傳空字串；這段時間內沒有方框時置中裁切
+func smartCropFilter(track []PetBox, srcW, srcH, dstW, dstH int, start, end float64) string {
+	if srcW <= 0 || srcH <= 0 {
+		return ""
+	}
+	cw, ch := cropWindow(srcW, srcH, dstW, dstH)
+	if srcW-cw < 4 && srcH-ch < 4 {
+		return ""
+	}
+	maxX, maxY := float64(srcW-cw), float64(srcH-ch)
 
-	story, err := generateStoryWithAI(project)
-	if err != nil {
-		markProjectFailed(projectID, "Failed to generate story: "+err.Error())
-		return
+	// 取片段前後各一張截圖的方框，讓開頭與結尾也能內插
+	boxes := []PetBox{}
+	for _, box := range track {
+		if box.Time >= start-2.0 && box.Time <= end+2.0 {
+			boxes = append(boxes, box)
+		}
+	}
+	if len(boxes) == 0 {
+		return fmt.Sprintf("crop=%d:%d:%.0f:%.0f", cw, ch, maxX/2, maxY/2)
 	}
 
-	projectsMutex.Lock()
-	project.Story = story
-	project.Status = "generating_video"
-	project.UpdatedAt = time.Now()
-	projectsMutex.Unlock()
+	// AI 的方框會有些微抖動，用前後三格加權平均（1:2:1）讓鏡頭移動平順
+	keys := make([]cropKey, len(boxes))
+	for i := range boxes {
+		sumX, sumY, n := 0.0, 0.0, 0.0
+		for j := i - 1; j <= i+1; j++ {
+			if j < 0 || j >= len(boxes) {
+				continue
+			}
+			weight := 1.0
+			if j == i {
+				weight = 2
+			}
+			cx, cy := boxes[j].center()
+			sumX, sumY, n = sumX+cx*weight, sumY+cy*weight, n+weight
+		}
+		keys[i] = cropKey{
+			t: boxes[i].Time - start,
+			x: math.Max(0, math.Min(maxX, sumX/n*float64(srcW)-float64(cw)/2)),
+			y: math.Max(0, math.Min(maxY, sumY/n*float64(srcH)-float64(ch)/2)),
+		}
+	}
 
-	// Step 3: Generate TTS audio for each chapter
-	for i := range project.Story.Chapters {
-		if err := generateTTS(project, i); err != nil {
-			log.Printf("Warning: TTS generation failed for chapter %d: %v", i, err)
-			// Continue without audio
+	xExpr := cropAxisExpr(keys, func(k cropKey) float64 { return k.x })
+	yExpr := cropAxisExpr(keys, func(k cropKey) float64 { return k.y })
+	return fmt.Sprintf("crop=%d:%d:'%s':'%s'", cw, ch, xExpr, yExpr)
+}
+
+// cropAxisExpr 將關鍵格組成 ffmpeg 的分段線性內插運算式
+func cropAxisExpr(keys []cropKey, value func(cropKey) float64) string {
+	expr := fmt.Sprintf("%.1f", value(keys[len(keys)-1]))
+	for i := len(keys) - 2; i >= 0; i-- {
+		a, b := keys[i], keys[i+1]
+		if b.t-a.t <= 0 {
+			continue
 		}
+		expr = fmt.Sprintf("if(lt(t,%.2f),%.1f+(%.1f)*(t-%.2f)/%.2f,%s)",
+			b.t, value(a), value(b)-value(a), a.t, b.t-a.t, expr)
 	}
+	return fmt.Sprintf("if(lt(t,%.2f),%.1f,%s)", keys[0].t, value(keys[0]), expr)
+}
 
-	// Step 4: Composite final video (with subtitles and background music)
-	if err := compositeVideo(project); err != nil {
-		markProjectFailed(projectID, "Failed to composite video: "+err.Error())
-		return
+// mediaDisplaySize 轉正後的畫面尺寸，舊資料沒有記錄時重新讀取
+func mediaDisplaySize(media *VideoInfo) (int, int) {
+	if media.DisplayWidth > 0 && media.DisplayHeight > 0 {
+		return media.DisplayWidth, media.DisplayHeight
 	}
+	return getVideoResolution(media.Path)
+}
 
-	projectsMutex.Lock()
-	project.Status = "completed"
-	project.UpdatedAt = time.Now()
-	projectsMutex.Unlock()
+// ============================================================================
+// Background Fill
+// ============================================================================
 
-	log.Printf("Project %s completed successfully", projectID)
-}
+const (
+	fillBlack   = "black"   // 黑邊
+	fillBlur    = "blur"    // 同一個畫面放大後模糊當背景
+	fillColor   = "color"   // 場合或自訂的主題色
+	fillPattern = "pattern" // 主題色加上腳印圖案
 
-func analyzeVideo(project *Project, videoIndex int) error {
-	video := &project.Videos[videoIndex]
+	defaultFillMode  = fillBlur
+	defaultFillColor = "#2B2B2B"
+)
 
-	log.Printf("Analyzing video %s (%s)", video.ID, video.OriginalName)
+var fillModes = []string{fillBlack, fillBlur, fillColor, fillPattern}
 
-	// Extract frames - 每2秒一張 (fps=0.5)
-	os.MkdirAll(video.FramesDir, 0755)
-	outputPattern := filepath.Join(video.FramesDir, "frame_%04d.jpg")
-	cmd := exec.Command("ffmpeg", "-i", video.Path, "-vf", "fps=0.5,scale=640:360", outputPattern)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("ffmpeg error: %v, output: %s", err, string(output))
+// FillSpec 畫面比例不同時，空白部分的填充方式
+type FillSpec struct {
+	Mode  string
+	Color string // #RRGGBB
+}
+
+// normalizeFillMode 驗證填充方式，未知的值使用預設
+func normalizeFillMode(mode string) string {
+	for _, m := range fillModes {
+		if m == mode {
+			return m
+		}
 	}
+	return defaultFillMode
+}
 
-	// Get all frame files
-	files, err := filepath.Glob(filepath.Join(video.FramesDir, "frame_*.jpg"))
+// parseHexColor 解析 #RRGGBB 格式的顏色
+func parseHexColor(value string) (color.RGBA, error) {
+	hexValue := strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if len(hexValue) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, expected #RRGGBB", value)
+	}
+	raw, err := hex.DecodeString(hexValue)
 	if err != nil {
-		return err
+		return color.RGBA{}, fmt.Errorf("invalid color %q, expected #RRGGBB", value)
 	}
+	return color.RGBA{R: raw[0], G: raw[1], B: raw[2], A: 255}, nil
+}
 
-	if len(files) == 0 {
-		return fmt.Errorf("no frames extracted")
+// projectFill 專案的填充設定，沒有指定顏色時使用場合的主題色
+func projectFill(project *Project) FillSpec {
+	fill := FillSpec{Mode: normalizeFillMode(project.FillMode), Color: project.FillColor}
+	if fill.Color == "" {
+		fill.Color = resolveProjectOccasion(project).ThemeColor
 	}
+	if _, err := parseHexColor(fill.Color); err != nil {
+		fill.Color = defaultFillColor
+	}
+	return fill
+}
 
-	log.Printf("Extracted %d frames from video %s", len(files), video.ID)
+// fillFilter 將畫面縮放到 width x height 以內並填滿空白部分
+// 回傳的濾鏡可以直接接在其他濾鏡後面（輸入與輸出都沒有標籤）
+func fillFilter(fill FillSpec, width, height int) string {
+	fit := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", width, height)
+	center := "overlay=(W-w)/2:(H-h)/2"
+
+	switch fill.Mode {
+	case fillBlur:
+		// 背景先縮小再模糊，速度比在原尺寸模糊快很多，稍微調暗讓主畫面更突出
+		return fmt.Sprintf(
+			"split[fill_fg][fill_bg];"+
+				"[fill_bg]scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d,boxblur=10:2,eq=brightness=-0.08,scale=%d:%d,setsar=1[fill_base];"+
+				"[fill_fg]%s[fill_main];"+
+				"[fill_base][fill_main]%s",
+			width/4, height/4, width/4, height/4, width, height,
+			fit, center)
+	case fillColor:
+		return fmt.Sprintf("%s,pad=%d:%d:(ow-iw)/2:(oh-ih)/2:color=0x%s",
+			fit, width, height, strings.TrimPrefix(fill.Color, "#"))
+	case fillPattern:
+		patternPath, err := ensurePawPattern(fill.Color, width, height)
+		if err != nil {
+			log.Printf("⚠️ Failed to create paw pattern: %v, using solid colour", err)
+			return fillFilter(FillSpec{Mode: fillColor, Color: fill.Color}, width, height)
+		}
+		// 以原畫面當底確保時間軸一致，再蓋上圖案（單張圖片會一直停留在最後一格）
+		return fmt.Sprintf(
+			"split[fill_fg][fill_bg];"+
+				"[fill_bg]scale=%d:%d,setsar=1[fill_base];"+
+				"movie='%s'[fill_pattern];"+
+				"[fill_base][fill_pattern]overlay[fill_back];"+
+				"[fill_fg]%s[fill_main];"+
+				"[fill_back][fill_main]%s",
+			width, height, patternPath, fit, center)
+	default:
+		return fmt.Sprintf("%s,pad=%d:%d:(ow-iw)/2:(oh-ih)/2:color=black", fit, width, height)
+	}
+}
 
-	// **新邏輯：整個影片只打一次 API，一次傳送所有圖片（最多10張）**
-	analysis, err := analyzeVideoWithAI(files, video.ID)
+// ensurePawPattern 產生（或重用）指定顏色與尺寸的腳印背景圖
+func ensurePawPattern(hexColor string, width, height int) (string, error) {
+	base, err := parseHexColor(hexColor)
 	if err != nil {
-		log.Printf("Warning: AI analysis failed for video %s: %v (using default analysis)", video.ID, err)
-		// 使用預設分析，讓流程繼續
-		analysis = &Analysis{
-			HasDog:          true,
-			HasHuman:        true,
-			InteractionType: "none",
-			Emotion:         "neutral",
-			ShortCaption:    "影片分析",
-		}
+		return "", err
+	}
+	dir := filepath.Join(storagePath, "patterns")
+	patternPath := filepath.Join(dir, fmt.Sprintf("paw_%02x%02x%02x_%dx%d.png", base.R, base.G, base.B, width, height))
+	if _, err := os.Stat(patternPath); err == nil {
+		return patternPath, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create pattern dir: %v", err)
 	}
 
-	// 根據 AI 分析結果創建 segments（每個 segment = 6 秒）
-	segmentSize := 3 // 3 frames = 6 seconds at fps=0.5 (2s per frame)
-	segments := []Segment{}
+	// 腳印顏色：深色背景用亮一點的腳印，淺色背景用暗一點的
+	paw := shadeColor(base, 0.92)
+	if int(base.R)+int(base.G)+int(base.B) < 384 {
+		paw = shadeColor(base, 1.25)
+	}
 
-	for i := 0; i < len(files); i += segmentSize {
-		end := i + segmentSize
-		if end > len(files) {
-			end = len(files)
-		}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: base}, image.Point{}, draw.Src)
 
-		segment := Segment{
-			Index:      len(segments) + 1,
-			Start:      float64(i) * 2.0, // 2.0s per frame at fps=0.5
-			End:        float64(end) * 2.0,
-			FramePaths: files[i:end],
-			Analysis:   analysis, // 所有 segment 使用相同的分析結果
+	// 交錯排列的腳印，每隔一排往右偏移半格
+	cell := height / 6
+	if cell < 40 {
+		cell = 40
+	}
+	for row := 0; row*cell < height+cell; row++ {
+		offset := 0
+		if row%2 == 1 {
+			offset = cell / 2
+		}
+		for col := -1; col*cell < width+cell; col++ {
+			drawPawPrint(img, col*cell+offset+cell/2, row*cell+cell/2, float64(cell)/5, paw)
 		}
-		segments = append(segments, segment)
 	}
 
-	// Find highlights based on analysis
-	highlights := []Highlight{}
+	f, err := os.Create(patternPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create pattern file: %v", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		os.Remove(patternPath)
+		return "", fmt.Errorf("failed to encode pattern: %v", err)
+	}
+	return patternPath, nil
+}
 
-	// 如果有互動，將整個影片（或前幾個 segment）標記為 highlight
-	if analysis.HasDog && analysis.HasHuman && analysis.InteractionType != "none" {
-		// 取前 15 秒作為 highlight
-		maxHighlightDuration := 15.0
-		for _, segment := range segments {
-			if segment.End <= maxHighlightDuration {
-				if len(highlights) == 0 {
-					highlights = append(highlights, Highlight{
-						Start:       segment.Start,
-						End:         segment.End,
-						Caption:     analysis.ShortCaption,
-						Interaction: analysis.InteractionType,
-						Emotion:     analysis.Emotion,
-					})
-				} else {
-					highlights[0].End = segment.End
-				}
+// drawPawPrint 以 (cx, cy) 為中心畫一個腳印：一個大肉墊加四個小趾頭
+func drawPawPrint(img *image.RGBA, cx, cy int, size float64, c color.RGBA) {
+	fillEllipse(img, float64(cx), float64(cy)+size*0.4, size*0.9, size*0.7, c)
+	toes := [][2]float64{{-1.05, -0.35}, {-0.4, -0.95}, {0.4, -0.95}, {1.05, -0.35}}
+	for _, toe := range toes {
+		fillEllipse(img, float64(cx)+toe[0]*size, float64(cy)+toe[1]*size, size*0.32, size*0.38, c)
+	}
+}
+
+// fillEllipse 填滿一個橢圓
+func fillEllipse(img *image.RGBA, cx, cy, rx, ry float64, c color.RGBA) {
+	bounds := img.Bounds()
+	for y := int(cy - ry); y <= int(cy+ry); y++ {
+		for x := int(cx - rx); x <= int(cx+rx); x++ {
+			if !(image.Point{X: x, Y: y}).In(bounds) {
+				continue
+			}
+			dx, dy := (float64(x)-cx)/rx, (float64(y)-cy)/ry
+			if dx*dx+dy*dy <= 1 {
+				img.SetRGBA(x, y, c)
 			}
 		}
 	}
+}
+
+// shadeColor 調整顏色亮度，factor 大於 1 變亮、小於 1 變暗
+func shadeColor(c color.RGBA, factor float64) color.RGBA {
+	scale := func(v uint8) uint8 {
+		return uint8(math.Max(0, math.Min(255, float64(v)*factor+(factor-1)*40)))
+	}
+	return color.RGBA{R: scale(c.R), G: scale(c.G), B: scale(c.B), A: 255}
+}
 
-	// Update video info
-	projectsMutex.Lock()
-	project.Videos[videoIndex].Segments = segments
-	project.Videos[videoIndex].Highlights = highlights
-	project.Videos[videoIndex].Analyzed = true
-	projectsMutex.Unlock()
+// ============================================================================
+// Transitions
+// ============================================================================
 
-	log.Printf("Analyzed video %s: %d segments, %d highlights", video.ID, len(segments), len(highlights))
-	return nil
+const (
+	defaultTransition         = "dissolve"
+	defaultTransitionDuration = 0.8
+	maxTransitionDuration     = 3.0
+	edgeFadeDuration          = 0.5 // 整段影片開頭與結尾的淡入淡出
+)
+
+// TransitionDefinition 章節之間的轉場，XFade 為 ffmpeg xfade 的 transition 名稱
+type TransitionDefinition struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	XFade string `json:"xfade"`
 }
 
-// 有ＡＩ
-func generateStoryWithAI(project *Project) (*Story, error) {
-	log.Printf("Generating story for project %s with AI (mode: %s)", project.ID, project.StoryMode)
+var transitionLibrary = []TransitionDefinition{
+	{ID: "dissolve", Name: "溶接", XFade: "fade"},
+	{ID: "wipe", Name: "擦除", XFade: "wipeleft"},
+	{ID: "slide", Name: "滑入", XFade: "slideleft"},
+	{ID: "circle_open", Name: "圓形展開", XFade: "circleopen"},
+	{ID: "fade_white", Name: "白色淡入淡出", XFade: "fadewhite"},
+	{ID: "fade_black", Name: "黑色淡入淡出", XFade: "fadeblack"},
+}
 
-	// 收集所有高光片段的描述
-	allHighlights := []string{}
-	for _, video := range project.Videos {
-		for _, highlight := range video.Highlights {
-			allHighlights = append(allHighlights, fmt.Sprintf("影片《%s》: %s (情緒：%s)",
-				video.OriginalName, highlight.Caption, highlight.Emotion))
+// lookupTransition 依 ID 找轉場，找不到時回傳 nil
+func lookupTransition(id string) *TransitionDefinition {
+	for i := range transitionLibrary {
+		if transitionLibrary[i].ID == id {
+			return &transitionLibrary[i]
 		}
 	}
+	return nil
+}
 
-	if len(allHighlights) == 0 {
-		return nil, fmt.Errorf("no highlights found in any video")
+// clampTransitionDuration 限制轉場秒數，0 代表使用預設
+func clampTransitionDuration(duration float64) float64 {
+	if duration <= 0 {
+		return 0
 	}
+	return math.Max(0.2, math.Min(maxTransitionDuration, duration))
+}
 
-	// 根據關係設定稱呼
-	ownerTitle := project.OwnerRelationship
-	if ownerTitle == "" {
-		ownerTitle = "主人"
+// chapterTransition 第 chapterPos 段接到下一段時使用的轉場（章節設定優先於專案設定）
+func chapterTransition(project *Project, chapterPos int) (*TransitionDefinition, float64) {
+	transition := lookupTransition(project.Transition)
+	duration := project.TransitionDuration
+	chapter := project.Story.Chapters[chapterPos]
+	if t := lookupTransition(chapter.Transition); t != nil {
+		transition = t
 	}
-
-	// 根據模式設定不同的提示詞風格
-	var modeStyle, modeExamples, modeEmotion string
-	switch project.StoryMode {
-	case "cute": // 可愛活潑（但不要太做作）
-		modeStyle = "活潑、親人、喜歡撒嬌的小狗"
-		modeEmotion = "開心、興奮、會撒嬌，但不會每一句都刻意裝可愛。偶爾用疊字或語氣詞（嘿嘿、好啦）就好。"
-		modeExamples = fmt.Sprintf(`「%s，你回來了！我有很乖地在門口等你喔。」
-「跟你一起玩的時候，我的尾巴都自己一直搖，停不下來。」
-「%s，可以再抱我一下嗎？被你抱著的時候，我覺得自己好安心。」`,
-			ownerTitle, ownerTitle)
-
-	case "funny": // 幽默風趣
-		modeStyle = "有點小聰明、會吐槽、但心裡很黏人的諧星狗狗"
-		modeEmotion = "幽默、自嘲、搞笑，會開玩笑吐槽%s，但不是真的在抱怨，語氣要帶著喜歡和依賴。"
-		modeEmotion = fmt.Sprintf(modeEmotion, ownerTitle)
-		modeExamples = fmt.Sprintf(`「%s，你知道嗎？我覺得沙發那一邊比較軟，所以我先幫你躺好試試看。」
-「欸～那個零食櫃我都有幫你看好喔，只是剛好順便幫自己看一下而已啦。」
-「好啦，我每天都在碎念你，可是你不在家的時候，我其實超想你的。」`,
-			ownerTitle)
-
-	default: // warm - 溫馨感人
-		modeStyle = "溫柔、感性、很在意細節的小天使狗狗"
-		modeEmotion = "溫馨、感動、深情，用具體回憶來表達對主人的依戀與感謝，而不是一直重複同一句話。"
-		modeExamples = fmt.Sprintf(`「%s你看，我跑得有點慢了，可是我還是想要走到門口等你。」
-「只要你在，我就覺得家裡好安靜、好安全，我可以放心地睡在你腳邊。」
-「謝謝你一直陪著我，累的時候還是會摸摸我、叫我的名字，我真的好喜歡那個聲音。」`,
-			ownerTitle)
+	if chapter.TransitionDuration > 0 {
+		duration = chapter.TransitionDuration
 	}
+	if transition == nil {
+		transition = lookupTransition(defaultTransition)
+	}
+	if duration <= 0 {
+		duration = defaultTransitionDuration
+	}
+	return transition, duration
+}
 
-	// 構建 prompt - 生成 5 段狗狗對白（加長、加細節）
-	prompt := fmt.Sprintf(`你是一隻名叫「%s」的%s，是一個有靈魂的小毛孩。  
-請用「第一人稱」的口吻，像一個 3～5 歲的小朋友，在看著這些回憶影片時，  
-對你的「%s」說悄悄話。
-
-🎭 本次風格設定：
-- 角色性格：%s
-- 情感基調：%s
-- 你非常愛你的%s，也非常依賴他/她。
-
-下面是剪輯出來的影片片段描述（每一行是一個高光片段）：
-%s
-
-請根據這些片段，替「狗狗本人」寫出 5 段對白，每段是狗狗在看著對應影片時心裡說的話。
-
-創作要求：
-1. 語氣設定：
-   - 用「我」來稱呼自己，用「%s」來稱呼對方。
-   - 口吻單純、直接，有點像小孩講話，但可以有情緒層次。
-2. 內容重點：
-   - 每一段要盡量呼應該段影片的畫面與情境（跑、撲、一起睡覺、散步…）。
-   - 可以具體描述畫面，例如「我衝過去撲在你身上」、「我趴在門口等你」。
-3. 長度與結構：
-   - 每段對白請寫成「2～3 句短句」。
-   - 整段總長度約 40～70 個中文字，不要太短。
-4. 情緒控制：
-   - 前 1～4 段可以偏日常、溫暖、搞笑或可愛（依照風格）。
-   - 第 5 段要特別有感情，帶一點不捨與感謝，可以提到「就算看不到我，我還是在你身邊」這類句子。
-   - 不要過度灑狗血，不要連發很多「謝謝你」而沒有具體畫面。
-5. 文字風格：
-   - 避免太制式的句子（例如「你是我最好的朋友」、「謝謝你的陪伴」可以出現，但不要一整段都在講這種話）。
-   - 盡量多一點畫面感與細節，少一點空泛形容詞。
-
-你可以參考以下風格示意（只參考語氣與情緒，不要直接抄）：
-%s
-
-請用 **嚴格 JSON 格式** 回應，內容必須是正好 5 個 chapters，例如：
+// renderedClip 已轉好格式的章節片段
+type renderedClip struct {
+	ChapterPos int
+	Path       string
+	AudioPath  string
+	Duration   float64
 
-{
-  "title": "給%s的悄悄話",
-  "chapters": [
-    {"narration": "第一段對白", "video_index": 0, "highlight_index": 0},
-    {"narration": "第二段對白", "video_index": 1, "highlight_index": 0},
-    {"narration": "第三段對白", "video_index": 2, "highlight_index": 0},
-    {"narration": "第四段對白", "video_index": 3, "highlight_index": 0},
-    {"narration": "第五段對白", "video_index": 4, "highlight_index": 0}
-  ]
-}
-
-注意：
-- 只回傳 JSON，不要任何註解、解說、markdown 或額外符號。
-- narration 必須是完整中文句子，符合上述長度與情感要求。`,
-		project.DogName,
-		project.DogBreed,
-		ownerTitle,
-		modeStyle,
-		modeEmotion,
-		ownerTitle,
-		strings.Join(allHighlights, "\n"),
-		ownerTitle,
-		modeExamples,
-		ownerTitle)
+	KeepOriginal   bool          // 片段裡有剪出原音
+	OriginalVolume float64       // 原音的音量
+	FullVolume     []AudioMoment // 原音以全音量播放的時段（片段內的秒數）
+}
 
-	// 調用 Gemini AI
-	requestBody := map[string]interface{}{
-		"contents": []map[string]interface{}{
-			{
-				"parts": []map[string]interface{}{
-					{"text": prompt},
-				},
-			},
-		},
-		"generationConfig": map[string]interface{}{
-			"temperature":      0.8, // 稍微提高溫度，讓語氣更活潑
-			"maxOutputTokens":  8000,
-			"responseMimeType": "application/json",
-		},
+// clipTimeline 計算每個片段在成品中的開始時間，轉場會讓下一段提早開始（與前一段重疊）
+// 回傳各片段開始時間、各轉場長度與總長度
+func clipTimeline(project *Project, clips []renderedClip) ([]float64, []float64, float64) {
+	starts := make([]float64, len(clips))
+	overlaps := make([]float64, 0, len(clips))
+	current := 0.0
+	for i, clip := range clips {
+		starts[i] = current
+		current += clip.Duration
+		if i == len(clips)-1 {
+			break
+		}
+		_, duration := chapterTransition(project, clip.ChapterPos)
+		// 轉場不能超過前後片段長度的 40%，否則 xfade 會吃掉整段
+		duration = math.Min(duration, math.Min(clip.Duration, clips[i+1].Duration)*0.4)
+		overlaps = append(overlaps, duration)
+		current -= duration
 	}
+	return starts, overlaps, current
+}
 
-	jsonData, _ := json.Marshal(requestBody)
-	url := fmt.Sprintf("%s?key=%s", aiAPIEndpoint, aiAPIKey)
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+// joinClipsWithTransitions 以 xfade/acrossfade 串接片段，並記錄每一段在成品中的時間軸
+func joinClipsWithTransitions(project *Project, clips []renderedClip, outputPath string) error {
+	starts, overlaps, total := clipTimeline(project, clips)
+
+	args := []string{}
+	filters := []string{}
+	for i, clip := range clips {
+		args = append(args, "-i", clip.Path)
+		// xfade 要求輸入的時間基準、影格率與像素格式一致
+		filters = append(filters, fmt.Sprintf("[%d:v]settb=AVTB,setpts=PTS-STARTPTS,fps=30,format=yuv420p[v%d]", i, i))
+	}
+	// 每段旁白前面補上前一個轉場的長度、後面補靜音到片段長度
+	// 旁白從轉場結束時開始，acrossfade 交疊的部分都是靜音，不會蓋掉說話的開頭
+	// 保留原音的片段先把旁白整理成 [n%d]，再與壓在旁白下面的原音混合成 [a%d]
+	leads := make([]float64, len(clips))
+	for i := 1; i < len(clips); i++ {
+		leads[i] = overlaps[i-1]
+	}
+	mix := projectAudioMix(project)
+	for i, clip := range clips {
+		label := fmt.Sprintf("a%d", i)
+		if clip.KeepOriginal {
+			label = fmt.Sprintf("n%d", i)
+		}
+		if clip.AudioPath != "" {
+			args = append(args, "-i", clip.AudioPath)
+			filters = append(filters, fmt.Sprintf(
+				"[%d:a]aresample=44100,aformat=channel_layouts=stereo,adelay=%d:all=1,apad,atrim=0:%.3f,asetpts=PTS-STARTPTS[%s]",
+				len(clips)+countAudioBefore(clips, i), int(leads[i]*1000), clip.Duration, label))
+		} else {
+			filters = append(filters, fmt.Sprintf("anullsrc=r=44100:cl=stereo,atrim=0:%.3f[%s]", clip.Duration, label))
+		}
+		if clip.KeepOriginal {
+			filters = append(filters, originalAudioFilters(mix, clip, i)...)
+		}
 	}
-	defer resp.Body.Close()
 
-	bodyBytes, _ := io.ReadAll(resp.Body)
+	videoOut, audioOut := "v0", "a0"
+	for i := 1; i < len(clips); i++ {
+		transition, _ := chapterTransition(project, clips[i-1].ChapterPos)
+		filters = append(filters,
+			fmt.Sprintf("[%s][v%d]xfade=transition=%s:duration=%.3f:offset=%.3f[vx%d]",
+				videoOut, i, transition.XFade, overlaps[i-1], starts[i], i),
+			fmt.Sprintf("[%s][a%d]acrossfade=d=%.3f:c1=tri:c2=tri[ax%d]",
+				audioOut, i, overlaps[i-1], i))
+		videoOut, audioOut = fmt.Sprintf("vx%d", i), fmt.Sprintf("ax%d", i)
+		log.Printf("  %d → %d: %s %.2fs at %.2fs", clips[i-1].ChapterPos+1, clips[i].ChapterPos+1, transition.ID, overlaps[i-1], starts[i])
+	}
+	filters = append(filters, fmt.Sprintf("[%s]fade=t=in:st=0:d=%.2f,fade=t=out:st=%.3f:d=%.2f[vout]",
+		videoOut, edgeFadeDuration, total-edgeFadeDuration, edgeFadeDuration))
+
+	args = append(args,
+		"-filter_complex", strings.Join(filters, ";"),
+		"-map", "[vout]",
+		"-map", "["+audioOut+"]",
+		"-c:v", "libx264",
+		"-preset", "fast",
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-y",
+		outputPath,
+	)
+	cmd := exec.Command("ffmpeg", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg xfade error: %v, output: %s", err, string(output))
+	}
 
-	var apiResponse struct {
-		Candidates []struct {
-			Content struct {
-				Parts []struct {
-					Text string `json:"text"`
-				} `json:"parts"`
-			} `json:"content"`
-		} `json:"candidates"`
+	// 時間軸：沒有成功產生片段的章節長度為 0，字幕會跳過
+	projectsMutex.Lock()
+	for i := range project.Story.Chapters {
+		project.Story.Chapters[i].TimelineStart = 0
+		project.Story.Chapters[i].TimelineEnd = 0
+		project.Story.Chapters[i].NarrationStart = 0
 	}
+	for i, clip := range clips {
+		chapter := &project.Story.Chapters[clip.ChapterPos]
+		chapter.TimelineStart = starts[i]
+		chapter.TimelineEnd = starts[i] + clip.Duration
+		chapter.NarrationStart = starts[i] + leads[i]
+	}
+	project.Story.Duration = total
+	projectsMutex.Unlock()
 
-	if err := json.Unmarshal(bodyBytes, &apiResponse); err != nil {
-		return nil, err
+	log.Printf("✅ Joined %d clips with transitions (total %.2fs)", len(clips), total)
+	return nil
+}
+
+// countAudioBefore 第 i 段之前有幾段有旁白，用來算出音訊輸入的編號
+func countAudioBefore(clips []renderedClip, i int) int {
+	count := 0
+	for _, clip := range clips[:i] {
+		if clip.AudioPath != "" {
+			count++
+		}
 	}
+	return count
+}
 
-	if len(apiResponse.Candidates) == 0 {
-		log.Printf("Story generation failed: no candidates. Response: %s", string(bodyBytes))
-		return nil, fmt.Errorf("no content in AI response")
-	}
+// ============================================================================
+// Narration Timing
+// ============================================================================
 
-	candidate := apiResponse.Candidates[0]
+const (
+	timingExtend = "extend" // 從原始影片多取一些畫面
+	timingFreeze = "freeze" // 停在最後一格
+	timingLoop   = "loop"   // 重複播放片段
+	timingSlow   = "slow"   // 放慢播放速度
 
-	if len(candidate.Content.Parts) == 0 {
-		log.Printf("Story generation failed: no parts. FinishReason: %v, Response: %s",
-			candidate, string(bodyBytes))
-		return nil, fmt.Errorf("no content in AI response (finishReason may be MAX_TOKENS or SAFETY)")
-	}
+	defaultTimingStrategy   = timingExtend
+	defaultNarrationPadding = 0.5
+	maxNarrationPadding     = 3.0
+	maxSlowFactor           = 2.0 // 超過兩倍慢動作會很不自然，剩下的用停格補
+)
 
-	content := apiResponse.Candidates[0].Content.Parts[0].Text
-	log.Printf("Story AI response content: %s", content)
-	content = strings.TrimPrefix(content, "```json")
-	content = strings.TrimPrefix(content, "```")
-	content = strings.TrimSuffix(content, "```")
-	content = strings.TrimSpace(content)
+var timingStrategies = []string{timingExtend, timingFreeze, timingLoop, timingSlow}
 
-	var storyResponse struct {
-		Title    string `json:"title"`
-		Chapters []struct {
-			Narration      string `json:"narration"`
-			VideoIndex     int    `json:"video_index"`
-			HighlightIndex int    `json:"highlight_index"`
-		} `json:"chapters"`
+// normalizeTimingStrategy 驗證畫面配合旁白的方式，未知的值使用預設
+func normalizeTimingStrategy(strategy string) string {
+	for _, s := range timingStrategies {
+		if s == strategy {
+			return s
+		}
 	}
+	return defaultTimingStrategy
+}
 
-	if err := json.Unmarshal([]byte(content), &storyResponse); err != nil {
-		return nil, fmt.Errorf("failed to parse story: %v", err)
+// narrationPadding 旁白結束後保留的秒數
+func narrationPadding(project *Project) float64 {
+	return math.Min(floatOrDefault(project.NarrationPadding, defaultNarrationPadding), maxNarrationPadding)
+}
+
+// narrationClipDuration 這一段旁白需要的畫面長度：前一個轉場 + 旁白 + 收尾（至少涵蓋下一個轉場）
+// 沒有旁白時回傳 0，維持原本的片段長度
+func narrationClipDuration(project *Project, chapterPos int) float64 {
+	chapter := project.Story.Chapters[chapterPos]
+	if chapter.AudioPath == "" || chapter.Duration <= 0 {
+		return 0
+	}
+	lead := 0.0
+	if chapterPos > 0 {
+		_, lead = chapterTransition(project, chapterPos-1)
+	}
+	tail := narrationPadding(project)
+	if chapterPos < len(project.Story.Chapters)-1 {
+		_, next := chapterTransition(project, chapterPos)
+		tail = math.Max(tail, next)
 	}
+	return lead + chapter.Duration + tail
+}
 
-	// 轉換為 Story 結構
-	story := &Story{
-		Title:    storyResponse.Title,
-		Chapters: []StoryChapter{},
+// clipTiming 影片章節要擷取的範圍，以及補足長度的方式
+type clipTiming struct {
+	Start       float64 // 在原始影片中的開始秒數
+	Length      float64 // 從原始影片擷取的秒數
+	Filter      string  // 放慢或停格的濾鏡，空白代表不需要
+	AudioFilter string  // 保留原音時配合放慢的音訊濾鏡
+	Stretch     float64 // 放慢的倍率，0 代表原速
+	LoopTo      float64 // 大於 0 時將片段重複播放到這個長度
+}
+
+// planClipTiming 依策略讓畫面長度配合旁白，required 為 0 時維持精華片段的長度
+func planClipTiming(strategy string, media *VideoInfo, start, end, required float64) clipTiming {
+	length := end - start
+	if required <= 0 {
+		return clipTiming{Start: start, Length: length}
+	}
+	if required <= length {
+		return clipTiming{Start: start, Length: required}
 	}
 
-	for i, ch := range storyResponse.Chapters {
-		if ch.VideoIndex >= len(project.Videos) {
-			log.Printf("Warning: chapter %d video_index %d >= videos length %d, skipping",
-				i, ch.VideoIndex, len(project.Videos))
-			continue
+	freeze := func(timing clipTiming, remaining float64) clipTiming {
+		if remaining > 0.01 {
+			if timing.Filter != "" {
+				timing.Filter += ","
+			}
+			timing.Filter += fmt.Sprintf("tpad=stop_mode=clone:stop_duration=%.3f", remaining)
 		}
-		video := project.Videos[ch.VideoIndex]
-
-		// 如果沒有 highlights 或 highlight_index 超出範圍，使用整個影片
-		var startTime, endTime float64
-		if len(video.Highlights) > 0 && ch.HighlightIndex < len(video.Highlights) {
-			highlight := video.Highlights[ch.HighlightIndex]
-			startTime = highlight.Start
-			endTime = highlight.End
-		} else {
-			// 沒有 highlights，使用影片前 15 秒
-			startTime = 0
-			endTime = 15.0
-			if video.Duration > 0 && video.Duration < 15.0 {
-				endTime = video.Duration
+		return timing
+	}
+
+	switch strategy {
+	case timingFreeze:
+		return freeze(clipTiming{Start: start, Length: length}, required-length)
+	case timingLoop:
+		return clipTiming{Start: start, Length: length, LoopTo: required}
+	case timingSlow:
+		factor := math.Min(required/length, maxSlowFactor)
+		timing := clipTiming{Start: start, Length: length, Filter: fmt.Sprintf("setpts=%.4f*PTS", factor),
+			AudioFilter: fmt.Sprintf("atempo=%.4f", 1/factor), Stretch: factor}
+		return freeze(timing, required-length*factor)
+	default:
+		// 往後多取，到影片結尾時改往前取；整支影片都不夠長時剩下的停格
+		if media.Duration >= required {
+			if start+required > media.Duration {
+				start = media.Duration - required
 			}
-			log.Printf("Using full video duration for chapter %d: 0 to %.2f", i+1, endTime)
+			return clipTiming{Start: start, Length: required}
 		}
-
-		chapter := StoryChapter{
-			Index:     i + 1,
-			Narration: ch.Narration,
-			VideoID:   video.ID,
-			StartTime: startTime,
-			EndTime:   endTime,
-			Duration:  endTime - startTime,
+		if media.Duration > length {
+			return freeze(clipTiming{Start: 0, Length: media.Duration}, required-media.Duration)
 		}
-		story.Chapters = append(story.Chapters, chapter)
+		return freeze(clipTiming{Start: start, Length: length}, required-length)
 	}
+}
 
-	log.Printf("Generated story with %d chapters", len(story.Chapters))
-
-	// 如果主人有留言，生成狗狗的回應
-	if project.OwnerMessage != "" {
-		dogResponse, err := generateDogResponse(project, story)
-		if err != nil {
-			log.Printf("Warning: Failed to generate dog response: %v", err)
-			story.DogResponse = fmt.Sprintf("%s，我愛你！", ownerTitle) // 預設回應
-		} else {
-			story.DogResponse = dogResponse
-		}
-		story.OwnerMessage = project.OwnerMessage
+// loopClip 將片段重複播放到指定長度
+// 重新編碼而不是 -c copy：copy 只能停在關鍵格，長度會超過旁白需要的秒數，影響之後的轉場與字幕時間
+func loopClip(inputPath, outputPath string, duration float64) error {
+	cmd := exec.Command("ffmpeg",
+		"-stream_loop", "-1",
+		"-i", inputPath,
+		"-t", fmt.Sprintf("%.3f", duration),
+		"-c:v", "libx264",
+		"-preset", "fast",
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-ar", "44100",
+		"-y",
+		outputPath,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg loop error: %v, output: %s", err, string(output))
 	}
-
-	return story, nil
+	return nil
 }
 
-// 有ＡＩ
-func generateDogResponse(project *Project, story *Story) (string, error) {
-	log.Printf("Generating dog response for project %s", project.ID)
+// ============================================================================
+// Original Clip Audio
+// ============================================================================
 
-	// 收集影片描述（給模型一點上下文，不用太長）
-	videoDescriptions := []string{}
-	for i, chapter := range story.Chapters {
-		videoDescriptions = append(videoDescriptions, fmt.Sprintf("影片 %d: %s", i+1, chapter.Narration))
-	}
+// AudioMoment 原音以全音量播放的時段，例如叫毛小孩名字、開心的叫聲、家人的笑聲
+type AudioMoment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
 
-	// 根據關係設定稱呼
-	ownerTitle := project.OwnerRelationship
-	if ownerTitle == "" {
-		ownerTitle = "主人"
+// validateAudioMoments 驗證全音量時段
+func validateAudioMoments(moments []AudioMoment) error {
+	for _, moment := range moments {
+		if moment.Start < 0 || moment.End <= moment.Start {
+			return fmt.Errorf("invalid moment %.2f-%.2f: end must be after start", moment.Start, moment.End)
+		}
 	}
+	return nil
+}
 
-	// 根據模式設定不同的回應風格
-	var modeStyle, modeEmotion, modeExamples, modeNote string
-	switch project.StoryMode {
-	case "cute": // 可愛活潑
-		modeStyle = "活潑、親人、喜歡撒嬌的小狗"
-		modeEmotion = "開心、興奮、黏人，講話會不自覺帶點小撒嬌，但不會每一句都裝可愛。"
-		modeExamples = fmt.Sprintf(`「%s你說那麼多話，我都有聽到喔，我好喜歡你叫我名字的聲音。」
-「%s，我真的好喜歡黏在你身邊睡覺，你走開的時候，我都會偷偷起來找你。」`,
-			ownerTitle, ownerTitle)
-		modeNote = "可以偶爾用一點輕鬆的語氣詞（像是：嘿嘿、好啦），但不要整段都是疊字或太做作。"
-
-	case "funny": // 幽默風趣
-		modeStyle = "有點小聰明、會吐槽、但超級愛主人的諧星狗狗"
-		modeEmotion = "幽默、自嘲、會小小吐槽一下%s，但整體是溫暖、依賴的感覺。"
-		modeEmotion = fmt.Sprintf(modeEmotion, ownerTitle)
-		modeExamples = fmt.Sprintf(`「%s，你講那麼感人，我耳朵都要熱起來了啦，不過我真的超想你的。」
-「欸～%s，你哭的時候鼻子皺皺的，其實有點好笑…但我最喜歡你笑給我看的樣子。」`,
-			ownerTitle, ownerTitle)
-		modeNote = "可以有一點點玩笑和吐槽，但結尾要真心，讓人感覺到是溫柔的狗狗。"
-
-	default: // warm - 溫馨感人
-		// 感人模式：像小孩很認真在安慰最重要的大人
-		modeStyle = "溫柔、感性、特別在意%s心情、很怕你難過的小天使狗狗"
-		modeStyle = fmt.Sprintf(modeStyle, ownerTitle)
-		modeEmotion = "溫馨、感動、帶著深深的思念，像小朋友抱著大人的手，一邊說話一邊偷偷安慰對方。"
-		modeExamples = fmt.Sprintf(`「%s，我真的有一個一個記住你說的每一句話，你難過的時候，我也好想抱抱你。」
-「%s，你不要一直覺得自己一個人走，我會像以前一樣，在你看不到的地方跟著你走路、陪你回家、在門口等你。」`,
-			ownerTitle, ownerTitle)
-		modeNote = "請用具體畫面（等你回家、一起睡覺、聽你說話、跟著你走路…）來表達思念和感謝，而不是只重複『謝謝你』『我愛你』這些字。整體情緒要溫暖、讓人有被好好抱住的感覺。"
+// chapterOriginalVolume 這一段原音的音量，章節沒有設定時使用專案的 audio_mix.original_volume
+func chapterOriginalVolume(project *Project, chapterPos int) float64 {
+	if volume := project.Story.Chapters[chapterPos].OriginalVolume; volume != nil {
+		return *volume
 	}
+	return projectAudioMix(project).OriginalVolume
+}
 
-	// 建立 prompt：讓狗狗在結尾說一段「成熟、真心安慰媽媽」的告白
-	prompt := fmt.Sprintf(`你是一隻名叫「%s」的%s。你的「%s」剛剛對你說了一段很重要的話，裡面充滿了想念和感謝。
-	請你以一隻懂事、成熟、會心疼%s的狗狗身份，對 %s 說一段真心的結尾告白。這段話會出現在故事的最後，但內容本身不要提到「影片」「畫面」這些字，就當作你真的站在她面前，安安靜靜地把心裡話說完。
-
-	【你的角色設定】
-	- 你是：%s
-	- 語氣特徵：%s
-	- 特別注意：%s
-
-	【%s 對你說的話】（請真正參考裡面的情緒與重點）：
-	「%s」
-
-	【你們一起經歷過的一些回憶畫面】（只作為靈感參考，不用逐條回應）：
-	%s
-
-	請以「狗狗自己的第一人稱（我）」回應，創作一段給 %s 的結尾告白，遵守以下要求：
-
-	1. 語氣：
-	   - 用成熟、溫柔的大人語氣說話，好像一個長大後的孩子在安慰自己最重要的家人。
-	   - 可以帶一點撒嬌或俏皮，但整體要穩定、真誠、讓人覺得被好好抱住。
-	   - 根據當前模式維持風格：%s。
-
-	2. 內容：
-	   - 不要解釋或重複「你剛剛說了什麼」，直接表達對她的愛和感謝
-	   - 可以簡單提到 1 個具體回憶或感受
-	   - 表達你對她的愛、感激和陪伴
-
-	3. 字數與句子：
-	   - **重要！！！嚴格控制在 40-60 個中文字之間**
-	   - **絕對不能超過 60 字，也不能少於 40 字**
-	   - 只寫 2-3 句短句，不要寫長段落
-	   - 簡潔有力，每個字都要有意義
-	   - 如果超過 60 字，請刪減內容直到符合字數
-
-	4. 稱呼與限制：
-	   - 回應中要直接叫「%s」至少一次
-	   - 不要使用「汪汪」「嗚嗚」這類擬聲詞
-	   - 不要提到「影片」「畫面」等詞
-	   - **再次強調：總字數必須在 40-60 字之間，請務必計算字數**
-	   - 只回傳狗狗說的話，不要任何其他內容
-
-	【風格示意（只參考語氣，不要照抄）】：
-	%s
-
-	請根據以上資訊，寫出一段溫暖、真誠、像一位長大後的孩子對 %s 說的結尾告白。只回傳那一段對白文字，不要其他內容。`,
-		project.DogName,
-		project.DogBreed,
-		ownerTitle,
-		ownerTitle,
-		ownerTitle,
-		modeStyle,
-		modeEmotion,
-		modeNote,
-		ownerTitle,
-		project.OwnerMessage,
-		strings.Join(videoDescriptions, "\n"),
-		ownerTitle,
-		modeEmotion,
-		ownerTitle,
-		ownerTitle,
-		ownerTitle,
-		modeExamples,
-		ownerTitle)
-
-	log.Printf("Dog response prompt (mode=%s): %s", project.StoryMode, prompt)
-	log.Printf("ＡＬＬ prompt：", prompt)
-
-	requestBody := map[string]interface{}{
-		"contents": []map[string]interface{}{
-			{
-				"parts": []map[string]interface{}{
-					{"text": prompt},
-				},
-			},
-		},
-		"generationConfig": map[string]interface{}{
-			"temperature":     0.9,
-			"maxOutputTokens": 2000,
-		},
-		// 放寬安全過濾，避免寵物紀念內容被誤判為敏感內容
-		"safetySettings": []map[string]interface{}{
-			{"category": "HARM_CATEGORY_HARASSMENT", "threshold": "BLOCK_NONE"},
-			{"category": "HARM_CATEGORY_HATE_SPEECH", "threshold": "BLOCK_NONE"},
-			{"category": "HARM_CATEGORY_SEXUALLY_EXPLICIT", "threshold": "BLOCK_NONE"},
-			{"category": "HARM_CATEGORY_DANGEROUS_CONTENT", "threshold": "BLOCK_NONE"},
-		},
+// clipMoments 把原始影片的全音量時段換成片段內的秒數（放慢時跟著拉長），片段外的部分去掉
+func (t clipTiming) clipMoments(moments []AudioMoment, clipDuration float64) []AudioMoment {
+	stretch := math.Max(t.Stretch, 1)
+	result := []AudioMoment{}
+	for _, moment := range moments {
+		start := math.Max((moment.Start-t.Start)*stretch, 0)
+		end := math.Min((moment.End-t.Start)*stretch, clipDuration)
+		if end > start {
+			result = append(result, AudioMoment{Start: start, End: end})
+		}
 	}
+	return result
+}
 
-	jsonData, _ := json.Marshal(requestBody)
-	url := fmt.Sprintf("%s?key=%s", aiAPIEndpoint, aiAPIKey)
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	req.Header.Set("Content-Type", "application/json")
+// originalVolumeFilter 原音的音量：全音量時段為 1，其餘為設定的音量
+func originalVolumeFilter(volume float64, moments []AudioMoment) string {
+	if len(moments) == 0 {
+		return fmt.Sprintf("volume=%.3f", volume)
+	}
+	terms := make([]string, 0, len(moments))
+	for _, moment := range moments {
+		terms = append(terms, fmt.Sprintf("between(t,%.3f,%.3f)", moment.Start, moment.End))
+	}
+	return fmt.Sprintf("volume='if(%s,1,%.3f)':eval=frame", strings.Join(terms, "+"), volume)
+}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+// originalAudioFilters 第 i 段的原音在旁白出聲時被壓低，再與旁白混合成 [a%d]
+// 旁白已經整理成 [n%d]，原音來自片段本身（第 i 個輸入）
+func originalAudioFilters(mix AudioMix, clip renderedClip, i int) []string {
+	return []string{
+		fmt.Sprintf("[n%d]asplit=2[nv%d][nk%d]", i, i, i),
+		fmt.Sprintf("[%d:a]asetpts=PTS-STARTPTS,aresample=44100,aformat=channel_layouts=stereo,%s,apad,atrim=0:%.3f[o%d]",
+			i, originalVolumeFilter(clip.OriginalVolume, clip.FullVolume), clip.Duration, i),
+		fmt.Sprintf("[o%d][nk%d]%s[od%d]", i, i, mix.sidechainFilter(), i),
+		fmt.Sprintf("[nv%d][od%d]amix=inputs=2:duration=first:normalize=0[a%d]", i, i, i),
 	}
-	defer resp.Body.Close()
+}
 
-	bodyBytes, _ := io.ReadAll(resp.Body)
+// ============================================================================
+// Subtitle Cues
+// ============================================================================
 
-	// 印出完整 raw response 方便 debug 截斷問題
-	log.Printf("[DEBUG] Gemini raw response for dog_response (len=%d): %s", len(bodyBytes), string(bodyBytes))
+const maxSubtitleLines = 2
 
-	var apiResponse struct {
-		Candidates []struct {
-			Content struct {
-				Parts []struct {
-					Text string `json:"text"`
-				} `json:"parts"`
-			} `json:"content"`
-			FinishReason string `json:"finishReason"`
-		} `json:"candidates"`
-	}
+const (
+	subtitlesBurn = "burn" // 燒錄在畫面上
+	subtitlesSoft = "soft" // MP4 內可開關的 mov_text 字幕軌
+	subtitlesBoth = "both"
+	subtitlesNone = "none"
 
-	if err := json.Unmarshal(bodyBytes, &apiResponse); err != nil {
-		log.Printf("[ERROR] Failed to unmarshal Gemini response: %v", err)
-		return "", err
-	}
+	defaultSubtitleMode = subtitlesBurn
+)
 
-	if len(apiResponse.Candidates) == 0 || len(apiResponse.Candidates[0].Content.Parts) == 0 {
-		return "", fmt.Errorf("no response from AI")
+// normalizeSubtitleMode 驗證字幕模式，未知的值使用預設
+func normalizeSubtitleMode(mode string) string {
+	switch mode {
+	case subtitlesBurn, subtitlesSoft, subtitlesBoth, subtitlesNone:
+		return mode
 	}
+	return defaultSubtitleMode
+}
 
-	// 將所有 parts 的文字串接起來，避免只取第一個 part 導致內容被截斷
-	var sb strings.Builder
-	for _, part := range apiResponse.Candidates[0].Content.Parts {
-		sb.WriteString(part.Text)
+// SubtitleCue 一則字幕，時間為成品中的秒數
+type SubtitleCue struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"` // 已依輸出寬度斷行
+}
+
+// isSentenceEnd 句尾標點（英文句點後面要接空白或結尾，避免切到小數點）
+func isSentenceEnd(runes []rune, i int) bool {
+	switch runes[i] {
+	case '。', '！', '？', '!', '?', '…', '\n':
+		return true
+	case '.':
+		return i == len(runes)-1 || unicode.IsSpace(runes[i+1])
 	}
-	response := sb.String()
+	return false
+}
 
-	finishReason := apiResponse.Candidates[0].FinishReason
-	log.Printf("Raw dog response text (finishReason=%s, len=%d): %q", finishReason, len(response), response)
+// isClosingBracket 結尾的引號與括號（不含逗號等標點，逗號後面是下一句）
+func isClosingBracket(r rune) bool {
+	return strings.ContainsRune("」』）》〉】”’\")]", r)
+}
 
-	// 如果被截斷（MAX_TOKENS）或字數太少，給一個警告
-	if finishReason == "MAX_TOKENS" {
-		log.Printf("⚠️ WARNING: dog response was truncated by MAX_TOKENS!")
+// splitSentences 依句尾標點將對白切成句子，保留標點
+func splitSentences(text string) []string {
+	sentences := []string{}
+	runes := []rune(text)
+	start := 0
+	for i := range runes {
+		if !isSentenceEnd(runes, i) {
+			continue
+		}
+		// 連續的句尾標點與結尾引號、括號併在同一句
+		if i+1 < len(runes) && (isSentenceEnd(runes, i+1) || isClosingBracket(runes[i+1])) {
+			continue
+		}
+		if sentence := strings.TrimSpace(string(runes[start : i+1])); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start = i + 1
 	}
+	if sentence := strings.TrimSpace(string(runes[start:])); sentence != "" {
+		sentences = append(sentences, sentence)
+	}
+	return sentences
+}
 
-	response = strings.TrimSpace(response)
-	// 去掉可能包起來的引號或書名號
-	response = strings.Trim(response, "「」\"")
+// splitCueText 太長的句子再切成每段最多 maxLines 行，優先在逗號後面切
+func splitCueText(sentence string, lang *LanguageProfile, wrapWidth int) []string {
+	limit := wrapWidth * maxSubtitleLines
+	tokens := []string{}
+	joiner := ""
+	if lang.CountWords {
+		tokens = strings.Fields(sentence)
+		joiner = " "
+	} else {
+		for _, r := range sentence {
+			tokens = append(tokens, string(r))
+		}
+	}
 
-	// 檢查長度與結尾，避免看起來像「講到一半就被切斷」
-	runeCount := len([]rune(response))
-	log.Printf("Generated dog response (cleaned, runes=%d): %s", runeCount, response)
-	
-	// 強制限制字數在 40-60 字之間
-	if runeCount > 60 {
-		log.Printf("⚠️ Dog response too long (%d chars), truncating to 60 chars", runeCount)
-		runes := []rune(response)
-		// 截取前 60 字
-		response = string(runes[:60])
-		// 找最後一個句號、逗號或感嘆號的位置，在那裡截斷比較自然
-		lastPunc := -1
-		responseRunes := []rune(response)
-		for i := len(responseRunes) - 1; i >= 40; i-- {
-			if responseRunes[i] == '。' || responseRunes[i] == '，' || responseRunes[i] == '！' {
-				lastPunc = i + 1
-				break
+	pieces := []string{}
+	current := []string{}
+	width := 0
+	lastBreak := -1
+	for _, token := range tokens {
+		tokenWidth := len([]rune(token)) + len(joiner)
+		if width+tokenWidth > limit && len(current) > 0 {
+			// 標點不要放在下一段的開頭
+			if runes := []rune(token); !isClosingPunctuation(runes[0]) {
+				cut := len(current)
+				if lastBreak >= len(current)/3 {
+					cut = lastBreak + 1
+				}
+				pieces = append(pieces, strings.Join(current[:cut], joiner))
+				current = append([]string{}, current[cut:]...)
+				width = 0
+				for _, t := range current {
+					width += len([]rune(t)) + len(joiner)
+				}
+				lastBreak = -1
 			}
 		}
-		if lastPunc > 40 {
-			response = string(responseRunes[:lastPunc])
+		current = append(current, token)
+		width += tokenWidth
+		if runes := []rune(token); isBreakPunctuation(runes[len(runes)-1]) {
+			lastBreak = len(current) - 1
 		}
-		runeCount = len([]rune(response))
-		log.Printf("✂️ Truncated to %d chars: %s", runeCount, response)
-	} else if runeCount < 40 {
-		log.Printf("⚠️ Dog response too short (%d chars), using fallback", runeCount)
-		response = fmt.Sprintf("%s，我也最愛最愛你了！每天和你在一起的時光，都是我最幸福的回憶。", ownerTitle)
-		runeCount = len([]rune(response))
 	}
-
-	// 1) 如果回應太短（少於 120 個中文字），直接使用預設的感人結尾
-	// if runeCount < 120 {
-	// 	log.Printf("⚠️ Dog response too short (%d runes), using fallback", runeCount)
-	// 	response = fmt.Sprintf("%s，謝謝你給我這麼多的愛，每一個和你在一起的日子，都是我最珍貴的回憶。你抱著我的時候，我覺得全世界都是溫暖的。就算現在你看不到我，我也會一直守在你身邊，陪你走過每一個早晨和夜晚。不要難過，因為我從來沒有離開過你。%s，我永遠愛你。", ownerTitle, ownerTitle)
-	// 	return response, nil
-	// }
-
-	// 2) 確保結尾有標點符號（但不要再加長文字，避免超過字數限制）
-	if !strings.HasSuffix(response, "。") && !strings.HasSuffix(response, "！") && !strings.HasSuffix(response, "？") {
-		response = response + "。"
+	if len(current) > 0 {
+		pieces = append(pieces, strings.Join(current, joiner))
 	}
-
-	// 最終檢查字數
-	finalRuneCount := len([]rune(response))
-	log.Printf("Final dog response (runes=%d): %s", finalRuneCount, response)
-
-	return response, nil
+	return pieces
 }
 
-func generateTTS(project *Project, chapterIndex int) error {
-	chapter := &project.Story.Chapters[chapterIndex]
-
-	log.Printf("Generating TTS for chapter %d: %s", chapterIndex+1, chapter.Narration)
-
-	// 使用 Google Cloud Text-to-Speech API
-	// API endpoint: https://texttospeech.googleapis.com/v1/text:synthesize
+// cueWeight 估計唸這段文字需要的相對時間
+func cueWeight(text string, lang *LanguageProfile) float64 {
+	return math.Max(1, float64(textLength(text, lang)))
+}
 
-	requestBody := map[string]interface{}{
-		"input": map[string]string{
-			"text": chapter.Narration,
-		},
-		"voice": map[string]interface{}{
-			"languageCode": "zh-TW",
-			"name":         "cmn-TW-Wavenet-A", // 台灣中文女聲
-			"ssmlGender":   "FEMALE",
-		},
-		"audioConfig": map[string]interface{}{
-			"audioEncoding": "MP3",
-			"speakingRate":  0.95, // 稍微慢一點，更溫暖
-			"pitch":         0.0,
-		},
+// distributeCues 依文字長度把 start～end 分給每一段
+func distributeCues(pieces []string, lang *LanguageProfile, wrapWidth int, start, end float64) []SubtitleCue {
+	total := 0.0
+	for _, piece := range pieces {
+		total += cueWeight(piece, lang)
 	}
-
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return fmt.Errorf("failed to marshal TTS request: %v", err)
+	cues := make([]SubtitleCue, 0, len(pieces))
+	current := start
+	for _, piece := range pieces {
+		next := current + (end-start)*cueWeight(piece, lang)/total
+		cues = append(cues, SubtitleCue{Start: current, End: next, Text: wrapTextForLanguage(piece, lang, wrapWidth)})
+		current = next
 	}
+	return cues
+}
 
-	// 使用與 Gemini 相同的 API Key
-	url := fmt.Sprintf("https://texttospeech.googleapis.com/v1/text:synthesize?key=%s", aiAPIKey)
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create TTS request: %v", err)
+// chapterSubtitleCues 一個章節的字幕：有 TTS 的句子時間點時依句子對齊，否則依字數比例分配
+func chapterSubtitleCues(chapter StoryChapter, lang *LanguageProfile, wrapWidth int, start, end float64) []SubtitleCue {
+	sentences := splitSentences(chapter.Narration)
+	if len(sentences) == 0 || end <= start {
+		return nil
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	// 句子的開始時間（相對於旁白開頭），數量對不上時不使用
+	bounds := []float64{}
+	if chapter.AudioPath != "" && len(chapter.SentenceTimes) == len(sentences) {
+		for _, t := range chapter.SentenceTimes {
+			bounds = append(bounds, math.Min(start+t, end))
+		}
+		bounds = append(bounds, end)
+	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send TTS request: %v", err)
+	cues := []SubtitleCue{}
+	if len(bounds) == 0 {
+		pieces := []string{}
+		for _, sentence := range sentences {
+			pieces = append(pieces, splitCueText(sentence, lang, wrapWidth)...)
+		}
+		return distributeCues(pieces, lang, wrapWidth, start, end)
 	}
-	defer resp.Body.Close()
+	for i, sentence := range sentences {
+		if bounds[i+1] <= bounds[i] {
+			continue
+		}
+		cues = append(cues, distributeCues(splitCueText(sentence, lang, wrapWidth), lang, wrapWidth, bounds[i], bounds[i+1])...)
+	}
+	return cues
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("TTS API error %d: %s", resp.StatusCode, string(body))
+// projectSubtitleCues 依合成時記錄的時間軸產生整支影片的字幕
+func projectSubtitleCues(project *Project, format *OutputFormat) []SubtitleCue {
+	lang := getLanguageProfile(project.Language)
+	wrapWidth := format.wrapWidth(lang.SubtitleWrapWidth)
+
+	cues := []SubtitleCue{}
+	for i, chapter := range project.Story.Chapters {
+		if chapter.TimelineEnd <= chapter.TimelineStart {
+			continue
+		}
+		// 字幕跟著旁白出現；沒有旁白時顯示到下一段開始
+		start := chapter.NarrationStart
+		end := chapter.TimelineEnd
+		if chapter.AudioPath != "" && chapter.Duration > 0 && start+chapter.Duration < end {
+			end = start + chapter.Duration
+		}
+		for _, next := range project.Story.Chapters[i+1:] {
+			if next.TimelineEnd > next.TimelineStart {
+				end = math.Min(end, next.NarrationStart)
+				break
+			}
+		}
+		cues = append(cues, chapterSubtitleCues(chapter, lang, wrapWidth, start, end)...)
 	}
 
-	// 解析回應
-	var ttsResponse struct {
-		AudioContent string `json:"audioContent"` // Base64 encoded MP3
+	// 結尾唸出的主人的話與毛小孩的回應，時間從結尾片段開始（章節部分結束）算起
+	for _, speech := range endingSpeeches(project.Story) {
+		start := project.Story.Duration + speech.Start
+		spoken := StoryChapter{Narration: speech.Text, AudioPath: speech.AudioPath, SentenceTimes: speech.SentenceTimes}
+		cues = append(cues, chapterSubtitleCues(spoken, lang, wrapWidth, start, start+speech.Duration)...)
 	}
+	return cues
+}
 
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read TTS response: %v", err)
+// burnedSubtitleCues 燒錄在畫面上的字幕：結尾卡片上已經畫出的文字不再重複
+// 每個版面都會畫出毛小孩的回應，主人的話只有 message 版面會畫，其他版面主人說話時仍然顯示字幕
+func burnedSubtitleCues(project *Project, format *OutputFormat) []SubtitleCue {
+	drawn := []*EndingSpeech{project.Story.PetSpeech}
+	if projectEndingTemplate(project).ShowsMessage {
+		drawn = append(drawn, project.Story.OwnerSpeech)
 	}
 
-	if err := json.Unmarshal(bodyBytes, &ttsResponse); err != nil {
-		return fmt.Errorf("failed to parse TTS response: %v", err)
+	cues := []SubtitleCue{}
+	for _, cue := range projectSubtitleCues(project, format) {
+		onCard := false
+		for _, speech := range drawn {
+			if speech == nil {
+				continue
+			}
+			start := project.Story.Duration + speech.Start
+			if cue.Start >= start-0.01 && cue.Start < start+speech.Duration {
+				onCard = true
+			}
+		}
+		if !onCard {
+			cues = append(cues, cue)
+		}
 	}
+	return cues
+}
 
-	if ttsResponse.AudioContent == "" {
-		return fmt.Errorf("no audio content in TTS response")
+// narrationSSML 在每一句前面加上 mark，TTS 會回傳每一句開始的時間
+func narrationSSML(sentences []string) string {
+	var b strings.Builder
+	b.WriteString("<speak>")
+	for i, sentence := range sentences {
+		fmt.Fprintf(&b, `<mark name="s%d"/>%s `, i, html.EscapeString(sentence))
 	}
+	b.WriteString("</speak>")
+	return b.String()
+}
 
-	// 解碼 Base64 音訊
-	audioData, err := base64.StdEncoding.DecodeString(ttsResponse.AudioContent)
-	if err != nil {
-		return fmt.Errorf("failed to decode audio: %v", err)
-	}
+// ============================================================================
+// Output Formats
+// ============================================================================
 
-	// 儲存音訊檔案
-	outputDir := filepath.Join(storagePath, "projects", project.ID, "audio")
-	os.MkdirAll(outputDir, 0755)
+const defaultOutputFormat = "16:9"
+
+// OutputFormat 輸出影片的比例與版面設定
+type OutputFormat struct {
+	ID               string  `json:"id"`
+	Name             string  `json:"name"`
+	Width            int     `json:"width"`
+	Height           int     `json:"height"`
+	SubtitleFontSize int     `json:"subtitle_font_size"` // libass 字級（以 288 高的畫面為基準）
+	SubtitleMarginV  int     `json:"subtitle_margin_v"`  // 字幕離底部的距離，直式影片要避開社群平台的按鈕
+	EndingFontSize   int     `json:"ending_font_size"`   // 結尾卡片的字體大小（像素）
+	WrapScale        float64 `json:"wrap_scale"`         // 每行字數相對於 16:9 的比例
+}
 
-	audioPath := filepath.Join(outputDir, fmt.Sprintf("chapter_%d.mp3", chapterIndex+1))
-	if err := os.WriteFile(audioPath, audioData, 0644); err != nil {
-		return fmt.Errorf("failed to save audio: %v", err)
+var outputFormats = map[string]*OutputFormat{
+	"16:9": {ID: "16:9", Name: "橫式 (YouTube)", Width: 1920, Height: 1080, SubtitleFontSize: 16, SubtitleMarginV: 30, EndingFontSize: 40, WrapScale: 1.0},
+	"9:16": {ID: "9:16", Name: "直式 (Reels / TikTok)", Width: 1080, Height: 1920, SubtitleFontSize: 9, SubtitleMarginV: 60, EndingFontSize: 48, WrapScale: 0.6},
+	"1:1":  {ID: "1:1", Name: "正方形 (LINE / Instagram)", Width: 1080, Height: 1080, SubtitleFontSize: 14, SubtitleMarginV: 30, EndingFontSize: 40, WrapScale: 0.6},
+	"4:5":  {ID: "4:5", Name: "直式 4:5 (Instagram 貼文)", Width: 1080, Height: 1350, SubtitleFontSize: 12, SubtitleMarginV: 40, EndingFontSize: 44, WrapScale: 0.6},
+}
+
+// outputFormatOrder 列出格式時的順序
+var outputFormatOrder = []string{"16:9", "9:16", "1:1", "4:5"}
+
+// getOutputFormat 取得輸出格式，未知的值使用 16:9
+func getOutputFormat(id string) *OutputFormat {
+	if format, ok := outputFormats[id]; ok {
+		return format
 	}
+	return outputFormats[defaultOutputFormat]
+}
 
-	// 取得音訊時長
-	duration := getAudioDuration(audioPath)
+// normalizeOutputFormats 驗證並去除重複的輸出格式，空白時使用 16:9
+func normalizeOutputFormats(ids []string) ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		if _, ok := outputFormats[id]; !ok {
+			return nil, fmt.Errorf("unknown output format %q", id)
+		}
+		seen[id] = true
+		result = append(result, id)
+	}
+	if len(result) == 0 {
+		result = append(result, defaultOutputFormat)
+	}
+	return result, nil
+}
 
-	// 更新章節資訊
-	projectsMutex.Lock()
-	project.Story.Chapters[chapterIndex].AudioPath = audioPath
-	project.Story.Chapters[chapterIndex].Duration = duration
-	projectsMutex.Unlock()
+// projectOutputFormats 專案要輸出的格式，第一個為主要格式
+func projectOutputFormats(project *Project) []string {
+	if len(project.OutputFormats) == 0 {
+		return []string{defaultOutputFormat}
+	}
+	return project.OutputFormats
+}
 
-	log.Printf("Generated TTS audio for chapter %d (duration: %.2fs)", chapterIndex+1, duration)
-	return nil
+// fileKey 用在檔名的格式代碼，例如 9:16 → 9x16
+func (f *OutputFormat) fileKey() string {
+	return strings.ReplaceAll(f.ID, ":", "x")
 }
 
-func getAudioDuration(audioPath string) float64 {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-show_entries", "format=duration",
-		"-of", "default=noprint_wrappers=1:nokey=1",
-		audioPath,
-	)
+// wrapWidth 依畫面寬度調整每行字數
+func (f *OutputFormat) wrapWidth(base int) int {
+	width := int(float64(base) * f.WrapScale)
+	if width < 8 {
+		width = 8
+	}
+	return width
+}
 
-	output, err := cmd.Output()
-	if err != nil {
-		return 0
+// finalVideoName 主要格式沿用 final.mp4，其他格式加上比例
+func finalVideoName(project *Project, format *OutputFormat) string {
+	if format.ID == projectOutputFormats(project)[0] {
+		return "final.mp4"
 	}
+	return fmt.Sprintf("final_%s.mp4", format.fileKey())
+}
 
-	duration := 0.0
-	fmt.Sscanf(string(output), "%f", &duration)
-	return duration
+// listOutputFormats 列出支援的輸出格式
+func listOutputFormats() []*OutputFormat {
+	list := make([]*OutputFormat, 0, len(outputFormatOrder))
+	for _, id := range outputFormatOrder {
+		list = append(list, outputFormats[id])
+	}
+	return list
 }
 
-func compositeVideo(project *Project) error {
-	log.Printf("Compositing final video for project %s (with transitions, subtitles and music)", project.ID)
+// ============================================================================
+// Typography
+// ============================================================================
 
-	if len(project.Story.Chapters) == 0 {
-		return fmt.Errorf("no chapters to composite")
-	}
+// 文字外框樣式
+const (
+	textStyleOutline = "outline" // 文字外框（預設）
+	textStyleBox     = "box"     // 文字後方加半透明底框
+	textStyleNone    = "none"    // 只有文字
+)
 
-	outputDir := filepath.Join(storagePath, "projects", project.ID)
+// TypographySettings 使用者設定的結尾卡片與字幕文字樣式，沒有設定的欄位使用預設值
+// outline_width、box_opacity 為指標，傳 0 就是 0（不要外框、透明底框）
+type TypographySettings struct {
+	FontFamily   string   `json:"font_family,omitempty"`   // 字體名稱，空白時使用語言預設（例如 Noto Sans CJK TC）
+	FontScale    float64  `json:"font_scale,omitempty"`    // 字級倍率 0.5～2.0，預設 1.0
+	Color        string   `json:"color,omitempty"`         // 文字顏色 #RRGGBB，預設白色
+	Style        string   `json:"style,omitempty"`         // outline(預設), box, none
+	OutlineColor string   `json:"outline_color,omitempty"` // 外框顏色，預設黑色
+	OutlineWidth *float64 `json:"outline_width,omitempty"` // 外框粗細（以 288 高的畫面為基準）0～5，預設 1.0
+	BoxColor     string   `json:"box_color,omitempty"`     // 底框顏色，預設黑色
+	BoxOpacity   *float64 `json:"box_opacity,omitempty"`   // 底框不透明度 0～1，預設 0.6
+}
 
-	// Step 1: 生成帶轉場效果的影片片段（移除原始音訊，只保留 TTS）
-	log.Printf("Step 1: Creating video segments with transitions and TTS audio")
-	videoWithTTSPath := filepath.Join(outputDir, "video_with_tts.mp4")
-	if err := createVideoWithTransitionsAndTTS(project, videoWithTTSPath); err != nil {
-		return fmt.Errorf("failed to create video with transitions: %v", err)
-	}
+// Typography 實際使用的文字樣式（TypographySettings 補上預設值）
+type Typography struct {
+	FontFamily   string  `json:"font_family"`
+	FontScale    float64 `json:"font_scale"`
+	Color        string  `json:"color"`
+	Style        string  `json:"style"`
+	OutlineColor string  `json:"outline_color"`
+	OutlineWidth float64 `json:"outline_width"`
+	BoxColor     string  `json:"box_color"`
+	BoxOpacity   float64 `json:"box_opacity"`
+}
 
-	// Step 2: 如果有結尾圖片和狗狗回應，添加結尾片段
-	videoWithEndingPath := videoWithTTSPath
-	log.Printf("📸 EndingImage check: EndingImage='%s', DogResponse='%s', OwnerMessage='%s'",
-		project.EndingImage, project.Story.DogResponse, project.OwnerMessage)
+const (
+	defaultTextColor    = "#FFFFFF"
+	defaultOutlineColor = "#000000"
+	defaultOutlineWidth = 1.0
+	defaultBoxColor     = "#000000"
+	defaultBoxOpacity   = 0.6
+)
 
-	if project.EndingImage != "" {
-		// 如果有 OwnerMessage 但 DogResponse 還是預設的簡短回應，重新生成
-		if project.OwnerMessage != "" && (project.Story.DogResponse == "" || project.Story.DogResponse == "主人，我愛你！") {
-			log.Printf("🤖 Regenerating dog response based on owner message")
-			dogResponse, err := generateDogResponse(project, project.Story)
-			if err != nil {
-				log.Printf("⚠️ Failed to generate dog response: %v, using default", err)
-				ownerTitle := project.OwnerRelationship
-				if ownerTitle == "" {
-					ownerTitle = "主人"
-				}
-				project.Story.DogResponse = fmt.Sprintf("%s，我也永遠愛你！每天和你在一起，是我最幸福的時光。", ownerTitle)
-			} else {
-				project.Story.DogResponse = dogResponse
-				log.Printf("✅ Generated dog response: %s", dogResponse)
-			}
-			project.Story.OwnerMessage = project.OwnerMessage
-		} else if project.Story.DogResponse == "" {
-			log.Printf("⚠️ No DogResponse, using default response for ending")
-			ownerTitle := project.OwnerRelationship
-			if ownerTitle == "" {
-				ownerTitle = "主人"
-			}
-			project.Story.DogResponse = fmt.Sprintf("%s，我愛你！每天和你在一起，是我最幸福的時光～", ownerTitle)
+// normalizeTypography 驗證使用者傳入的文字樣式，nil 代表沿用預設
+func normalizeTypography(t *TypographySettings) (*TypographySettings, error) {
+	if t == nil {
+		return nil, nil
+	}
+	result := *t
+	result.FontFamily = strings.TrimSpace(result.FontFamily)
+	if strings.ContainsAny(result.FontFamily, ",:'\\") {
+		return nil, fmt.Errorf("invalid font family %q", result.FontFamily)
+	}
+	for _, value := range []string{result.Color, result.OutlineColor, result.BoxColor} {
+		if value == "" {
+			continue
 		}
-
-		log.Printf("Step 2: Adding ending image with dog response")
-		videoWithEndingPath = filepath.Join(outputDir, "video_with_ending.mp4")
-		if err := addEndingImage(project, videoWithTTSPath, videoWithEndingPath); err != nil {
-			log.Printf("❌ Failed to add ending image: %v, continuing without it", err)
-			videoWithEndingPath = videoWithTTSPath
-		} else {
-			log.Printf("✅ Ending image added successfully")
+		if _, err := parseHexColor(value); err != nil {
+			return nil, err
 		}
-	} else {
-		log.Printf("Step 2: Skipping ending image (EndingImage path is empty)")
 	}
-
-	// Step 3: 加入字幕
-	log.Printf("Step 3: Adding subtitles")
-	subtitledVideoPath := filepath.Join(outputDir, "subtitled_video.mp4")
-	if err := addSubtitles(project, videoWithEndingPath, subtitledVideoPath); err != nil {
-		log.Printf("Warning: Failed to add subtitles: %v, continuing without subtitles", err)
-		subtitledVideoPath = videoWithEndingPath
+	switch result.Style {
+	case "", textStyleOutline, textStyleBox, textStyleNone:
+	default:
+		return nil, fmt.Errorf("unknown text style %q", result.Style)
 	}
-
-	// Step 4: 加入背景音樂（100% 音量）
-	log.Printf("Step 4: Adding background music")
-	finalVideoPath := filepath.Join(outputDir, "final.mp4")
-	if err := addBackgroundMusic(project, subtitledVideoPath, finalVideoPath); err != nil {
-		log.Printf("Warning: Failed to add background music: %v, using version without music", err)
-		os.Rename(subtitledVideoPath, finalVideoPath)
-	} else {
-		os.Remove(subtitledVideoPath)
+	if result.FontScale != 0 && (result.FontScale < 0.5 || result.FontScale > 2) {
+		return nil, fmt.Errorf("font_scale must be between 0.5 and 2.0")
+	}
+	if !floatInRange(result.OutlineWidth, 0, 5) {
+		return nil, fmt.Errorf("outline_width must be between 0 and 5")
 	}
+	if !floatInRange(result.BoxOpacity, 0, 1) {
+		return nil, fmt.Errorf("box_opacity must be between 0 and 1")
+	}
+	return &result, nil
+}
 
-	// 清理中間檔案
-	os.Remove(videoWithTTSPath)
-	if videoWithEndingPath != videoWithTTSPath {
-		os.Remove(videoWithEndingPath)
+// projectTypography 專案實際使用的文字樣式（已補上預設值）
+func projectTypography(project *Project) Typography {
+	settings := TypographySettings{}
+	if project.Typography != nil {
+		settings = *project.Typography
+	}
+	typo := Typography{
+		FontFamily:   settings.FontFamily,
+		FontScale:    settings.FontScale,
+		Color:        settings.Color,
+		Style:        settings.Style,
+		OutlineColor: settings.OutlineColor,
+		OutlineWidth: floatOrDefault(settings.OutlineWidth, defaultOutlineWidth),
+		BoxColor:     settings.BoxColor,
+		BoxOpacity:   floatOrDefault(settings.BoxOpacity, defaultBoxOpacity),
+	}
+	if typo.FontFamily == "" {
+		typo.FontFamily = getLanguageProfile(project.Language).SubtitleFont
+	}
+	if typo.FontScale == 0 {
+		typo.FontScale = 1.0
+	}
+	if typo.Style == "" {
+		typo.Style = textStyleOutline
 	}
+	if typo.Color == "" {
+		typo.Color = defaultTextColor
+	}
+	if typo.OutlineColor == "" {
+		typo.OutlineColor = defaultOutlineColor
+	}
+	if typo.BoxColor == "" {
+		typo.BoxColor = defaultBoxColor
+	}
+	return typo
+}
 
-	projectsMutex.Lock()
-	project.FinalVideo = finalVideoPath
-	projectsMutex.Unlock()
+// assStyle 產生 ASS 的 Style 行，fontSize 與 marginV 以 288 高為基準
+func (t Typography) assStyle(format *OutputFormat, fontSize, marginV int) string {
+	scale := float64(format.Height) / 288
+	// BorderStyle 1 為外框加陰影，3 為不透明底框（底框使用 OutlineColour）
+	borderStyle, outlineColour, outline, shadow := 1, assColor(t.OutlineColor, 1), t.OutlineWidth*scale, scale
+	switch t.Style {
+	case textStyleBox:
+		borderStyle, outlineColour, outline, shadow = 3, assColor(t.BoxColor, t.BoxOpacity), 4*scale, 0
+	case textStyleNone:
+		outline, shadow = 0, 0
+	}
+	return fmt.Sprintf("Style: Default,%s,%d,%s,&H000000FF,%s,&H80000000,0,0,0,0,100,100,0,0,%d,%.1f,%.1f,2,%d,%d,%d,1",
+		t.FontFamily, int(float64(fontSize)*t.FontScale*scale), assColor(t.Color, 1), outlineColour,
+		borderStyle, outline, shadow, int(20*scale), int(20*scale), int(float64(marginV)*scale))
+}
 
-	log.Printf("✅ Created final video with all effects for project %s", project.ID)
-	return nil
+// assColor #RRGGBB 轉成 ASS 的 &HAABBGGRR（alpha 00 為不透明）
+func assColor(value string, opacity float64) string {
+	c, err := parseHexColor(value)
+	if err != nil {
+		c = color.RGBA{R: 255, G: 255, B: 255}
+	}
+	alpha := int(math.Round((1 - opacity) * 255))
+	return fmt.Sprintf("&H%02X%02X%02X%02X", alpha, c.B, c.G, c.R)
 }
 
-// createVideoWithTransitionsAndTTS - 創建帶轉場效果和 TTS 的影片（移除原始音訊）
-func createVideoWithTransitionsAndTTS(project *Project, outputPath string) error {
-	outputDir := filepath.Dir(outputPath)
+var (
+	fontFileCache      = make(map[string]string)
+	fontFileCacheMutex sync.Mutex
+)
 
-	log.Printf("🎬 Creating video segments with fade transitions and TTS audio")
+// resolveFontFile 找出字體檔，依序嘗試：
+// 1. FONTS_PATH 內附的字體（檔名與字體名稱相符）
+// 2. fontconfig (fc-match)，並要求支援該語言的字元，避免中文變成方塊
+// 3. 語言設定中的候選路徑（macOS 開發環境）
+// 都找不到時回傳空字串
+func resolveFontFile(family string, lang *LanguageProfile) string {
+	key := family + "|" + lang.Code
+	fontFileCacheMutex.Lock()
+	defer fontFileCacheMutex.Unlock()
+	if fontFile, ok := fontFileCache[key]; ok {
+		return fontFile
+	}
+
+	fontFile := findBundledFont(family)
+	if fontFile == "" {
+		fontFile = fcMatchFont(family, lang)
+	}
+	if fontFile == "" {
+		for _, candidate := range lang.FontFiles {
+			if _, err := os.Stat(candidate); err == nil {
+				fontFile = candidate
+				break
+			}
+		}
+	}
+	fontFileCache[key] = fontFile
+	return fontFile
+}
 
-	// 統一目標尺寸為 16:9 (1920x1080)
-	targetWidth := 1920
-	targetHeight := 1080
-	log.Printf("📐 Target resolution: %dx%d (16:9)", targetWidth, targetHeight)
+// fontNameKey 比對字體名稱用，忽略大小寫、空白與連字號
+func fontNameKey(name string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "", "_", "").Replace(name))
+}
 
-	// 處理每個章節
-	processedSegments := []string{}
-	// filterComplex := []string{} // Unused
-	audioInputs := []string{}
+// findBundledFont 在 FONTS_PATH 中尋找字體檔，檔名慣例為「字體名稱-粗細.副檔名」
+// 先找名稱完全相同的檔案（NotoSansCJKtc-Regular.otf），
+// 再逐步去掉名稱最後的字（Noto Sans CJK TC → Noto Sans CJK），對應 NotoSansCJK-Regular.ttc 這類合輯
+func findBundledFont(family string) string {
+	files := []string{}
+	filepath.WalkDir(fontsPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".ttf", ".otf", ".ttc", ".otc":
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
 
-	for i, chapter := range project.Story.Chapters {
-		// 找到對應的影片
-		var videoPath string
-		for _, video := range project.Videos {
-			if video.ID == chapter.VideoID {
-				videoPath = video.Path
-				break
+	words := strings.Fields(family)
+	for n := len(words); n >= 2 || (n == 1 && len(words) == 1); n-- {
+		want := fontNameKey(strings.Join(words[:n], " "))
+		// 同名字體有多種粗細時優先使用 Regular
+		var match string
+		for _, file := range files {
+			name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+			weight := ""
+			if i := strings.LastIndex(name, "-"); i > 0 {
+				name, weight = name[:i], name[i+1:]
+			}
+			if fontNameKey(name) != want {
+				continue
+			}
+			if match == "" || strings.EqualFold(weight, "Regular") {
+				match = file
 			}
 		}
-
-		if videoPath == "" {
-			log.Printf("⚠️ Warning: video not found for chapter %d", i+1)
-			continue
+		if match != "" {
+			return match
 		}
+	}
+	return ""
+}
 
-		// 獲取原始影片尺寸
-		origWidth, origHeight := getVideoResolution(videoPath)
-		log.Printf("📹 Chapter %d: original size=%dx%d, duration=%.2f-%.2f",
-			chapter.Index, origWidth, origHeight, chapter.StartTime, chapter.EndTime)
+// fcMatchFont 透過 fontconfig 找字體，沒有安裝 fc-match 時回傳空字串
+func fcMatchFont(family string, lang *LanguageProfile) string {
+	pattern := fmt.Sprintf("%s:lang=%s", family, strings.ToLower(lang.Code))
+	output, err := exec.Command("fc-match", "-f", "%{file}", pattern).Output()
+	if err != nil {
+		return ""
+	}
+	fontFile := strings.TrimSpace(string(output))
+	if _, err := os.Stat(fontFile); err != nil {
+		return ""
+	}
+	return fontFile
+}
 
-		// 剪切影片片段（移除音訊）
-		segmentPath := filepath.Join(outputDir, fmt.Sprintf("segment_%d.mp4", chapter.Index))
+// subtitleFontsDir 燒錄字幕時讓 libass 一併載入 FONTS_PATH 內附的字體
+func subtitleFontsDir() string {
+	if info, err := os.Stat(fontsPath); err == nil && info.IsDir() {
+		return fmt.Sprintf(":fontsdir='%s'", escapeFilterPath(fontsPath))
+	}
+	return ""
+}
 
-		// 計算淡入淡出
-		fadeDuration := 0.5
-		videoDuration := chapter.EndTime - chapter.StartTime
+// logFontResolution 啟動時列出各語言使用的字體，方便確認容器內有沒有中文字體
+func logFontResolution() {
+	for _, code := range []string{"zh-TW", "zh-CN", "en", "ja"} {
+		lang := languageProfiles[code]
+		if fontFile := resolveFontFile(lang.SubtitleFont, lang); fontFile != "" {
+			log.Printf("🔤 Font for %s: %s → %s", code, lang.SubtitleFont, fontFile)
+		} else {
+			log.Printf("⚠️ No font file found for %s (%s), text may not render correctly", code, lang.SubtitleFont)
+		}
+	}
+}
 
-		// 組合濾鏡：縮放到 16:9 + 淡入淡出
-		// scale 保持寬高比，pad 填充黑邊到目標尺寸
-		videoFilter := fmt.Sprintf(
-			"scale=%d:%d:force_original_aspect_ratio=decrease,"+
-				"pad=%d:%d:(ow-iw)/2:(oh-ih)/2:color=black,"+
-				"fade=t=in:st=0:d=%.2f,fade=t=out:st=%.2f:d=%.2f",
-			targetWidth, targetHeight,
-			targetWidth, targetHeight,
-			fadeDuration, videoDuration-fadeDuration, fadeDuration)
+// ============================================================================
+// Ending Cards
+// ============================================================================
 
-		log.Printf("🎨 Chapter %d filter: %s", chapter.Index, videoFilter)
+const (
+	defaultEndingTemplate = "classic"
+	defaultEndingDuration = 15.0
+	minEndingDuration     = 5.0
+	maxEndingDuration     = 30.0
+	endingTextDelay       = 0.6 // 文字層在背景出現後多久開始淡入
+	endingTextFade        = 1.2
+	endingVoiceLeadIn     = 1.0 // 結尾語音在卡片出現後多久開始
+	endingVoicePause      = 1.2 // 主人說完到毛小孩回應之間的停頓
+	endingVoiceTail       = 2.5 // 語音結束後卡片停留的秒數
+)
 
-		cmd := exec.Command("ffmpeg",
-			"-i", videoPath,
-			"-ss", fmt.Sprintf("%.2f", chapter.StartTime),
-			"-to", fmt.Sprintf("%.2f", chapter.EndTime),
-			"-vf", videoFilter,
-			"-an", // 移除音訊
-			"-c:v", "libx264",
-			"-preset", "fast",
-			"-pix_fmt", "yuv420p",
-			"-y",
-			segmentPath,
-		)
+// 結尾卡片的文字層，分開淡入：有語音時主人的話與毛小孩的回應在開始說話時才出現
+const (
+	endingLayerStatic = iota // 標題、名字、日期
+	endingLayerOwner         // 主人的話
+	endingLayerPet           // 毛小孩的回應與署名
+	endingLayerCount
+)
 
-		if output, err := cmd.CombinedOutput(); err != nil {
-			log.Printf("❌ Failed to create segment %d: %v, output: %s", chapter.Index, err, string(output))
-			continue
-		}
+// EndingTemplate 結尾卡片的版面
+type EndingTemplate struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	ShowsMessage bool   `json:"shows_message"` // 卡片上會畫出主人的話，燒錄字幕時不再重複
+}
 
-		log.Printf("✅ Chapter %d segment created: %s", chapter.Index, segmentPath)
-		processedSegments = append(processedSegments, segmentPath)
+var endingTemplates = []*EndingTemplate{
+	{ID: "classic", Name: "經典", Description: "結尾圖片完整顯示，空白處依 fill_mode 填充，下方顯示毛小孩的回應"},
+	{ID: "message", Name: "對話", Description: "主人的話與毛小孩的回應並列", ShowsMessage: true},
+	{ID: "name_dates", Name: "名字與日期", Description: "圓形照片、名字與日期區間，適合紀念影片"},
+	{ID: "paw_frame", Name: "腳印相框", Description: "腳印圖案背景加上相框"},
+	{ID: "polaroid", Name: "拍立得", Description: "拍立得相片，名字寫在相片下方"},
+}
 
-		// 如果有 TTS 音訊，記錄下來
-		if chapter.AudioPath != "" {
-			audioInputs = append(audioInputs, chapter.AudioPath)
+// lookupEndingTemplate 依 ID 取得結尾版面，找不到時回傳 nil
+func lookupEndingTemplate(id string) *EndingTemplate {
+	for _, template := range endingTemplates {
+		if template.ID == id {
+			return template
 		}
 	}
+	return nil
+}
 
-	if len(processedSegments) == 0 {
-		return fmt.Errorf("❌ no segments created")
+// projectEndingTemplate 專案使用的結尾版面，未設定時使用 classic
+func projectEndingTemplate(project *Project) *EndingTemplate {
+	if template := lookupEndingTemplate(project.EndingTemplate); template != nil {
+		return template
 	}
+	return lookupEndingTemplate(defaultEndingTemplate)
+}
 
-	log.Printf("📦 Total %d segments created, preparing to concatenate", len(processedSegments))
-
-	// 合併所有影片片段
-	concatListPath := filepath.Join(outputDir, "concat_segments.txt")
-	f, err := os.Create(concatListPath)
-	if err != nil {
-		return err
+// clampEndingDuration 結尾秒數限制在 5～30 秒，0 使用預設的 15 秒
+func clampEndingDuration(duration float64) float64 {
+	if duration == 0 {
+		return defaultEndingDuration
 	}
-	defer f.Close()
+	return math.Max(minEndingDuration, math.Min(maxEndingDuration, duration))
+}
 
-	for i, seg := range processedSegments {
-		fmt.Fprintf(f, "file '%s'\n", filepath.Base(seg))
-		log.Printf("  %d. %s", i+1, filepath.Base(seg))
+// endingTimeline 結尾片段的長度與各文字層開始淡入的時間
+// 有語音時文字在開始說話時出現，長度取 ending_duration 與語音（主人的話、停頓、毛小孩的回應，最後停留一下）較長者；
+// 沒有語音時使用 ending_duration，所有文字一起出現
+func endingTimeline(project *Project) (float64, []float64) {
+	starts := make([]float64, endingLayerCount)
+	for i := range starts {
+		starts[i] = endingTextDelay
 	}
-	f.Close()
-
-	log.Printf("🔗 Concatenating %d video segments...", len(processedSegments))
-
-	// 拼接影片
-	videoOnlyPath := filepath.Join(outputDir, "video_only.mp4")
-	cmd := exec.Command("ffmpeg",
-		"-f", "concat",
-		"-safe", "0",
-		"-i", concatListPath,
-		"-c", "copy",
-		"-y",
-		videoOnlyPath,
-	)
-
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("❌ ffmpeg concat error: %v, output: %s", err, string(output))
+	story := project.Story
+	if story == nil || (story.OwnerSpeech == nil && story.PetSpeech == nil) {
+		return clampEndingDuration(project.EndingDuration), starts
 	}
 
-	log.Printf("✅ Video segments concatenated: %s", videoOnlyPath)
-
-	// 合併所有 TTS 音訊
-	if len(audioInputs) > 0 {
-		log.Printf("🎤 Merging %d TTS audio files", len(audioInputs))
-
-		audioListPath := filepath.Join(outputDir, "concat_audio.txt")
-		af, err := os.Create(audioListPath)
-		if err != nil {
-			return err
+	end := 0.0
+	for layer, speech := range map[int]*EndingSpeech{endingLayerOwner: story.OwnerSpeech, endingLayerPet: story.PetSpeech} {
+		if speech == nil {
+			continue
 		}
+		starts[layer] = math.Max(endingTextDelay, speech.Start-0.3)
+		end = math.Max(end, speech.Start+speech.Duration)
+	}
+	return math.Max(clampEndingDuration(project.EndingDuration), end+endingVoiceTail), starts
+}
 
-		for _, audioPath := range audioInputs {
-			fmt.Fprintf(af, "file '%s'\n", audioPath)
+// endingSpeeches 依播放順序列出結尾的語音
+func endingSpeeches(story *Story) []*EndingSpeech {
+	speeches := []*EndingSpeech{}
+	if story == nil {
+		return speeches
+	}
+	for _, speech := range []*EndingSpeech{story.OwnerSpeech, story.PetSpeech} {
+		if speech != nil {
+			speeches = append(speeches, speech)
 		}
-		af.Close()
-
-		mergedAudioPath := filepath.Join(outputDir, "merged_audio.mp3")
-		cmd = exec.Command("ffmpeg",
-			"-f", "concat",
-			"-safe", "0",
-			"-i", audioListPath,
-			"-c", "copy",
-			"-y",
-			mergedAudioPath,
-		)
+	}
+	return speeches
+}
 
-		if output, err := cmd.CombinedOutput(); err != nil {
-			log.Printf("Warning: Failed to merge audio: %v, output: %s", err, string(output))
-			// 沒有音訊，直接使用影片
-			os.Rename(videoOnlyPath, outputPath)
-		} else {
-			// 合併影片和音訊
-			cmd = exec.Command("ffmpeg",
-				"-i", videoOnlyPath,
-				"-i", mergedAudioPath,
-				"-c:v", "copy",
-				"-c:a", "aac",
-				"-shortest",
-				"-y",
-				outputPath,
-			)
+// validateEndingDate 驗證日期格式 YYYY-MM-DD，空字串視為未設定
+func validateEndingDate(value string) error {
+	if value == "" {
+		return nil
+	}
+	if _, err := time.Parse("2006-01-02", value); err != nil {
+		return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", value)
+	}
+	return nil
+}
 
-			if output, err := cmd.CombinedOutput(); err != nil {
-				return fmt.Errorf("failed to merge video and audio: %v, output: %s", err, string(output))
+// endingDateRange 結尾卡片的日期區間，例如 2012.03.05 – 2024.08.10
+// 沒有設定開始日期時使用第一隻毛小孩檔案中的生日或到家的日子
+func endingDateRange(project *Project) string {
+	start, end := project.EndingStartDate, project.EndingEndDate
+	if start == "" {
+		for _, pet := range project.Pets {
+			if pet.ProfileID == "" {
+				continue
 			}
-
-			os.Remove(mergedAudioPath)
+			if profile, ok := getPetProfile(pet.ProfileID); ok {
+				start = profile.Birthday
+				if start == "" {
+					start = profile.AdoptionDate
+				}
+				break
+			}
+		}
+	}
+	dates := []string{}
+	for _, value := range []string{start, end} {
+		if t, err := time.Parse("2006-01-02", value); err == nil {
+			dates = append(dates, t.Format("2006.01.02"))
 		}
+	}
+	return strings.Join(dates, " – ")
+}
+
+// endingCardText 結尾卡片上的文字
+type endingCardText struct {
+	Title     string // 場合的標題，例如「豆豆，生日快樂！」
+	Name      string
+	Dates     string
+	Message   string // 主人的話
+	Response  string // 毛小孩的回應
+	Signature string
+}
 
-		os.Remove(audioListPath)
-	} else {
-		// 沒有 TTS，直接使用影片
-		os.Rename(videoOnlyPath, outputPath)
+func endingCardContent(project *Project) endingCardText {
+	content := endingCardText{
+		Title: occasionEndingTitle(project),
+		Name:  project.DogName,
+		Dates: endingDateRange(project),
 	}
-
-	// 清理
-	os.Remove(concatListPath)
-	for _, seg := range processedSegments {
-		os.Remove(seg)
+	if project.Story != nil {
+		content.Response = strings.ReplaceAll(project.Story.DogResponse, "\n\n", "\n")
 	}
-
-	log.Printf("✅ Created video with transitions and TTS audio")
-	return nil
+	if message := strings.TrimSpace(project.OwnerMessage); message != "" {
+		content.Message = "“" + message + "”"
+	}
+	if content.Name != "" {
+		content.Signature = "— " + content.Name
+	}
+	return content
 }
 
-// addEndingImage - 添加結尾圖片並顯示狗狗的回應
-// 使用 concat 協議合併影片，確保結尾圖片正確顯示
-func addEndingImage(project *Project, inputVideo, outputVideo string) error {
-	log.Printf("Adding ending image with dog response (concat approach)")
+// cardCanvas 繪製結尾卡片：背景層會緩慢放大，文字層為透明背景，合成時依序淡入
+type cardCanvas struct {
+	bg      *image.RGBA
+	layers  []*image.RGBA
+	font    *opentype.Font
+	typo    Typography
+	base    float64 // 內文字級（像素）
+	outline int     // 外框粗細（像素）
+}
 
-	outputDir := filepath.Dir(inputVideo)
-	endingDuration := 15.0 // 結尾 15 秒
+// cardBlock 一段文字，Scale 為相對於內文的字級，Opacity 為文字的不透明度，Layer 為畫在哪一個文字層
+type cardBlock struct {
+	Text    string
+	Scale   float64
+	Opacity float64
+	Layer   int
+}
 
-	// 準備狗狗回應文字（直接是狗狗視角的話，不加名字前綴）
-	dogText := project.Story.DogResponse
-	// 先把段落中的 "\n\n" 正規化成單一 "\n"，避免間距過大
-	dogText = strings.ReplaceAll(dogText, "\n\n", "\n")
-	// 為了避免文字太長被左右切掉，先做簡單斷行（大約每行 22 個字）
-	dogText = wrapTextForFFmpeg(dogText, 22)
+// renderEndingCard 依版面產生結尾卡片的背景與各文字層的 PNG
+func renderEndingCard(project *Project, format *OutputFormat, outputDir string) (string, []string, error) {
+	bg, layers, err := drawEndingCard(project, format)
+	if err != nil {
+		return "", nil, err
+	}
+	bgPath := filepath.Join(outputDir, fmt.Sprintf("ending_card_%s_bg.png", format.fileKey()))
+	if err := savePNG(bgPath, bg); err != nil {
+		return "", nil, err
+	}
+	layerPaths := []string{}
+	for i, layer := range layers {
+		layerPath := filepath.Join(outputDir, fmt.Sprintf("ending_card_%s_text%d.png", format.fileKey(), i))
+		if err := savePNG(layerPath, layer); err != nil {
+			return "", nil, err
+		}
+		layerPaths = append(layerPaths, layerPath)
+	}
+	return bgPath, layerPaths, nil
+}
 
-	// 獲取輸入影片時長和原始解析度
-	inputDuration := getVideoDuration(inputVideo)
-	originalWidth, originalHeight := getVideoResolution(inputVideo)
-	if inputDuration == 0 || originalWidth == 0 || originalHeight == 0 {
-		log.Printf("⚠️ Warning: Could not get input video info (duration: %.2f, size: %dx%d), copying input as-is", inputDuration, originalWidth, originalHeight)
-		return exec.Command("cp", inputVideo, outputVideo).Run()
+// drawEndingCard 畫出結尾卡片的背景層與文字層
+func drawEndingCard(project *Project, format *OutputFormat) (*image.RGBA, []*image.RGBA, error) {
+	photo, err := loadImageFile(project.EndingImage)
+	if err != nil {
+		return nil, nil, err
 	}
-	log.Printf("📹 Input video info: duration=%.2fs, original size=%dx%d", inputDuration, originalWidth, originalHeight)
 
-	// 統一使用 16:9 比例 (1920x1080)
-	width := 1920
-	height := 1080
-	log.Printf("🎬 Target video size: %dx%d (16:9)", width, height)
+	w, h := format.Width, format.Height
+	typo := projectTypography(project)
+	content := endingCardContent(project)
+	cardFont, err := loadCardFont(typo.FontFamily, getLanguageProfile(project.Language),
+		strings.Join([]string{content.Title, content.Name, content.Dates, content.Message, content.Response, content.Signature}, ""))
+	if err != nil {
+		log.Printf("❌ Ending card font unavailable: %v", err)
+		return nil, nil, err
+	}
+	canvas := &cardCanvas{
+		bg:      image.NewRGBA(image.Rect(0, 0, w, h)),
+		layers:  make([]*image.RGBA, endingLayerCount),
+		font:    cardFont,
+		typo:    typo,
+		base:    float64(format.EndingFontSize) * typo.FontScale,
+		outline: int(math.Ceil(typo.OutlineWidth * float64(h) / 288)),
+	}
+	for i := range canvas.layers {
+		canvas.layers[i] = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+	fill := projectFill(project)
+	theme, _ := parseHexColor(fill.Color)
+	cardTemplate := projectEndingTemplate(project)
+	log.Printf("🪪 Rendering ending card %q (%dx%d)", cardTemplate.ID, w, h)
+
+	landscape := w > h
+	pct := func(x, y, x2, y2 float64) image.Rectangle {
+		return image.Rect(int(x*float64(w)), int(y*float64(h)), int(x2*float64(w)), int(y2*float64(h)))
+	}
+	// 橫式畫面左圖右文，直式與正方形上圖下文
+	photoRect, textRect := pct(0.08, 0.06, 0.92, 0.50), pct(0.08, 0.54, 0.92, 0.94)
+	if landscape {
+		photoRect, textRect = pct(0.06, 0.10, 0.48, 0.90), pct(0.52, 0.10, 0.94, 0.90)
+	}
+	unit := int(math.Min(float64(w), float64(h)))
+
+	switch cardTemplate.ID {
+	case "message":
+		fillRect(canvas.bg, canvas.bg.Bounds(), shadeColor(theme, 0.45), 1)
+		framed := containRect(photoRect, photo.Bounds(), unit/60)
+		fillRect(canvas.bg, framed, color.RGBA{R: 255, G: 255, B: 255, A: 255}, 1)
+		drawCover(canvas.bg, framed.Inset(unit/60), photo)
+		canvas.drawStack(textRect, []cardBlock{
+			{Text: content.Title, Scale: 1.3, Opacity: 1},
+			{Text: content.Message, Scale: 0.8, Opacity: 0.8, Layer: endingLayerOwner},
+			{Text: content.Response, Scale: 1, Opacity: 1, Layer: endingLayerPet},
+			{Text: content.Signature, Scale: 0.8, Opacity: 0.9, Layer: endingLayerPet},
+		})
 
-	// 創建結尾圖片影片（10秒）
-	endingVideoPath := filepath.Join(outputDir, "ending_segment.mp4")
+	case "name_dates":
+		fillRect(canvas.bg, canvas.bg.Bounds(), shadeColor(theme, 0.35), 1)
+		diameter := int(float64(h) * 0.42)
+		center := image.Pt(w/2, int(float64(h)*0.27))
+		if !landscape {
+			diameter = int(float64(w) * 0.55)
+			center = image.Pt(w/2, int(float64(h)*0.25))
+		}
+		fillEllipse(canvas.bg, float64(center.X), float64(center.Y), float64(diameter)/2+float64(unit)/80, float64(diameter)/2+float64(unit)/80, shadeColor(theme, 1.3))
+		drawCircle(canvas.bg, center, diameter, photo)
+		canvas.drawStack(image.Rect(int(float64(w)*0.1), center.Y+diameter/2+unit/25, int(float64(w)*0.9), int(float64(h)*0.95)), []cardBlock{
+			{Text: content.Name, Scale: 2, Opacity: 1},
+			{Text: content.Dates, Scale: 0.8, Opacity: 0.85},
+			{Text: content.Response, Scale: 1, Opacity: 1, Layer: endingLayerPet},
+		})
 
-	// 選擇字體 (macOS 使用 STHeiti 或 PingFang，其他使用默認或 Arial)
-	// STHeiti (华文黑体) 通常比 PingFang 更容易被 FFmpeg 識別
-	fontFile := "/System/Library/Fonts/STHeiti Medium.ttc"
-	if _, err := os.Stat(fontFile); err != nil {
-		fontFile = "/System/Library/Fonts/PingFang.ttc"
-		if _, err := os.Stat(fontFile); err != nil {
-			fontFile = "Arial" // Fallback
-		}
-	}
-	log.Printf("🔤 Using font: %s", fontFile)
-
-	// 字體大小改為 24，適中顯示
-	fontSize := 40
-	log.Printf("📏 Font size: %d", fontSize)
-
-	// 使用 FFmpeg 創建結尾圖片影片
-	// 1. 循環圖片 10 秒
-	// 2. 添加靜音音軌 (anullsrc)
-	// 3. 縮放並添加文字
-	// 注意：使用 input 的寬高，並確保顏色空間與主影片一致
-	endingCmd := exec.Command("ffmpeg",
-		"-loop", "1",
-		"-i", project.EndingImage,
-		"-f", "lavfi",
-		"-i", "anullsrc=r=44100:cl=stereo",
-		"-vf", fmt.Sprintf(
-			"scale=%d:%d:force_original_aspect_ratio=decrease,"+
-				"pad=%d:%d:(ow-iw)/2:(oh-ih)/2:color=black,"+
-				"drawtext=fontfile='%s':text='%s':fontsize=%d:fontcolor=white:"+
-				"x=(w-text_w)/2:y=h-%d:"+
-				"box=1:boxcolor=black@0.6:boxborderw=10,"+
-				"fade=t=in:st=0:d=0.5,fade=t=out:st=%.1f:d=0.5,"+
-				"format=yuv420p,colorspace=bt709:iall=bt601-6-625:fast=1",
-			width, height,
-			width, height,
-			fontFile,
-			escapeFFmpegText(dogText),
-			fontSize,
-			height/3, // y position: leave roughly bottom third for text
-			endingDuration-0.5,
-		),
-		"-t", fmt.Sprintf("%.2f", endingDuration),
-		"-c:v", "libx264",
-		"-c:a", "aac",
-		"-pix_fmt", "yuv420p",
-		"-color_range", "tv",
-		"-colorspace", "bt709",
-		"-color_primaries", "bt709",
-		"-color_trc", "bt709",
-		"-shortest",
-		"-y",
-		endingVideoPath,
-	)
+	case "paw_frame":
+		if patternPath, err := ensurePawPattern(fill.Color, w, h); err == nil {
+			if pattern, err := loadImageFile(patternPath); err == nil {
+				draw.Draw(canvas.bg, canvas.bg.Bounds(), pattern, image.Point{}, draw.Src)
+			}
+		} else {
+			fillRect(canvas.bg, canvas.bg.Bounds(), theme, 1)
+		}
+		border := unit / 35
+		framed := containRect(photoRect, photo.Bounds(), border)
+		fillRect(canvas.bg, framed, shadeColor(theme, 1.4), 1)
+		drawCover(canvas.bg, framed.Inset(border), photo)
+		for _, corner := range []image.Point{framed.Min, {X: framed.Max.X, Y: framed.Min.Y}, {X: framed.Min.X, Y: framed.Max.Y}, framed.Max} {
+			drawPawPrint(canvas.bg, corner.X, corner.Y, float64(border)*1.2, shadeColor(theme, 0.6))
+		}
+		fillRect(canvas.bg, textRect.Inset(-unit/40), shadeColor(theme, 0.4), 0.75)
+		canvas.drawStack(textRect, []cardBlock{
+			{Text: content.Title, Scale: 1.3, Opacity: 1},
+			{Text: content.Response, Scale: 1, Opacity: 1, Layer: endingLayerPet},
+			{Text: content.Signature, Scale: 0.8, Opacity: 0.9, Layer: endingLayerPet},
+		})
 
-	endingOutput, err := endingCmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Failed to create ending segment: %v, output: %s", err, string(endingOutput))
-		return fmt.Errorf("failed to create ending: %v", err)
-	}
+	case "polaroid":
+		fillRect(canvas.bg, canvas.bg.Bounds(), shadeColor(theme, 0.8), 1)
+		// 拍立得相紙的比例約為 0.83，下方留白較多
+		cardW := int(math.Min(float64(photoRect.Dx()), float64(photoRect.Dy())*0.83))
+		cardH := int(float64(cardW) / 0.83)
+		card := image.Rect(0, 0, cardW, cardH).Add(image.Pt(photoRect.Min.X+(photoRect.Dx()-cardW)/2, photoRect.Min.Y+(photoRect.Dy()-cardH)/2))
+		margin := cardW / 16
+		fillRect(canvas.bg, card.Add(image.Pt(margin/3, margin/3)), color.RGBA{A: 255}, 0.35)
+		fillRect(canvas.bg, card, color.RGBA{R: 250, G: 248, B: 242, A: 255}, 1)
+		drawCover(canvas.bg, image.Rect(card.Min.X+margin, card.Min.Y+margin, card.Max.X-margin, card.Min.Y+margin+cardW-2*margin), photo)
+		// 相片下方的名字用深色字，不加外框
+		caption := *canvas
+		caption.typo.Color, caption.typo.Style = "#333333", textStyleNone
+		caption.drawStack(image.Rect(card.Min.X+margin, card.Min.Y+cardW, card.Max.X-margin, card.Max.Y-margin/2), []cardBlock{
+			{Text: content.Name, Scale: 1.2, Opacity: 1},
+			{Text: content.Dates, Scale: 0.6, Opacity: 0.8},
+		})
+		canvas.drawStack(textRect, []cardBlock{
+			{Text: content.Title, Scale: 1.3, Opacity: 1},
+			{Text: content.Response, Scale: 1, Opacity: 1, Layer: endingLayerPet},
+		})
 
-	// 驗證結尾影片
-	if stat, err := os.Stat(endingVideoPath); err != nil || stat.Size() == 0 {
-		return fmt.Errorf("ending segment not created properly")
+	default: // classic
+		// 與影片片段相同，圖片完整顯示，空白處依 fill_mode 填充
+		drawFilled(canvas.bg, canvas.bg.Bounds(), photo, fill, theme)
+		// 下半部漸層變暗，讓文字容易閱讀
+		for y := h * 45 / 100; y < h; y++ {
+			alpha := 0.75 * float64(y-h*45/100) / float64(h-h*45/100)
+			fillRect(canvas.bg, image.Rect(0, y, w, y+1), color.RGBA{A: 255}, alpha)
+		}
+		canvas.drawStack(pct(0.08, 0.05, 0.92, 0.22), []cardBlock{{Text: content.Title, Scale: 1.5, Opacity: 1}})
+		canvas.drawStack(pct(0.08, 0.58, 0.92, 0.94), []cardBlock{{Text: content.Response, Scale: 1, Opacity: 1, Layer: endingLayerPet}})
 	}
 
-	log.Printf("Created ending segment: %s", endingVideoPath)
+	return canvas.bg, canvas.layers, nil
+}
 
-	// 使用 concat filter 合併影片
-	// [0:v][0:a][1:v][1:a]concat=n=2:v=1:a=1[outv][outa]
-	concatCmd := exec.Command("ffmpeg",
-		"-i", inputVideo,
-		"-i", endingVideoPath,
-		"-filter_complex", "[0:v][0:a][1:v][1:a]concat=n=2:v=1:a=1[outv][outa]",
-		"-map", "[outv]",
-		"-map", "[outa]",
-		"-c:v", "libx264",
-		"-c:a", "aac",
-		"-preset", "fast",
-		"-y",
-		outputVideo,
-	)
+// drawStack 將多段文字置中排在 rect 內，放不下時整體縮小字級（最小到一半）
+func (c *cardCanvas) drawStack(rect image.Rectangle, blocks []cardBlock) {
+	type laidOut struct {
+		block  cardBlock
+		face   font.Face
+		lines  []string
+		height int
+	}
+	var layout []laidOut
+	total := 0
+	for factor := 1.0; ; factor *= 0.9 {
+		layout, total = nil, 0
+		for _, block := range blocks {
+			if strings.TrimSpace(block.Text) == "" {
+				continue
+			}
+			face, err := opentype.NewFace(c.font, &opentype.FaceOptions{Size: c.base * block.Scale * factor, DPI: 72, Hinting: font.HintingFull})
+			if err != nil {
+				log.Printf("⚠️ Failed to create font face: %v", err)
+				return
+			}
+			lines := wrapTextToWidth(face, block.Text, rect.Dx()-2*c.outline)
+			height := len(lines) * lineHeight(face)
+			if len(layout) > 0 {
+				total += lineHeight(face) / 2 // 段落之間的間距
+			}
+			layout = append(layout, laidOut{block: block, face: face, lines: lines, height: height})
+			total += height
+		}
+		if total <= rect.Dy() || factor < 0.5 {
+			break
+		}
+	}
 
-	concatOutput, err := concatCmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Concat failed: %v, output: %s", err, string(concatOutput))
+	y := rect.Min.Y + (rect.Dy()-total)/2
+	for i, item := range layout {
+		if i > 0 {
+			y += lineHeight(item.face) / 2
+		}
+		ascent := item.face.Metrics().Ascent.Ceil()
+		for _, line := range item.lines {
+			width := font.MeasureString(item.face, line).Ceil()
+			x := rect.Min.X + (rect.Dx()-width)/2
+			c.drawLine(c.layers[item.block.Layer], item.face, line, x, y+ascent, width, item.block.Opacity)
+			y += lineHeight(item.face)
+		}
+	}
+}
 
-		// 嘗試不帶音訊的 concat (如果輸入影片沒有音訊)
-		log.Printf("Trying concat without audio...")
-		concatCmdNoAudio := exec.Command("ffmpeg",
-			"-i", inputVideo,
-			"-i", endingVideoPath,
-			"-filter_complex", "[0:v][1:v]concat=n=2:v=1:a=0[outv]",
-			"-map", "[outv]",
-			"-c:v", "libx264",
-			"-preset", "fast",
-			"-y",
-			outputVideo,
-		)
-		if out, err := concatCmdNoAudio.CombinedOutput(); err != nil {
-			log.Printf("Concat no-audio failed: %v, output: %s", err, string(out))
-			return fmt.Errorf("failed to concat: %v", err)
+// drawLine 依文字樣式畫一行字（底框、外框、文字），baseline 為基線位置
+func (c *cardCanvas) drawLine(dst *image.RGBA, face font.Face, text string, x, baseline, width int, opacity float64) {
+	metrics := face.Metrics()
+	switch c.typo.Style {
+	case textStyleBox:
+		pad := metrics.Height.Ceil() / 4
+		boxColor, _ := parseHexColor(c.typo.BoxColor)
+		fillRect(dst, image.Rect(x-pad, baseline-metrics.Ascent.Ceil()-pad/2, x+width+pad, baseline+metrics.Descent.Ceil()+pad/2), boxColor, c.typo.BoxOpacity)
+	case textStyleOutline:
+		if c.outline <= 0 {
+			break
+		}
+		outlineColor, _ := parseHexColor(c.typo.OutlineColor)
+		for i := 0; i < 16; i++ {
+			angle := float64(i) * math.Pi / 8
+			dx := int(math.Round(float64(c.outline) * math.Cos(angle)))
+			dy := int(math.Round(float64(c.outline) * math.Sin(angle)))
+			drawString(dst, face, text, x+dx, baseline+dy, outlineColor, opacity)
 		}
 	}
+	textColor, _ := parseHexColor(c.typo.Color)
+	drawString(dst, face, text, x, baseline, textColor, opacity)
+}
 
-	// 驗證輸出
-	finalDuration := getVideoDuration(outputVideo)
-	log.Printf("Created video with ending: duration=%.2fs (expected: %.2fs)", finalDuration, inputDuration+endingDuration)
+func drawString(dst *image.RGBA, face font.Face, text string, x, baseline int, c color.RGBA, opacity float64) {
+	drawer := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(color.NRGBA{R: c.R, G: c.G, B: c.B, A: uint8(opacity * 255)}),
+		Face: face,
+		Dot:  fixed.P(x, baseline),
+	}
+	drawer.DrawString(text)
+}
 
-	// 清理
-	os.Remove(endingVideoPath)
+func lineHeight(face font.Face) int {
+	return int(float64(face.Metrics().Height.Ceil()) * 1.3)
+}
 
-	log.Printf("✅ Added ending image with duration %.2fs", endingDuration)
-	return nil
+// wrapTextToWidth 依實際字寬斷行：英文在空白處斷開，中日文可以在任意字之間斷開，
+// 標點符號不會出現在行首
+func wrapTextToWidth(face font.Face, text string, maxWidth int) []string {
+	limit := fixed.I(maxWidth)
+	lines := []string{}
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, unit := range lineBreakUnits(strings.TrimSpace(paragraph)) {
+			candidate := line + unit
+			if line != "" && font.MeasureString(face, strings.TrimRight(candidate, " ")) > limit {
+				lines = append(lines, strings.TrimRight(line, " "))
+				candidate = strings.TrimLeft(unit, " ")
+			}
+			line = candidate
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
 }
 
-func compositeVideoOnly(project *Project, outputPath string) error {
-	outputDir := filepath.Dir(outputPath)
+// lineBreakUnits 將文字切成不可再分割的斷行單位：
+// 英文單字（包含後面的空白）、單一個中日文字；標點黏在前一個單位，開頭的括號引號黏在後一個單位
+func lineBreakUnits(text string) []string {
+	units := []string{}
+	var current []rune
+	flush := func() {
+		if len(current) > 0 {
+			units = append(units, string(current))
+			current = nil
+		}
+	}
+	opening := false // 目前的單位是否只有開頭的括號引號
+	for _, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+			current = append(current, ' ')
+			flush()
+			opening = false
+		case strings.ContainsRune("「『（(“‘《〈[", r):
+			if !opening {
+				flush()
+			}
+			current = append(current, r)
+			opening = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			current = append(current, r)
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			if !opening {
+				flush()
+			}
+			current = append(current, r)
+			opening = false
+		default:
+			// 英文字母接在中日文字或標點後面時另起一個單位
+			if !opening && len(current) > 0 {
+				last := current[len(current)-1]
+				if unicode.In(last, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) || (unicode.IsPunct(last) && last != '\'' && last != '-') {
+					flush()
+				}
+			}
+			current = append(current, r)
+			opening = false
+		}
+	}
+	flush()
+	return units
+}
 
-	// 建立影片片段列表檔案
-	listFile := filepath.Join(outputDir, "concat_list.txt")
-	f, err := os.Create(listFile)
-	if err != nil {
-		return err
+// drawFilled 將圖片完整放進 rect（不裁切），空白處依 fill_mode 填充，對應影片片段的 fillFilter
+func drawFilled(dst *image.RGBA, rect image.Rectangle, src image.Image, fill FillSpec, theme color.RGBA) {
+	switch fill.Mode {
+	case fillBlur:
+		// 先縮得很小再放大，得到類似模糊的背景，再稍微調暗
+		small := image.NewRGBA(image.Rect(0, 0, rect.Dx()/16+1, rect.Dy()/16+1))
+		drawCover(small, small.Bounds(), src)
+		xdraw.BiLinear.Scale(dst, rect, small, small.Bounds(), draw.Src, nil)
+		fillRect(dst, rect, color.RGBA{A: 255}, 0.2)
+	case fillColor:
+		fillRect(dst, rect, theme, 1)
+	case fillPattern:
+		var pattern image.Image
+		if patternPath, err := ensurePawPattern(fill.Color, rect.Dx(), rect.Dy()); err == nil {
+			pattern, _ = loadImageFile(patternPath)
+		}
+		if pattern != nil {
+			draw.Draw(dst, rect, pattern, image.Point{}, draw.Src)
+		} else {
+			fillRect(dst, rect, theme, 1)
+		}
+	default: // black
+		fillRect(dst, rect, color.RGBA{A: 255}, 1)
 	}
-	defer f.Close()
+	drawCover(dst, containRect(rect, src.Bounds(), 0), src)
+}
 
-	for _, chapter := range project.Story.Chapters {
-		// 找到對應的影片
-		var videoPath string
-		for _, video := range project.Videos {
-			if video.ID == chapter.VideoID {
-				videoPath = video.Path
-				break
+// loadCardFont 載入結尾卡片的字體；字體合輯（.ttc）中選擇名稱相符的字體，
+// 找不到字體檔時使用 Go 內建字體；內建字體不含中日文字，text 中有它畫不出的字時回傳錯誤，
+// 避免卡片上出現一排方框
+func loadCardFont(family string, lang *LanguageProfile, text string) (*opentype.Font, error) {
+	if fontFile := resolveFontFile(family, lang); fontFile != "" {
+		data, err := os.ReadFile(fontFile)
+		if err == nil {
+			var f *opentype.Font
+			if f, err = parseCardFont(data, family); err == nil {
+				return f, nil
 			}
 		}
-
-		if videoPath == "" {
+		log.Printf("⚠️ Failed to load font %s: %v", fontFile, err)
+	}
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, err
+	}
+	var buf sfnt.Buffer
+	for _, r := range text {
+		if unicode.IsSpace(r) {
 			continue
 		}
+		if index, err := f.GlyphIndex(&buf, r); err != nil || index == 0 {
+			return nil, fmt.Errorf("no font file found for %q and the built-in font cannot draw %q; add the font to %s", family, string(r), fontsPath)
+		}
+	}
+	log.Printf("⚠️ No usable font for %s, ending card falls back to Go Regular", family)
+	return f, nil
+}
 
-		// 剪出這個片段
-		segmentPath := filepath.Join(outputDir, fmt.Sprintf("segment_%d.mp4", chapter.Index))
-		cmd := exec.Command("ffmpeg",
-			"-i", videoPath,
-			"-ss", fmt.Sprintf("%.2f", chapter.StartTime),
-			"-to", fmt.Sprintf("%.2f", chapter.EndTime),
-			"-c:v", "libx264",
-			"-c:a", "aac",
-			"-y",
-			segmentPath,
-		)
-
-		if output, err := cmd.CombinedOutput(); err != nil {
-			log.Printf("Failed to create segment %d: %v, output: %s", chapter.Index, err, string(output))
+func parseCardFont(data []byte, family string) (*opentype.Font, error) {
+	collection, err := opentype.ParseCollection(data)
+	if err != nil {
+		return nil, err
+	}
+	var first *opentype.Font
+	for i := 0; i < collection.NumFonts(); i++ {
+		f, err := collection.Font(i)
+		if err != nil {
 			continue
 		}
-
-		fmt.Fprintf(f, "file '%s'\n", filepath.Base(segmentPath))
+		if first == nil {
+			first = f
+		}
+		if name, err := f.Name(nil, sfnt.NameIDFamily); err == nil && strings.EqualFold(name, family) {
+			return f, nil
+		}
 	}
+	if first == nil {
+		return nil, fmt.Errorf("no usable font in file")
+	}
+	return first, nil
+}
 
-	// 拼接所有片段
-	cmd := exec.Command("ffmpeg",
-		"-f", "concat",
-		"-safe", "0",
-		"-i", listFile,
-		"-c", "copy",
-		"-y",
-		outputPath,
-	)
-
-	output, err := cmd.CombinedOutput()
+// loadImageFile 讀取 JPG 或 PNG 圖片
+func loadImageFile(imagePath string) (image.Image, error) {
+	f, err := os.Open(imagePath)
 	if err != nil {
-		return fmt.Errorf("ffmpeg concat error: %v, output: %s", err, string(output))
+		return nil, fmt.Errorf("failed to open image: %v", err)
 	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	return img, nil
+}
 
-	projectsMutex.Lock()
-	project.FinalVideo = outputPath
-	projectsMutex.Unlock()
-
-	log.Printf("Created final video (no audio) for project %s", project.ID)
+func savePNG(imagePath string, img image.Image) error {
+	f, err := os.Create(imagePath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", imagePath, err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		return fmt.Errorf("failed to encode %s: %v", imagePath, err)
+	}
 	return nil
 }
 
-func compositeVideoWithAudio(project *Project, outputPath string) error {
-	outputDir := filepath.Dir(outputPath)
-
-	log.Printf("Compositing video with TTS audio for project %s", project.ID)
-
-	// 處理每個章節：調整影片時長以匹配音訊時長
-	processedSegments := []string{}
-
-	for i, chapter := range project.Story.Chapters {
-		// 找到對應的影片
-		var videoPath string
-		for _, video := range project.Videos {
-			if video.ID == chapter.VideoID {
-				videoPath = video.Path
-				break
-			}
-		}
+// fillRect 以指定的不透明度在 rect 上疊一層顏色
+func fillRect(dst *image.RGBA, rect image.Rectangle, c color.RGBA, opacity float64) {
+	fill := color.NRGBA{R: c.R, G: c.G, B: c.B, A: uint8(opacity * 255)}
+	draw.Draw(dst, rect, image.NewUniform(fill), image.Point{}, draw.Over)
+}
 
-		if videoPath == "" {
-			log.Printf("Warning: video not found for chapter %d", i+1)
-			continue
-		}
+// drawCover 將圖片縮放裁切到剛好填滿 rect（置中）
+func drawCover(dst *image.RGBA, rect image.Rectangle, src image.Image) {
+	sb := src.Bounds()
+	scale := math.Max(float64(rect.Dx())/float64(sb.Dx()), float64(rect.Dy())/float64(sb.Dy()))
+	cropW, cropH := int(float64(rect.Dx())/scale), int(float64(rect.Dy())/scale)
+	crop := image.Rect(0, 0, cropW, cropH).Add(sb.Min).Add(image.Pt((sb.Dx()-cropW)/2, (sb.Dy()-cropH)/2))
+	xdraw.CatmullRom.Scale(dst, rect, src, crop, draw.Over, nil)
+}
 
-		segmentPath := filepath.Join(outputDir, fmt.Sprintf("segment_%d.mp4", i+1))
+// containRect 在 bounds 內放得下圖片（加上 border）的最大置中範圍
+func containRect(bounds, img image.Rectangle, border int) image.Rectangle {
+	innerW, innerH := float64(bounds.Dx()-2*border), float64(bounds.Dy()-2*border)
+	scale := math.Min(innerW/float64(img.Dx()), innerH/float64(img.Dy()))
+	w, h := int(float64(img.Dx())*scale)+2*border, int(float64(img.Dy())*scale)+2*border
+	return image.Rect(0, 0, w, h).Add(image.Pt(bounds.Min.X+(bounds.Dx()-w)/2, bounds.Min.Y+(bounds.Dy()-h)/2))
+}
 
-		// 剪輯影片為 15 秒左右
-		targetDuration := 15.0 // 目標 15 秒
-		actualEndTime := chapter.StartTime + targetDuration
-		if actualEndTime > chapter.EndTime {
-			actualEndTime = chapter.EndTime
+// drawCircle 將圖片裁成圓形畫在 center
+func drawCircle(dst *image.RGBA, center image.Point, diameter int, src image.Image) {
+	rect := image.Rect(0, 0, diameter, diameter).Add(center.Sub(image.Pt(diameter/2, diameter/2)))
+	photo := image.NewRGBA(rect)
+	drawCover(photo, rect, src)
+	mask := image.NewAlpha(rect)
+	radius := float64(diameter) / 2
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			dx, dy := float64(x-center.X)+0.5, float64(y-center.Y)+0.5
+			// 邊緣一個像素做反鋸齒
+			coverage := math.Max(0, math.Min(1, radius-math.Sqrt(dx*dx+dy*dy)))
+			mask.SetAlpha(x, y, color.Alpha{A: uint8(coverage * 255)})
 		}
+	}
+	draw.DrawMask(dst, rect, photo, rect.Min, mask, rect.Min, draw.Over)
+}
 
-		if chapter.AudioPath != "" && chapter.Duration > 0 {
-			// 有音訊：調整影片速度以匹配音訊時長
-			videoDuration := actualEndTime - chapter.StartTime
-
-			// 如果音訊比影片長，減慢影片播放速度
-			// 如果音訊比影片短，加快影片播放速度
-			speedFactor := videoDuration / chapter.Duration
+// ============================================================================
+// Pets and Species
+// ============================================================================
 
-			// 限制速度範圍（0.5x - 2.0x）
-			if speedFactor < 0.5 {
-				speedFactor = 0.5
-			} else if speedFactor > 2.0 {
-				speedFactor = 2.0
-			}
+const defaultSpecies = "dog"
+
+// speciesLabels 各物種在不同語言中的稱呼
+var speciesLabels = map[string]map[string]string{
+	"dog":        {"zh-TW": "狗狗", "zh-CN": "狗狗", "en": "dog", "ja": "犬"},
+	"cat":        {"zh-TW": "貓咪", "zh-CN": "猫咪", "en": "cat", "ja": "猫"},
+	"rabbit":     {"zh-TW": "兔兔", "zh-CN": "兔兔", "en": "rabbit", "ja": "うさぎ"},
+	"hamster":    {"zh-TW": "倉鼠", "zh-CN": "仓鼠", "en": "hamster", "ja": "ハムスター"},
+	"guinea_pig": {"zh-TW": "天竺鼠", "zh-CN": "豚鼠", "en": "guinea pig", "ja": "モルモット"},
+	"bird":       {"zh-TW": "鳥寶", "zh-CN": "鸟宝", "en": "bird", "ja": "鳥"},
+	"ferret":     {"zh-TW": "雪貂", "zh-CN": "雪貂", "en": "ferret", "ja": "フェレット"},
+	"other":      {"zh-TW": "毛小孩", "zh-CN": "毛孩子", "en": "pet", "ja": "ペット"},
+}
 
-			log.Printf("Chapter %d: video=%.2fs, audio=%.2fs, speed=%.2fx",
-				i+1, videoDuration, chapter.Duration, speedFactor)
+// normalizeSpecies 統一物種代碼，未知的物種歸類為 other
+func normalizeSpecies(species string) string {
+	species = strings.ToLower(strings.TrimSpace(species))
+	species = strings.ReplaceAll(species, " ", "_")
+	if species == "" {
+		return defaultSpecies
+	}
+	if _, ok := speciesLabels[species]; !ok {
+		return "other"
+	}
+	return species
+}
 
-			// 剪出影片片段並調整速度（移除原音）+ 淡入淡出
-			log.Printf("Creating segment %d with speed adjustment (%.2fx) and fade: %s to %s", i+1,
-				speedFactor, fmt.Sprintf("%.2f", chapter.StartTime), fmt.Sprintf("%.2f", actualEndTime))
+// speciesLabel 取得物種在指定語言的稱呼
+func speciesLabel(species, lang string) string {
+	labels := speciesLabels[normalizeSpecies(species)]
+	if label, ok := labels[lang]; ok {
+		return label
+	}
+	return labels[defaultLanguage]
+}
 
-			segmentDuration := actualEndTime - chapter.StartTime
-			fadeDuration := 0.5
+// projectPets 專案中的毛小孩；舊專案只有 DogName 時視為一隻狗。
+// 有連結毛小孩檔案的會使用檔案中的最新資料。
+func projectPets(project *Project) []PetInfo {
+	if len(project.Pets) > 0 {
+		pets := make([]PetInfo, 0, len(project.Pets))
+		for _, pet := range project.Pets {
+			if profile, ok := getPetProfile(pet.ProfileID); ok && pet.ProfileID != "" {
+				pet = petInfoFromProfile(profile)
+			}
+			pets = append(pets, pet)
+		}
+		return pets
+	}
+	return []PetInfo{{
+		Name:    project.DogName,
+		Species: defaultSpecies,
+		Breed:   project.DogBreed,
+	}}
+}
 
-			// 組合濾鏡：速度調整 + 淡入淡出
-			filterComplex := fmt.Sprintf("setpts=%.4f*PTS,fade=t=in:st=0:d=%.2f,fade=t=out:st=%.2f:d=%.2f",
-				1.0/speedFactor, fadeDuration, segmentDuration-fadeDuration, fadeDuration)
+// projectSpecies 專案中出現的物種（不重複，依出現順序）
+func projectSpecies(project *Project) []string {
+	species := []string{}
+	seen := map[string]bool{}
+	for _, pet := range projectPets(project) {
+		s := normalizeSpecies(pet.Species)
+		if !seen[s] {
+			seen[s] = true
+			species = append(species, s)
+		}
+	}
+	return species
+}
 
-			cmd := exec.Command("ffmpeg",
-				"-i", videoPath,
-				"-ss", fmt.Sprintf("%.2f", chapter.StartTime),
-				"-t", fmt.Sprintf("%.2f", segmentDuration),
-				"-filter:v", filterComplex,
-				"-an", // 移除原音訊
-				"-c:v", "libx264",
-				"-preset", "fast",
-				"-y",
-				segmentPath+"_video.mp4",
-			)
+// describePets 將毛小孩清單整理成 prompt 用的描述，例如「豆豆（狗狗，柴犬，個性：貪吃）」
+func describePets(pets []PetInfo, lang string) string {
+	text, ok := petDetailTexts[lang]
+	if !ok {
+		text = petDetailTexts[defaultLanguage]
+	}
+	format, petSeparator := "%s（%s）", "；"
+	if lang == "en" {
+		format, petSeparator = "%s (%s)", " / "
+	}
 
-			if output, err := cmd.CombinedOutput(); err != nil {
-				log.Printf("Failed to process video for chapter %d: %v, output: %s", i+1, err, string(output))
-				continue
-			}
+	descriptions := make([]string, 0, len(pets))
+	for _, pet := range pets {
+		details := []string{speciesLabel(pet.Species, lang)}
+		if pet.Breed != "" {
+			details = append(details, pet.Breed)
+		}
+		if extra := petDetails(pet, lang); extra != "" {
+			details = append(details, extra)
+		}
+		descriptions = append(descriptions, fmt.Sprintf(format, pet.Name, strings.Join(details, text.Separator)))
+	}
+	return strings.Join(descriptions, petSeparator)
+}
 
-			// 合併音訊與影片
-			cmd = exec.Command("ffmpeg",
-				"-i", segmentPath+"_video.mp4",
-				"-i", chapter.AudioPath,
-				"-c:v", "copy",
-				"-c:a", "aac",
-				"-shortest",
-				"-y",
-				segmentPath,
-			)
+// petNames 將毛小孩的名字串起來，作為相容舊欄位 DogName 的值
+func petNames(pets []PetInfo, lang string) string {
+	names := make([]string, 0, len(pets))
+	for _, pet := range pets {
+		names = append(names, pet.Name)
+	}
+	if lang == "en" {
+		return strings.Join(names, " & ")
+	}
+	return strings.Join(names, "、")
+}
 
-			if output, err := cmd.CombinedOutput(); err != nil {
-				log.Printf("Failed to merge audio for chapter %d: %v, output: %s", i+1, err, string(output))
-				continue
-			}
+// speakerVoice 多隻毛小孩輪流說話時，依說話者調整音高，讓每隻聽起來不一樣
+func speakerVoice(project *Project, speaker string, voice TTSVoice) TTSVoice {
+	pitchOffsets := []float64{0, 3.0, -2.5, 5.0, -4.0}
+	if project.NarrationStyle != "multi" || speaker == "" {
+		return voice
+	}
+	for i, pet := range projectPets(project) {
+		if pet.Name == speaker {
+			voice.Pitch += pitchOffsets[i%len(pitchOffsets)]
+			return voice
+		}
+	}
+	return voice
+}
 
-			// 清理臨時檔案
-			os.Remove(segmentPath + "_video.mp4")
+// ============================================================================
+// Pet Profiles
+// ============================================================================
 
-		} else {
-			// 沒有音訊，只剪出影片（移除原音）+ 淡入淡出
-			log.Printf("Creating segment %d without audio with fade effects: %s to %s", i+1,
-				fmt.Sprintf("%.2f", chapter.StartTime), fmt.Sprintf("%.2f", actualEndTime))
+// PetProfile 可在多個專案之間共用的毛小孩檔案
+type PetProfile struct {
+	ID                string    `json:"id"`
+	Name              string    `json:"name"`
+	Species           string    `json:"species"`
+	Breed             string    `json:"breed,omitempty"`
+	Birthday          string    `json:"birthday,omitempty"`      // YYYY-MM-DD
+	AdoptionDate      string    `json:"adoption_date,omitempty"` // YYYY-MM-DD，來到家裡的日子
+	Nicknames         []string  `json:"nicknames,omitempty"`
+	Personality       []string  `json:"personality,omitempty"` // 個性特徵，例如「貪吃」「怕打雷」
+	Favorites         []string  `json:"favorites,omitempty"`   // 最喜歡的東西，例如「網球」「雞肉乾」
+	OwnerRelationship string    `json:"owner_relationship,omitempty"`
+	PhotoPath         string    `json:"photo_path,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
 
-			segmentDuration := actualEndTime - chapter.StartTime
-			fadeDuration := 0.5 // 淡入淡出 0.5 秒
+// PetProfileRequest 建立或更新毛小孩檔案的請求內容
+type PetProfileRequest struct {
+	Name              string   `json:"name" binding:"required"`
+	Species           string   `json:"species"`
+	Breed             string   `json:"breed"`
+	Birthday          string   `json:"birthday"`
+	AdoptionDate      string   `json:"adoption_date"`
+	Nicknames         []string `json:"nicknames"`
+	Personality       []string `json:"personality"`
+	Favorites         []string `json:"favorites"`
+	OwnerRelationship string   `json:"owner_relationship"`
+}
 
-			// 淡入淡出濾鏡
-			fadeFilter := fmt.Sprintf("fade=t=in:st=0:d=%.2f,fade=t=out:st=%.2f:d=%.2f",
-				fadeDuration, segmentDuration-fadeDuration, fadeDuration)
+const petDateLayout = "2006-01-02"
 
-			cmd := exec.Command("ffmpeg",
-				"-i", videoPath,
-				"-ss", fmt.Sprintf("%.2f", chapter.StartTime),
-				"-t", fmt.Sprintf("%.2f", segmentDuration),
-				"-vf", fadeFilter, // 加入淡入淡出
-				"-an", // 移除原音訊
-				"-c:v", "libx264",
-				"-preset", "fast",
-				"-y",
-				segmentPath,
-			)
+// applyPetProfileRequest 驗證請求並寫入檔案（整筆覆蓋）
+func applyPetProfileRequest(profile *PetProfile, req PetProfileRequest) error {
+	for _, date := range []string{req.Birthday, req.AdoptionDate} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(petDateLayout, date); err != nil {
+			return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
+		}
+	}
 
-			if output, err := cmd.CombinedOutput(); err != nil {
-				log.Printf("Failed to create segment %d: %v, output: %s", i+1, err, string(output))
-				continue
-			}
+	profile.Name = strings.TrimSpace(req.Name)
+	profile.Species = normalizeSpecies(req.Species)
+	profile.Breed = req.Breed
+	profile.Birthday = req.Birthday
+	profile.AdoptionDate = req.AdoptionDate
+	profile.Nicknames = compactStrings(req.Nicknames)
+	profile.Personality = compactStrings(req.Personality)
+	profile.Favorites = compactStrings(req.Favorites)
+	profile.OwnerRelationship = req.OwnerRelationship
+	profile.UpdatedAt = time.Now()
+	return nil
+}
 
-			log.Printf("Segment %d created with fade effects", i+1)
+// compactStrings 去掉空白與空字串
+func compactStrings(values []string) []string {
+	result := []string{}
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
 		}
+	}
+	return result
+}
 
-		processedSegments = append(processedSegments, segmentPath)
+// getPetProfile 取得毛小孩檔案的複本
+func getPetProfile(id string) (PetProfile, bool) {
+	petProfilesMutex.RLock()
+	defer petProfilesMutex.RUnlock()
+
+	profile, ok := petProfiles[id]
+	if !ok {
+		return PetProfile{}, false
 	}
+	return *profile, true
+}
 
-	if len(processedSegments) == 0 {
-		return fmt.Errorf("no segments were successfully processed")
+// petInfoFromProfile 將毛小孩檔案轉成專案使用的 PetInfo
+func petInfoFromProfile(profile PetProfile) PetInfo {
+	return PetInfo{
+		ProfileID:   profile.ID,
+		Name:        profile.Name,
+		Species:     profile.Species,
+		Breed:       profile.Breed,
+		Personality: strings.Join(profile.Personality, "、"),
 	}
+}
 
-	// 建立拼接列表
-	listFile := filepath.Join(outputDir, "concat_list.txt")
-	f, err := os.Create(listFile)
+// elapsedSince 計算從某個日期到現在經過的年與月
+func elapsedSince(date string) (years, months int, ok bool) {
+	t, err := time.Parse(petDateLayout, date)
 	if err != nil {
-		return err
+		return 0, 0, false
 	}
-	defer f.Close()
-
-	for _, segmentPath := range processedSegments {
-		fmt.Fprintf(f, "file '%s'\n", filepath.Base(segmentPath))
+	now := time.Now()
+	total := (now.Year()-t.Year())*12 + int(now.Month()) - int(t.Month())
+	if now.Day() < t.Day() {
+		total--
+	}
+	if total < 0 {
+		return 0, 0, false
 	}
+	return total / 12, total % 12, true
+}
 
-	// 拼接所有片段
-	tempConcatPath := filepath.Join(outputDir, "temp_concat.mp4")
-	cmd := exec.Command("ffmpeg",
-		"-f", "concat",
-		"-safe", "0",
-		"-i", listFile,
-		"-c", "copy",
-		"-y",
-		tempConcatPath,
-	)
+// petDetailText 毛小孩補充資訊在各語言中的用詞
+type petDetailText struct {
+	Separator      string
+	ListSeparator  string
+	Personality    string
+	Nicknames      string
+	Favorites      string
+	AgeYears       string
+	AgeMonths      string
+	TogetherYears  string
+	TogetherMonths string
+}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("ffmpeg concat error: %v, output: %s", err, string(output))
-	}
+var petDetailTexts = map[string]petDetailText{
+	"zh-TW": {"，", "、", "個性：", "小名：", "最喜歡：", "%d 歲", "%d 個月大", "陪伴家人 %d 年", "陪伴家人 %d 個月"},
+	"zh-CN": {"，", "、", "性格：", "小名：", "最喜欢：", "%d 岁", "%d 个月大", "陪伴家人 %d 年", "陪伴家人 %d 个月"},
+	"en":    {", ", "; ", "personality: ", "nicknames: ", "favourite things: ", "%d years old", "%d months old", "with the family for %d years", "with the family for %d months"},
+	"ja":    {"、", "・", "性格：", "呼び名：", "好きなもの：", "%d 歳", "生後 %d か月", "家族になって %d 年", "家族になって %d か月"},
+}
 
-	// 如果有結尾圖片，加入結尾圖片和文字
-	log.Printf("Checking ending image: path=%s, message=%s", project.EndingImage, project.Story.FinalMessage)
+// petDetails 毛小孩的補充資訊（個性、小名、年紀、陪伴時間、最喜歡的東西），供 prompt 使用
+func petDetails(pet PetInfo, lang string) string {
+	text, ok := petDetailTexts[lang]
+	if !ok {
+		text = petDetailTexts[defaultLanguage]
+	}
 
-	if project.EndingImage != "" && project.Story != nil && project.Story.FinalMessage != "" {
-		log.Printf("Adding ending image to video...")
-		// 使用一個新的臨時檔案來存儲帶有結尾的影片
-		videoWithEndingPath := filepath.Join(outputDir, "video_with_ending.mp4")
+	profile, hasProfile := PetProfile{}, false
+	if pet.ProfileID != "" {
+		profile, hasProfile = getPetProfile(pet.ProfileID)
+	}
+	if !hasProfile {
+		if pet.Personality == "" {
+			return ""
+		}
+		return text.Personality + pet.Personality
+	}
 
-		if err := addEndingImage(project, tempConcatPath, videoWithEndingPath); err != nil {
-			log.Printf("❌ Failed to add ending image: %v", err)
-			// 如果失敗，使用沒有結尾的版本
-			os.Rename(tempConcatPath, outputPath)
+	details := []string{}
+	if len(profile.Personality) > 0 {
+		details = append(details, text.Personality+strings.Join(profile.Personality, text.ListSeparator))
+	}
+	if len(profile.Nicknames) > 0 {
+		details = append(details, text.Nicknames+strings.Join(profile.Nicknames, text.ListSeparator))
+	}
+	if years, months, ok := elapsedSince(profile.Birthday); ok {
+		if years > 0 {
+			details = append(details, fmt.Sprintf(text.AgeYears, years))
 		} else {
-			log.Printf("✅ Ending image added successfully")
-			// 成功加入結尾，將結果移動到最終輸出路徑
-			os.Rename(videoWithEndingPath, outputPath)
-			os.Remove(tempConcatPath)
+			details = append(details, fmt.Sprintf(text.AgeMonths, months))
+		}
+	}
+	if years, months, ok := elapsedSince(profile.AdoptionDate); ok {
+		if years > 0 {
+			details = append(details, fmt.Sprintf(text.TogetherYears, years))
+		} else if months > 0 {
+			details = append(details, fmt.Sprintf(text.TogetherMonths, months))
 		}
-	} else {
-		log.Printf("No ending image or message, skipping. EndingImage=%s, FinalMessage=%v",
-			project.EndingImage, project.Story != nil && project.Story.FinalMessage != "")
-		os.Rename(tempConcatPath, outputPath)
 	}
+	if len(profile.Favorites) > 0 {
+		details = append(details, text.Favorites+strings.Join(profile.Favorites, text.ListSeparator))
+	}
+	return strings.Join(details, text.Separator)
+}
 
-	projectsMutex.Lock()
-	project.FinalVideo = outputPath
-	projectsMutex.Unlock()
+// ============================================================================
+// Story Modes and Prompt Templates
+// ============================================================================
 
-	log.Printf("Created final video with TTS audio for project %s", project.ID)
-	return nil
+// 預設的模式與 prompt 模板會編進執行檔；PROMPTS_PATH 目錄中的同名檔案會覆蓋預設值，
+// 新增的檔案則會變成新的模式，內容團隊不需要改程式就能加上新的風格
+//
+//go:embed prompts
+var embeddedPrompts embed.FS
+
+const defaultStoryMode = "warm"
+
+// StoryModeDefinition 故事模式定義，對應 prompts/modes/*.json
+// 同一個 ID 可以有多個版本，專案建立時會記下使用的版本
+type StoryModeDefinition struct {
+	ID          string                     `json:"id"`
+	Version     int                        `json:"version"`
+	Name        string                     `json:"name"`
+	Description string                     `json:"description,omitempty"`
+	MusicMood   string                     `json:"music_mood,omitempty"` // 自動挑選背景音樂時偏好的氣氛
+	Story       StoryModePrompt            `json:"story"`
+	DogResponse StoryModePrompt            `json:"dog_response"`
+	Templates   map[string]string          `json:"templates,omitempty"` // 覆蓋預設的 prompt 模板，例如 {"story": "story_poetic"}
+	Locales     map[string]StoryModeLocale `json:"locales,omitempty"`   // 其他語言的風格文字，例如 {"en": {...}}
+	Source      string                     `json:"source"`              // 定義檔來源（embedded 或檔案路徑）
 }
 
-func markProjectFailed(projectID, errorMsg string) {
-	log.Printf("Project %s failed: %s", projectID, errorMsg)
+// StoryModeLocale 模式在特定語言下的名稱與風格文字
+type StoryModeLocale struct {
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Story       StoryModePrompt `json:"story"`
+	DogResponse StoryModePrompt `json:"dog_response"`
+}
 
-	projectsMutex.Lock()
-	if project, exists := projects[projectID]; exists {
-		project.Status = "failed"
-		project.Error = errorMsg
-		project.UpdatedAt = time.Now()
+// localized 取得模式在指定語言下的風格文字，沒有翻譯時使用預設內容
+func (m *StoryModeDefinition) localized(lang string) StoryModeLocale {
+	if locale, ok := m.Locales[lang]; ok {
+		if locale.Name == "" {
+			locale.Name = m.Name
+		}
+		return locale
+	}
+	return StoryModeLocale{
+		Name:        m.Name,
+		Description: m.Description,
+		Story:       m.Story,
+		DogResponse: m.DogResponse,
 	}
-	projectsMutex.Unlock()
 }
 
-func getVideoDuration(videoPath string) float64 {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-show_entries", "format=duration",
-		"-of", "default=noprint_wrappers=1:nokey=1",
-		videoPath,
-	)
+// StoryModePrompt 模式的風格文字，內容本身也是模板，可以使用 {{.OwnerTitle}}
+type StoryModePrompt struct {
+	Style    string `json:"style"`
+	Emotion  string `json:"emotion"`
+	Examples string `json:"examples"`
+	Note     string `json:"note,omitempty"`
+}
 
-	output, err := cmd.Output()
+var (
+	storyModes      = make(map[string][]*StoryModeDefinition) // 依版本由小到大排序
+	promptTemplates *template.Template
+	storyModesMutex sync.RWMutex
+)
+
+// loadStoryModes 重新載入所有模式與 prompt 模板
+func loadStoryModes() error {
+	modes := make(map[string][]*StoryModeDefinition)
+	loadedOccasions := make(map[string]*OccasionDefinition)
+	templateSources := make(map[string]string)
+
+	sub, err := fs.Sub(embeddedPrompts, "prompts")
 	if err != nil {
-		return 0
+		return err
+	}
+	if err := collectPromptFiles(sub, "embedded", modes, loadedOccasions, templateSources); err != nil {
+		return fmt.Errorf("failed to load embedded prompts: %v", err)
 	}
 
-	duration := 0.0
-	fmt.Sscanf(string(output), "%f", &duration)
-	return duration
-}
+	if info, err := os.Stat(promptsPath); err == nil && info.IsDir() {
+		if err := collectPromptFiles(os.DirFS(promptsPath), promptsPath, modes, loadedOccasions, templateSources); err != nil {
+			return fmt.Errorf("failed to load prompts from %s: %v", promptsPath, err)
+		}
+	}
 
-func getVideoResolution(videoPath string) (int, int) {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=width,height",
-		"-of", "csv=s=x:p=0",
-		videoPath,
-	)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Error getting video resolution: %v", err)
-		return 0, 0
+	tmpl := template.New("prompts").Option("missingkey=error")
+	names := make([]string, 0, len(templateSources))
+	for name := range templateSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := tmpl.New(name).Parse(templateSources[name]); err != nil {
+			return fmt.Errorf("failed to parse template %s: %v", name, err)
+		}
 	}
 
-	var width, height int
-	fmt.Sscanf(strings.TrimSpace(string(output)), "%dx%d", &width, &height)
-	return width, height
-}
+	for id, versions := range modes {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+		modes[id] = versions
+	}
+
+	if _, ok := modes[defaultStoryMode]; !ok {
+		return fmt.Errorf("default story mode %q is missing", defaultStoryMode)
+	}
+	if _, ok := loadedOccasions[defaultOccasion]; !ok {
+		return fmt.Errorf("default occasion %q is missing", defaultOccasion)
+	}
 
-func escapeFFmpegText(text string) string {
-	// FFmpeg drawtext 需要轉義特殊字符
-	text = strings.ReplaceAll(text, "\\", "\\\\")
-	text = strings.ReplaceAll(text, "'", "\\'")
-	text = strings.ReplaceAll(text, ":", "\\:")
-	text = strings.ReplaceAll(text, "[", "\\[")
-	text = strings.ReplaceAll(text, "]", "\\]")
-	return text
+	storyModesMutex.Lock()
+	storyModes = modes
+	occasions = loadedOccasions
+	promptTemplates = tmpl
+	storyModesMutex.Unlock()
+
+	log.Printf("Loaded %d story modes, %d occasions and %d prompt templates", len(modes), len(loadedOccasions), len(names))
+	return nil
 }
 
-// wrapTextForFFmpeg 將長文字按最大字數換行，避免在 drawtext 中被左右切掉
-// maxChars 是「每行最多的字數」（以 rune 計算，適合中英文摻雜的情況）
-func wrapTextForFFmpeg(text string, maxChars int) string {
-	if maxChars <= 0 {
-		return text
+// collectPromptFiles 讀取 modes/*.json、occasions/*.json 與 templates/*.tmpl，同 ID（同版本）的後讀取者覆蓋先前的
+func collectPromptFiles(fsys fs.FS, source string, modes map[string][]*StoryModeDefinition, occasionDefs map[string]*OccasionDefinition, templateSources map[string]string) error {
+	modeFiles, err := fs.Glob(fsys, "modes/*.json")
+	if err != nil {
+		return err
 	}
+	for _, file := range modeFiles {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
 
-	// 先以原本的換行切開，每一段再做一次包裝
-	parts := strings.Split(text, "\n")
-	wrappedParts := make([]string, 0, len(parts))
-
-	for _, p := range parts {
-		p = strings.TrimSpace(p)
-		if p == "" {
-			wrappedParts = append(wrappedParts, "")
-			continue
+		var mode StoryModeDefinition
+		if err := json.Unmarshal(data, &mode); err != nil {
+			return fmt.Errorf("invalid mode file %s: %v", file, err)
+		}
+		if mode.ID == "" {
+			return fmt.Errorf("mode file %s has no id", file)
 		}
+		if mode.Version <= 0 {
+			mode.Version = 1
+		}
+		mode.Source = source + ":" + file
 
-		runes := []rune(p)
-		lineStart := 0
-		for lineStart < len(runes) {
-			end := lineStart + maxChars
-			if end > len(runes) {
-				end = len(runes)
+		replaced := false
+		for i, existing := range modes[mode.ID] {
+			if existing.Version == mode.Version {
+				modes[mode.ID][i] = &mode
+				replaced = true
+				break
 			}
-			wrappedParts = append(wrappedParts, string(runes[lineStart:end]))
-			lineStart = end
 		}
+		if !replaced {
+			modes[mode.ID] = append(modes[mode.ID], &mode)
+		}
+	}
+
+	occasionFiles, err := fs.Glob(fsys, "occasions/*.json")
+	if err != nil {
+		return err
+	}
+	for _, file := range occasionFiles {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+
+		var occasion OccasionDefinition
+		if err := json.Unmarshal(data, &occasion); err != nil {
+			return fmt.Errorf("invalid occasion file %s: %v", file, err)
+		}
+		if occasion.ID == "" {
+			return fmt.Errorf("occasion file %s has no id", file)
+		}
+		occasion.Source = source + ":" + file
+		occasionDefs[occasion.ID] = &occasion
+	}
+
+	templateFiles, err := fs.Glob(fsys, "templates/*.tmpl")
+	if err != nil {
+		return err
+	}
+	for _, file := range templateFiles {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(path.Base(file), ".tmpl")
+		templateSources[name] = string(data)
 	}
 
-	// 使用真正的換行字元，讓 FFmpeg drawtext 正確換行
-	return strings.Join(wrappedParts, "\n")
+	return nil
 }
 
-func generateOwnerMessageTTS(message, outputPath string) error {
-	log.Printf("Generating TTS for owner message: %s", message)
+// lookupStoryMode 取得指定版本的模式，version 為 0 時回傳最新版本
+func lookupStoryMode(id string, version int) *StoryModeDefinition {
+	storyModesMutex.RLock()
+	defer storyModesMutex.RUnlock()
 
-	requestBody := map[string]interface{}{
-		"input": map[string]string{
-			"text": message,
-		},
-		"voice": map[string]interface{}{
-			"languageCode": "zh-TW",
-			"name":         "cmn-TW-Wavenet-C", // 台灣中文男聲
-			"ssmlGender":   "MALE",
-		},
-		"audioConfig": map[string]interface{}{
-			"audioEncoding": "MP3",
-			"speakingRate":  0.9,
-			"pitch":         -2.0, // 稍微低沉一點
-		},
+	versions := storyModes[id]
+	if len(versions) == 0 {
+		return nil
+	}
+	if version <= 0 {
+		return versions[len(versions)-1]
 	}
+	for _, mode := range versions {
+		if mode.Version == version {
+			return mode
+		}
+	}
+	return nil
+}
 
-	return executeTTSRequest(requestBody, outputPath)
+// resolveProjectStoryMode 取得專案使用的模式，找不到時退回預設模式
+func resolveProjectStoryMode(project *Project) *StoryModeDefinition {
+	if mode := lookupStoryMode(project.StoryMode, project.StoryModeVersion); mode != nil {
+		return mode
+	}
+	log.Printf("⚠️ Story mode %s v%d not found, falling back to %s", project.StoryMode, project.StoryModeVersion, defaultStoryMode)
+	return lookupStoryMode(defaultStoryMode, 0)
 }
 
-func generateDogResponseTTS(message, outputPath string) error {
-	log.Printf("Generating TTS for dog response: %s", message)
+// listStoryModes 列出所有模式的最新版本，以及可用的版本號
+func listStoryModes() []gin.H {
+	storyModesMutex.RLock()
+	defer storyModesMutex.RUnlock()
 
-	requestBody := map[string]interface{}{
-		"input": map[string]string{
-			"text": message,
-		},
-		"voice": map[string]interface{}{
-			"languageCode": "zh-TW",
-			"name":         "cmn-TW-Wavenet-A", // 台灣中文女聲（狗狗的聲音）
-			"ssmlGender":   "FEMALE",
-		},
-		"audioConfig": map[string]interface{}{
-			"audioEncoding": "MP3",
-			"speakingRate":  0.95,
-			"pitch":         2.0, // 稍微高一點，更可愛
-		},
+	ids := make([]string, 0, len(storyModes))
+	for id := range storyModes {
+		ids = append(ids, id)
 	}
+	sort.Strings(ids)
 
-	return executeTTSRequest(requestBody, outputPath)
+	list := make([]gin.H, 0, len(ids))
+	for _, id := range ids {
+		versions := storyModes[id]
+		latest := versions[len(versions)-1]
+		versionNumbers := make([]int, 0, len(versions))
+		for _, mode := range versions {
+			versionNumbers = append(versionNumbers, mode.Version)
+		}
+		list = append(list, gin.H{
+			"id":          latest.ID,
+			"name":        latest.Name,
+			"description": latest.Description,
+			"version":     latest.Version,
+			"versions":    versionNumbers,
+			"music_mood":  latest.MusicMood,
+			"default":     latest.ID == defaultStoryMode,
+			"locales":     localeCodes(latest),
+		})
+	}
+	return list
 }
 
-func executeTTSRequest(requestBody map[string]interface{}, outputPath string) error {
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return fmt.Errorf("failed to marshal TTS request: %v", err)
+// localeCodes 模式有翻譯的語言
+func localeCodes(mode *StoryModeDefinition) []string {
+	codes := make([]string, 0, len(mode.Locales))
+	for code := range mode.Locales {
+		codes = append(codes, code)
 	}
+	sort.Strings(codes)
+	return codes
+}
 
-	url := fmt.Sprintf("https://texttospeech.googleapis.com/v1/text:synthesize?key=%s", aiAPIKey)
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create TTS request: %v", err)
+// renderModePrompt 將模式的風格文字套上稱呼等變數
+func renderModePrompt(prompt StoryModePrompt, data interface{}) (StoryModePrompt, error) {
+	var err error
+	render := func(text string) string {
+		if err != nil || text == "" {
+			return text
+		}
+		var out string
+		out, err = renderInlineTemplate(text, data)
+		return out
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	rendered := StoryModePrompt{
+		Style:    render(prompt.Style),
+		Emotion:  render(prompt.Emotion),
+		Examples: render(prompt.Examples),
+		Note:     render(prompt.Note),
+	}
+	return rendered, err
+}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+func renderInlineTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("inline").Option("missingkey=error").Parse(text)
 	if err != nil {
-		return fmt.Errorf("failed to send TTS request: %v", err)
+		return "", err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("TTS API error %d: %s", resp.StatusCode, string(body))
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
 	}
+	return buf.String(), nil
+}
 
-	var ttsResponse struct {
-		AudioContent string `json:"audioContent"`
+// renderPromptTemplate 依模式設定與語言選擇 prompt 模板並產生 prompt
+// kind 為 story、dog_response、chapter_regenerate 等；有 <name>.<lang> 模板時優先使用
+func renderPromptTemplate(mode *StoryModeDefinition, kind, lang string, data interface{}) (string, error) {
+	name := kind
+	if mode != nil && mode.Templates[kind] != "" {
+		name = mode.Templates[kind]
 	}
 
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read TTS response: %v", err)
-	}
+	storyModesMutex.RLock()
+	tmpl := promptTemplates
+	storyModesMutex.RUnlock()
 
-	if err := json.Unmarshal(bodyBytes, &ttsResponse); err != nil {
-		return fmt.Errorf("failed to parse TTS response: %v", err)
+	if tmpl != nil && tmpl.Lookup(name+"."+lang) != nil {
+		name = name + "." + lang
 	}
-
-	audioData, err := base64.StdEncoding.DecodeString(ttsResponse.AudioContent)
-	if err != nil {
-		return fmt.Errorf("failed to decode audio: %v", err)
+	if tmpl == nil || tmpl.Lookup(name) == nil {
+		return "", fmt.Errorf("prompt template %q not found", name)
 	}
 
-	if err := os.WriteFile(outputPath, audioData, 0644); err != nil {
-		return fmt.Errorf("failed to write audio file: %v", err)
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", fmt.Errorf("failed to render prompt template %s: %v", name, err)
 	}
+	return buf.String(), nil
+}
 
-	return nil
+// PromptContext 所有 prompt 模板共用的變數
+type PromptContext struct {
+	DogName    string
+	DogBreed   string
+	OwnerTitle string
+	Mode       StoryModePrompt
+	Language   *LanguageProfile
+
+	Pets            []PetInfo
+	MultiPet        bool
+	NarrationStyle  string // multi, collective
+	PetsDescription string // 所有毛小孩的描述
+	FirstPetName    string
+	SpeciesLabel    string // 主要毛小孩的物種稱呼，例如「狗狗」「貓咪」
+	PetDetails      string // 只有一隻毛小孩時的補充資訊（個性等）
+
+	Occasion OccasionPromptData
 }
 
-// 壓縮圖片到指定大小
-func compressImage(inputPath string, maxWidth, maxHeight int) ([]byte, error) {
-	// 使用 FFmpeg 壓縮圖片
-	cmd := exec.Command("ffmpeg",
-		"-i", inputPath,
-		"-vf", fmt.Sprintf("scale='min(%d,iw)':min'(%d,ih)':force_original_aspect_ratio=decrease", maxWidth, maxHeight),
-		"-q:v", "5", // 品質 5（1-31，數字越小品質越高）
-		"-f", "image2",
-		"-",
-	)
+// StoryPromptData story 模板的變數
+type StoryPromptData struct {
+	PromptContext
+	Highlights string
+}
 
-	output, err := cmd.Output()
+// DogResponsePromptData dog_response 模板的變數
+type DogResponsePromptData struct {
+	PromptContext
+	OwnerMessage string
+	Memories     string
+}
+
+// ChapterPromptData chapter_regenerate 模板的變數
+type ChapterPromptData struct {
+	PromptContext
+	StoryTitle       string
+	ChapterCount     int
+	ChapterIndex     int
+	Caption          string
+	PrevNarration    string
+	CurrentNarration string
+	NextNarration    string
+	Feedback         string
+	Speaker          string
+}
+
+// newPromptContext 依專案與模式建立共用變數，modePrompt 選擇要用模式的 story 或 dog_response 設定
+func newPromptContext(project *Project, ownerTitle string, modePrompt StoryModePrompt) (PromptContext, error) {
+	lang := getLanguageProfile(project.Language)
+	pets := projectPets(project)
+	ctx := PromptContext{
+		DogName:         pets[0].Name,
+		DogBreed:        pets[0].Breed,
+		OwnerTitle:      ownerTitle,
+		Language:        lang,
+		Pets:            pets,
+		MultiPet:        len(pets) > 1,
+		NarrationStyle:  project.NarrationStyle,
+		PetsDescription: describePets(pets, lang.Code),
+		FirstPetName:    pets[0].Name,
+		SpeciesLabel:    speciesLabel(pets[0].Species, lang.Code),
+		PetDetails:      petDetails(pets[0], lang.Code),
+	}
+	if ctx.MultiPet {
+		ctx.DogName = petNames(pets, lang.Code)
+		ctx.SpeciesLabel = speciesLabel("other", lang.Code)
+	}
+	if ctx.DogBreed == "" {
+		ctx.DogBreed = ctx.SpeciesLabel
+	}
+
+	occasion, err := renderOccasionPrompt(resolveProjectOccasion(project), lang.Code, ctx)
 	if err != nil {
-		return nil, fmt.Errorf("ffmpeg compress error: %v", err)
+		return ctx, fmt.Errorf("failed to render occasion prompt: %v", err)
 	}
+	ctx.Occasion = occasion
 
-	return output, nil
+	rendered, err := renderModePrompt(modePrompt, ctx)
+	if err != nil {
+		return ctx, fmt.Errorf("failed to render mode prompt: %v", err)
+	}
+	ctx.Mode = rendered
+	return ctx, nil
 }
 
 // ============================================================================
-// Subtitles and Background Music
+// Occasions
 // ============================================================================
 
-func addSubtitles(project *Project, inputVideo, outputVideo string) error {
-	log.Printf("Adding subtitles to video for project %s", project.ID)
+const defaultOccasion = "memorial"
+
+// OccasionDefinition 影片的場合（紀念、生日、回家紀念日…），與故事模式各自獨立
+type OccasionDefinition struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	OccasionPrompt
+	Music       OccasionMusic             `json:"music"`
+	ColorFilter string                    `json:"color_filter,omitempty"` // 套用在每個片段上的 FFmpeg 調色濾鏡
+	ThemeColor  string                    `json:"theme_color,omitempty"`  // 主題色 #RRGGBB，用於填充背景
+	Locales     map[string]OccasionLocale `json:"locales,omitempty"`
+	Source      string                    `json:"source"`
+}
 
-	// 建立 SRT 字幕檔案
-	outputDir := filepath.Dir(inputVideo)
-	srtPath := filepath.Join(outputDir, "subtitles.srt")
+// OccasionPrompt 場合影響 prompt 與結尾卡片的文字，內容本身也是模板
+type OccasionPrompt struct {
+	Arc             []string `json:"arc"`                    // 各段對白的情緒安排
+	ResponseContext string   `json:"response_context"`       // 主人的話裡充滿了什麼
+	ResponseTone    string   `json:"response_tone"`          // 結尾回應的語氣
+	EndingTitle     string   `json:"ending_title,omitempty"` // 結尾卡片的標題，空白時不顯示
+}
 
-	f, err := os.Create(srtPath)
-	if err != nil {
-		return fmt.Errorf("failed to create subtitle file: %v", err)
-	}
-	defer f.Close()
+// OccasionLocale 場合在特定語言下的文字
+type OccasionLocale struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	OccasionPrompt
+}
 
-	// 生成 SRT 格式字幕
-	currentTime := 0.0
-	subtitleIndex := 1
+// OccasionMusic 場合的背景音樂設定
+type OccasionMusic struct {
+	Mood  string    `json:"mood,omitempty"`  // gentle, cheerful, warm, playful，自動挑選音樂庫曲目時使用
+	Chord []float64 `json:"chord,omitempty"` // 音樂庫沒有合適的曲目時用來生成背景音樂的和弦頻率
+}
 
-	// 添加前 5 個影片的字幕（狗狗的對白）
-	for _, chapter := range project.Story.Chapters {
-		startTime := currentTime
-		endTime := currentTime + chapter.Duration
+// OccasionPromptData 套用到 prompt 模板中的場合文字
+type OccasionPromptData struct {
+	ID   string
+	Name string
+	OccasionPrompt
+}
 
-		// SRT 格式
-		fmt.Fprintf(f, "%d\n", subtitleIndex)
-		fmt.Fprintf(f, "%s --> %s\n", formatSRTTime(startTime), formatSRTTime(endTime))
-		fmt.Fprintf(f, "%s\n\n", chapter.Narration)
+var occasions = make(map[string]*OccasionDefinition)
 
-		currentTime = endTime
-		subtitleIndex++
+// localized 取得場合在指定語言下的文字，沒有翻譯的欄位使用預設內容
+func (o *OccasionDefinition) localized(lang string) OccasionLocale {
+	locale, ok := o.Locales[lang]
+	if !ok {
+		return OccasionLocale{Name: o.Name, Description: o.Description, OccasionPrompt: o.OccasionPrompt}
+	}
+	if locale.Name == "" {
+		locale.Name = o.Name
+	}
+	if locale.Description == "" {
+		locale.Description = o.Description
+	}
+	if len(locale.Arc) == 0 {
+		locale.Arc = o.Arc
+	}
+	if locale.ResponseContext == "" {
+		locale.ResponseContext = o.ResponseContext
+	}
+	if locale.ResponseTone == "" {
+		locale.ResponseTone = o.ResponseTone
+	}
+	if locale.EndingTitle == "" {
+		locale.EndingTitle = o.EndingTitle
 	}
+	return locale
+}
 
-	// 結尾部分的字幕已由 addEndingImage 直接燒錄到影片中，此處不再添加 SRT 字幕
-	// 這樣可以避免字幕重複或樣式衝突，並符合用戶需求
+// lookupOccasion 取得場合定義
+func lookupOccasion(id string) *OccasionDefinition {
+	storyModesMutex.RLock()
+	defer storyModesMutex.RUnlock()
+	return occasions[id]
+}
 
-	// 使用 FFmpeg 將字幕燒錄到影片中
-	// 字幕樣式：白色文字、黑色邊框、底部居中
-	// 字體大小改為 16，適中顯示
-	subtitleStyle := "FontSize=16,PrimaryColour=&H00FFFFFF,OutlineColour=&H00000000,BorderStyle=1,Outline=1,Shadow=1,MarginV=30"
+// resolveProjectOccasion 取得專案的場合，找不到時退回預設場合
+func resolveProjectOccasion(project *Project) *OccasionDefinition {
+	if occasion := lookupOccasion(project.Occasion); occasion != nil {
+		return occasion
+	}
+	if project.Occasion != "" {
+		log.Printf("⚠️ Occasion %s not found, falling back to %s", project.Occasion, defaultOccasion)
+	}
+	return lookupOccasion(defaultOccasion)
+}
 
-	log.Printf("📝 Adding subtitles with style: %s", subtitleStyle)
-	log.Printf("📄 Subtitle file: %s", srtPath)
+// listOccasions 列出所有場合
+func listOccasions() []gin.H {
+	storyModesMutex.RLock()
+	defer storyModesMutex.RUnlock()
 
-	// 複製字幕檔案到沒有空格的臨時路徑（避免 FFmpeg filter 路徑解析問題）
-	tempSrtPath := filepath.Join(os.TempDir(), "subtitles_temp.srt")
-	srtContent, err := os.ReadFile(srtPath)
-	if err != nil {
-		return fmt.Errorf("failed to read srt file: %v", err)
+	ids := make([]string, 0, len(occasions))
+	for id := range occasions {
+		ids = append(ids, id)
 	}
-	if err := os.WriteFile(tempSrtPath, srtContent, 0644); err != nil {
-		return fmt.Errorf("failed to write temp srt file: %v", err)
+	sort.Strings(ids)
+
+	list := make([]gin.H, 0, len(ids))
+	for _, id := range ids {
+		occasion := occasions[id]
+		locales := make([]string, 0, len(occasion.Locales))
+		for code := range occasion.Locales {
+			locales = append(locales, code)
+		}
+		sort.Strings(locales)
+		list = append(list, gin.H{
+			"id":          occasion.ID,
+			"name":        occasion.Name,
+			"description": occasion.Description,
+			"music_mood":  occasion.Music.Mood,
+			"theme_color": occasion.ThemeColor,
+			"default":     occasion.ID == defaultOccasion,
+			"locales":     locales,
+		})
 	}
-	defer os.Remove(tempSrtPath)
+	return list
+}
 
-	log.Printf("📄 Using temp subtitle file: %s", tempSrtPath)
+// renderOccasionPrompt 將場合文字套上名字與稱呼等變數
+func renderOccasionPrompt(occasion *OccasionDefinition, lang string, data interface{}) (OccasionPromptData, error) {
+	locale := occasion.localized(lang)
+	rendered := OccasionPromptData{ID: occasion.ID, Name: locale.Name}
 
-	cmd := exec.Command("ffmpeg",
-		"-i", inputVideo,
-		"-vf", fmt.Sprintf("subtitles=%s:force_style='%s'", tempSrtPath, subtitleStyle),
-		"-c:a", "copy",
-		"-y",
-		outputVideo,
-	)
+	var err error
+	render := func(text string) string {
+		if err != nil || text == "" {
+			return text
+		}
+		var out string
+		out, err = renderInlineTemplate(text, data)
+		return out
+	}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("ffmpeg subtitle error: %v, output: %s", err, string(output))
+	for _, line := range locale.Arc {
+		rendered.Arc = append(rendered.Arc, render(line))
 	}
+	rendered.ResponseContext = render(locale.ResponseContext)
+	rendered.ResponseTone = render(locale.ResponseTone)
+	rendered.EndingTitle = render(locale.EndingTitle)
+	return rendered, err
+}
 
-	log.Printf("✅ Added subtitles for project %s (including ending)", project.ID)
-	return nil
+// occasionEndingTitle 結尾卡片的標題，場合沒有設定時回傳空字串
+func occasionEndingTitle(project *Project) string {
+	ctx, err := newPromptContext(project, projectOwnerTitle(project), StoryModePrompt{})
+	if err != nil {
+		log.Printf("⚠️ Failed to render ending title: %v", err)
+		return ""
+	}
+	return ctx.Occasion.EndingTitle
 }
 
-func formatSRTTime(seconds float64) string {
-	hours := int(seconds / 3600)
-	minutes := int((seconds - float64(hours*3600)) / 60)
-	secs := int(seconds) % 60
-	millis := int((seconds - float64(int(seconds))) * 1000)
+// ============================================================================
+// Languages
+// ============================================================================
 
-	return fmt.Sprintf("%02d:%02d:%02d,%03d", hours, minutes, secs, millis)
+const defaultLanguage = "zh-TW"
+
+// TTSVoice Google Cloud TTS 的聲音設定
+type TTSVoice struct {
+	Name         string  `json:"name"`
+	Gender       string  `json:"gender"`
+	SpeakingRate float64 `json:"speaking_rate"`
+	Pitch        float64 `json:"pitch"`
 }
 
-func addBackgroundMusic(project *Project, inputVideo, outputVideo string) error {
-	log.Printf("Adding background music to video for project %s", project.ID)
+// LanguageProfile 語言相關的所有設定：prompt、TTS 聲音、長度規則、斷行與字體
+type LanguageProfile struct {
+	Code              string       `json:"code"`
+	Name              string       `json:"name"`
+	TTSLanguageCode   string       `json:"tts_language_code"`
+	NarratorVoice     TTSVoice     `json:"narrator_voice"` // 章節旁白（狗狗）
+	OwnerVoice        TTSVoice     `json:"owner_voice"`    // 主人留言
+	DogVoice          TTSVoice     `json:"dog_voice"`      // 狗狗回應
+	CountWords        bool         `json:"count_words"`    // true 以單字數計算長度（英文），false 以字元數計算（中日文）
+	LengthUnit        string       `json:"length_unit"`    // prompt 中描述長度的單位
+	NarrationMin      int          `json:"narration_min"`
+	NarrationMax      int          `json:"narration_max"`
+	ResponseMin       int          `json:"response_min"`
+	ResponseMax       int          `json:"response_max"`
+	SubtitleWrapWidth int          `json:"subtitle_wrap_width"` // 1920 寬畫面下字幕每行最多字元數
+	SubtitleFont      string       `json:"subtitle_font"`
+	SubtitleLanguage  string       `json:"subtitle_language"` // 字幕軌的 ISO 639-2 語言代碼
+	FontFiles         []string     `json:"-"`                 // 找不到內附字體與 fontconfig 時的字體檔候選（macOS）
+	DefaultOwnerTitle string       `json:"default_owner_title"`
+	PromptInstruction string       `json:"-"` // 附加在 prompt 最後的輸出語言要求
+	ShortResponse     string       `json:"-"` // 預設的簡短回應，%s 為稱呼
+	LongResponse      string       `json:"-"` // 預設的完整回應，%s 為稱呼
+	PromptLabels      PromptLabels `json:"-"`
+}
 
-	// 生成背景音樂
-	outputDir := filepath.Dir(inputVideo)
-	musicPath := filepath.Join(outputDir, "background_music.mp3")
+// PromptLabels 程式帶入 prompt 的固定文字，跟著輸出語言，避免英文、日文的 prompt 中混入中文
+type PromptLabels struct {
+	Caption         string // 分析影片時 short_caption 的說明
+	Video           string // 高光片段的來源是影片
+	Photo           string // 高光片段的來源是照片
+	Emotion         string // 片段的情緒，%s 為 happy 等
+	NoCaption       string // 章節沒有對應的片段描述
+	FirstChapter    string // 沒有上一段
+	LastChapter     string // 沒有下一段
+	DefaultFeedback string // 重寫旁白時使用者沒有給意見
+}
 
-	// 先刪除舊的音樂文件（如果存在）
-	if _, err := os.Stat(musicPath); err == nil {
-		log.Printf("🗑️ Removing old background music file: %s", musicPath)
-		os.Remove(musicPath)
+var languageProfiles = map[string]*LanguageProfile{
+	"zh-TW": {
+		Code:              "zh-TW",
+		Name:              "繁體中文",
+		TTSLanguageCode:   "zh-TW",
+		NarratorVoice:     TTSVoice{Name: "cmn-TW-Wavenet-A", Gender: "FEMALE", SpeakingRate: 0.95, Pitch: 0.0}, // 台灣中文女聲
+		OwnerVoice:        TTSVoice{Name: "cmn-TW-Wavenet-C", Gender: "MALE", SpeakingRate: 0.9, Pitch: -2.0},   // 台灣中文男聲
+		DogVoice:          TTSVoice{Name: "cmn-TW-Wavenet-A", Gender: "FEMALE", SpeakingRate: 0.95, Pitch: 2.0},
+		LengthUnit:        "個中文字",
+		NarrationMin:      40,
+		NarrationMax:      70,
+		ResponseMin:       40,
+		ResponseMax:       60,
+		SubtitleWrapWidth: 24,
+		SubtitleFont:      "Noto Sans CJK TC",
+		SubtitleLanguage:  "chi",
+		FontFiles: []string{
+			"/System/Library/Fonts/STHeiti Medium.ttc",
+			"/System/Library/Fonts/PingFang.ttc",
+		},
+		DefaultOwnerTitle: "主人",
+		PromptInstruction: "請使用繁體中文撰寫所有文字。",
+		ShortResponse:     "%s，我愛你！",
+		LongResponse:      "%s，我也永遠愛你！每天和你在一起，是我最幸福的時光。",
+		PromptLabels: PromptLabels{
+			Caption:         "用繁體中文簡短描述這個影片的主要內容（15字以內）",
+			Video:           "影片",
+			Photo:           "照片",
+			Emotion:         "(情緒：%s)",
+			NoCaption:       "（沒有片段描述）",
+			FirstChapter:    "（這是第一段）",
+			LastChapter:     "（這是最後一段）",
+			DefaultFeedback: "（沒有特別意見，請換一種說法重寫）",
+		},
+	},
+	"zh-CN": {
+		Code:              "zh-CN",
+		Name:              "简体中文",
+		TTSLanguageCode:   "cmn-CN",
+		NarratorVoice:     TTSVoice{Name: "cmn-CN-Wavenet-A", Gender: "FEMALE", SpeakingRate: 0.95, Pitch: 0.0},
+		OwnerVoice:        TTSVoice{Name: "cmn-CN-Wavenet-B", Gender: "MALE", SpeakingRate: 0.9, Pitch: -2.0},
+		DogVoice:          TTSVoice{Name: "cmn-CN-Wavenet-A", Gender: "FEMALE", SpeakingRate: 0.95, Pitch: 2.0},
+		LengthUnit:        "個中文字",
+		NarrationMin:      40,
+		NarrationMax:      70,
+		ResponseMin:       40,
+		ResponseMax:       60,
+		SubtitleWrapWidth: 24,
+		SubtitleFont:      "Noto Sans CJK SC",
+		SubtitleLanguage:  "chi",
+		FontFiles: []string{
+			"/System/Library/Fonts/STHeiti Medium.ttc",
+			"/System/Library/Fonts/PingFang.ttc",
+		},
+		DefaultOwnerTitle: "主人",
+		PromptInstruction: "請使用簡體中文（中国大陆用語）撰寫所有文字，包括標題。",
+		ShortResponse:     "%s，我爱你！",
+		LongResponse:      "%s，我也永远爱你！每天和你在一起，是我最幸福的时光。",
+		PromptLabels: PromptLabels{
+			Caption:         "用简体中文简短描述这个视频的主要内容（15字以内）",
+			Video:           "视频",
+			Photo:           "照片",
+			Emotion:         "(情绪：%s)",
+			NoCaption:       "（没有片段描述）",
+			FirstChapter:    "（这是第一段）",
+			LastChapter:     "（这是最后一段）",
+			DefaultFeedback: "（没有特别意见，请换一种说法重写）",
+		},
+	},
+	"en": {
+		Code:              "en",
+		Name:              "English",
+		TTSLanguageCode:   "en-US",
+		NarratorVoice:     TTSVoice{Name: "en-US-Wavenet-F", Gender: "FEMALE", SpeakingRate: 0.95, Pitch: 0.0},
+		OwnerVoice:        TTSVoice{Name: "en-US-Wavenet-D", Gender: "MALE", SpeakingRate: 0.9, Pitch: -2.0},
+		DogVoice:          TTSVoice{Name: "en-US-Wavenet-F", Gender: "FEMALE", SpeakingRate: 0.95, Pitch: 2.0},
+		CountWords:        true,
+		LengthUnit:        "words",
+		NarrationMin:      25,
+		NarrationMax:      45,
+		ResponseMin:       25,
+		ResponseMax:       40,
+		SubtitleWrapWidth: 48,
+		SubtitleFont:      "Noto Sans",
+		SubtitleLanguage:  "eng",
+		FontFiles: []string{
+			"/System/Library/Fonts/Helvetica.ttc",
+			"/Library/Fonts/Arial.ttf",
+		},
+		DefaultOwnerTitle: "my human",
+		PromptInstruction: "Write everything in natural English.",
+		ShortResponse:     "%s, I love you!",
+		LongResponse:      "%s, I will love you forever! Every day with you was the happiest time of my life.",
+		PromptLabels: PromptLabels{
+			Caption:         "A short English description of what happens in the video (10 words or fewer)",
+			Video:           "Video",
+			Photo:           "Photo",
+			Emotion:         "(emotion: %s)",
+			NoCaption:       "(no clip description)",
+			FirstChapter:    "(this is the first part)",
+			LastChapter:     "(this is the last part)",
+			DefaultFeedback: "(no specific feedback, please rewrite it in a different way)",
+		},
+	},
+	"ja": {
+		Code:              "ja",
+		Name:              "日本語",
+		TTSLanguageCode:   "ja-JP",
+		NarratorVoice:     TTSVoice{Name: "ja-JP-Wavenet-B", Gender: "FEMALE", SpeakingRate: 0.95, Pitch: 0.0},
+		OwnerVoice:        TTSVoice{Name: "ja-JP-Wavenet-C", Gender: "MALE", SpeakingRate: 0.9, Pitch: -2.0},
+		DogVoice:          TTSVoice{Name: "ja-JP-Wavenet-B", Gender: "FEMALE", SpeakingRate: 0.95, Pitch: 2.0},
+		LengthUnit:        "個日文字（假名與漢字都算一個字）",
+		NarrationMin:      50,
+		NarrationMax:      90,
+		ResponseMin:       50,
+		ResponseMax:       80,
+		SubtitleWrapWidth: 24,
+		SubtitleFont:      "Noto Sans CJK JP",
+		SubtitleLanguage:  "jpn",
+		FontFiles: []string{
+			"/System/Library/Fonts/ヒラギノ角ゴシック W3.ttc",
+			"/System/Library/Fonts/Hiragino Sans GB.ttc",
+		},
+		DefaultOwnerTitle: "ご主人",
+		PromptInstruction: "請使用自然的日文撰寫所有文字（包括標題），不要使用中文。",
+		ShortResponse:     "%s、大好きだよ！",
+		LongResponse:      "%s、ずっと大好きだよ！一緒にいた毎日が、ぼくの一番幸せな時間だった。",
+		PromptLabels: PromptLabels{
+			Caption:         "動画の主な内容を日本語で短く説明（20文字以内）",
+			Video:           "動画",
+			Photo:           "写真",
+			Emotion:         "（感情：%s）",
+			NoCaption:       "（シーンの説明なし）",
+			FirstChapter:    "（これが最初のパートです）",
+			LastChapter:     "（これが最後のパートです）",
+			DefaultFeedback: "（特に要望はありません。別の言い方で書き直してください）",
+		},
+	},
+}
+
+// getLanguageProfile 取得語言設定，不支援的語言退回預設語言
+func getLanguageProfile(code string) *LanguageProfile {
+	if profile, ok := languageProfiles[code]; ok {
+		return profile
 	}
+	return languageProfiles[defaultLanguage]
+}
 
-	// 檢查是否有指定的背景音樂檔案
-	specificBGM := "./狗狗影片/bibi-pianopachelbels-canon-终于弹了这首-世界上最治愈的钢琴曲卡农.mp3"
-	musicCopied := false
+// promptLanguage 專案實際使用的語言代碼
+func promptLanguage(project *Project) string {
+	return getLanguageProfile(project.Language).Code
+}
 
-	log.Printf("🎵 Checking for specific BGM file: %s", specificBGM)
-	if stat, err := os.Stat(specificBGM); err == nil {
-		log.Printf("✅ Found specific BGM file: %s (size: %d bytes)", specificBGM, stat.Size())
+// projectOwnerTitle 主人的稱呼，沒有設定時使用語言預設值
+func projectOwnerTitle(project *Project) string {
+	if project.OwnerRelationship != "" {
+		return project.OwnerRelationship
+	}
+	return getLanguageProfile(project.Language).DefaultOwnerTitle
+}
 
-		// 複製到輸出目錄以避免檔名問題
-		inputMusic, err := os.ReadFile(specificBGM)
-		if err == nil {
-			log.Printf("📖 Successfully read BGM file, size: %d bytes", len(inputMusic))
-			if err := os.WriteFile(musicPath, inputMusic, 0644); err != nil {
-				log.Printf("❌ Failed to copy BGM, falling back to generation: %v", err)
-			} else {
-				// 驗證寫入
-				if verifyStats, err := os.Stat(musicPath); err == nil {
-					log.Printf("✅ Successfully copied BGM to: %s (size: %d bytes)", musicPath, verifyStats.Size())
-					musicCopied = true
-				} else {
-					log.Printf("❌ Failed to verify copied BGM file: %v", err)
-				}
-			}
-		} else {
-			log.Printf("❌ Failed to read BGM, falling back to generation: %v", err)
+// textLength 依語言規則計算長度：英文算單字，中日文算字元（不含空白）
+func textLength(text string, lang *LanguageProfile) int {
+	if lang.CountWords {
+		return len(strings.Fields(text))
+	}
+	count := 0
+	for _, r := range text {
+		if !unicode.IsSpace(r) {
+			count++
 		}
-	} else {
-		log.Printf("❌ Specific BGM not found: %s, error: %v", specificBGM, err)
 	}
+	return count
+}
 
-	// 如果沒有複製成功，則生成
-	if !musicCopied {
-		// 取得影片時長
-		videoDuration := getVideoDuration(inputVideo)
-		if videoDuration == 0 {
-			return fmt.Errorf("failed to get video duration")
-		}
+// isClosingPunctuation 不應該出現在行首的標點
+func isClosingPunctuation(r rune) bool {
+	return strings.ContainsRune("。，、！？；：」』）》…,.!?;:)", r)
+}
 
-		log.Printf("Generating background music with duration %.2fs", videoDuration)
-		// 生成柔和的背景音樂
-		if err := generateBackgroundMusic(musicPath, videoDuration); err != nil {
-			return fmt.Errorf("failed to generate music: %v", err)
+// isBreakPunctuation 可以自然截斷句子的標點
+func isBreakPunctuation(r rune) bool {
+	return strings.ContainsRune("。，！？、.,!?", r)
+}
+
+// truncateToLength 將文字截到 maxLen 以內，盡量停在 minLen 之後的標點上
+func truncateToLength(text string, lang *LanguageProfile, minLen, maxLen int) string {
+	if lang.CountWords {
+		words := strings.Fields(text)
+		if len(words) <= maxLen {
+			return text
+		}
+		words = words[:maxLen]
+		for i := len(words) - 1; i >= minLen; i-- {
+			last := []rune(words[i])
+			if isBreakPunctuation(last[len(last)-1]) {
+				words = words[:i+1]
+				break
+			}
 		}
+		return strings.Join(words, " ")
 	}
 
-	// 將背景音樂與影片合併
-	// 用戶要求背景音樂音量 100% (volume=1.0)
-	// 原始影片音訊 (TTS) 音量保持 1.0
-	// 在最後 3 秒淡出音訊
-	videoDuration := getVideoDuration(inputVideo)
-	fadeStartTime := videoDuration - 3.0
-	if fadeStartTime < 0 {
-		fadeStartTime = 0
+	runes := []rune(text)
+	if len(runes) <= maxLen {
+		return text
 	}
-
-	// filter_complex: 混合音訊後，在最後 3 秒淡出
-	filterComplex := fmt.Sprintf("[0:a]volume=1.0[a1];[1:a]volume=1.0[a2];[a1][a2]amix=inputs=2:duration=shortest,afade=t=out:st=%.2f:d=3[aout]", fadeStartTime)
-	log.Printf("Audio filter: %s (video duration: %.2fs, fade start: %.2fs)", filterComplex, videoDuration, fadeStartTime)
-
-	cmd := exec.Command("ffmpeg",
-		"-i", inputVideo,
-		"-i", musicPath,
-		"-filter_complex", filterComplex,
-		"-map", "0:v",
-		"-map", "[aout]",
-		"-c:v", "copy",
-		"-c:a", "aac",
-		"-y",
-		outputVideo,
-	)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		// 如果混合失敗（可能沒有原始音訊），嘗試直接加入音樂並淡出
-		log.Printf("Audio mix failed, trying direct add with fade: %v", err)
-		fadeFilter := fmt.Sprintf("afade=t=out:st=%.2f:d=3", fadeStartTime)
-		cmd = exec.Command("ffmpeg",
-			"-i", inputVideo,
-			"-i", musicPath,
-			"-filter_complex", fmt.Sprintf("[1:a]%s[aout]", fadeFilter),
-			"-map", "0:v",
-			"-map", "[aout]",
-			"-c:v", "copy",
-			"-c:a", "aac",
-			"-shortest",
-			"-y",
-			outputVideo,
-		)
-
-		output, err = cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("ffmpeg music add error: %v, output: %s", err, string(output))
+	runes = runes[:maxLen]
+	for i := len(runes) - 1; i >= minLen; i-- {
+		if isBreakPunctuation(runes[i]) {
+			return string(runes[:i+1])
 		}
 	}
-
-	log.Printf("Added background music for project %s", project.ID)
-	return nil
+	return string(runes)
 }
 
-func generateBackgroundMusic(outputPath string, duration float64) error {
-	// 生成溫柔的背景音樂
-	// 使用 C 大調和弦 (C-E-G)
-
-	cmd := exec.Command("ffmpeg",
-		"-f", "lavfi",
-		"-i", fmt.Sprintf("sine=frequency=261.63:duration=%.2f", duration),
-		"-f", "lavfi",
-		"-i", fmt.Sprintf("sine=frequency=329.63:duration=%.2f", duration),
-		"-f", "lavfi",
-		"-i", fmt.Sprintf("sine=frequency=392.00:duration=%.2f", duration),
-		"-filter_complex",
-		"[0:a]volume=0.3[a0];[1:a]volume=0.2[a1];[2:a]volume=0.15[a2];[a0][a1][a2]amix=inputs=3:duration=first[aout]",
-		"-map", "[aout]",
-		"-c:a", "libmp3lame",
-		"-b:a", "128k",
-		"-y",
-		outputPath,
-	)
+// ensureSentenceEnd 確保句子有結尾標點
+func ensureSentenceEnd(text string, lang *LanguageProfile) string {
+	if text == "" {
+		return text
+	}
+	runes := []rune(text)
+	last := runes[len(runes)-1]
+	if strings.ContainsRune("。！？!?.…", last) {
+		return text
+	}
+	// 以逗號結尾時換成句號
+	if last == '，' || last == ',' || last == '、' {
+		runes = runes[:len(runes)-1]
+	}
+	if lang.CountWords {
+		return string(runes) + "."
+	}
+	return string(runes) + "。"
+}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to generate music: %v, output: %s", err, string(output))
+// wrapTextForLanguage 依語言斷行：英文在空白處斷行，中日文按字數斷行並避免標點出現在行首
+func wrapTextForLanguage(text string, lang *LanguageProfile, maxChars int) string {
+	if !lang.CountWords {
+		return wrapTextForFFmpeg(text, maxChars)
+	}
+	if maxChars <= 0 {
+		return text
 	}
 
-	return nil
+	lines := []string{}
+	for _, paragraph := range strings.Split(text, "\n") {
+		words := strings.Fields(paragraph)
+		if len(words) == 0 {
+			lines = append(lines, "")
+			continue
+		}
+		line := words[0]
+		for _, word := range words[1:] {
+			if len([]rune(line))+1+len([]rune(word)) > maxChars {
+				lines = append(lines, line)
+				line = word
+			} else {
+				line += " " + word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
 }
 
 // ============================================================================
@@ -2916,11 +8941,27 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
 func createStorageDirectories() {
 	dirs := []string{
 		filepath.Join(storagePath, "videos"),
 		filepath.Join(storagePath, "frames"),
 		filepath.Join(storagePath, "highlights"),
+		filepath.Join(storagePath, "pets"),
+		filepath.Join(storagePath, "patterns"),
+		uploadTempPath,
 	}
 
 	for _, dir := range dirs {
@@ -2934,8 +8975,9 @@ func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, Upload-Offset, Upload-Checksum")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, HEAD, DELETE")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "Upload-Offset, Upload-Length")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)